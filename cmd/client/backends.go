@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gotunnel/pkg/health"
+	"gotunnel/pkg/log"
+	"gotunnel/pkg/protocol"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend selection policies for client.backend_policy.
+const (
+	backendRoundRobin = "round_robin" // Take healthy backends in turn
+	backendLeastConn  = "least_conn"  // Take the healthy backend with the fewest open relays
+	backendRandom     = "random"      // Take a random healthy backend
+)
+
+// backend is one local address a tunnel forwards users to.
+type backend struct {
+	Addr    string
+	healthy bool
+	active  int             // Relays currently open to this backend
+	tracker *health.Tracker // Damps check results into healthy/unhealthy, guarded by the pool's mu
+
+	lastErr   string        // Error of the last failed check, "" after a success
+	latency   time.Duration // Duration of the last probe
+	lastCheck time.Time
+}
+
+// backendPool spreads a tunnel's users over its backends and tracks their health.
+type backendPool struct {
+	mu       sync.Mutex
+	policy   string
+	opts     health.ProbeOptions
+	check    string // Check type reported in health_report
+	backends []*backend
+	rr       int
+
+	// Called when the last healthy backend goes down and when the first one comes back
+	onAllDown func()
+	onAnyUp   func()
+	// Called after any backend changes state, once onAllDown/onAnyUp have run
+	onChange func()
+}
+
+// newBackendPool creates a pool over addrs, checked as opts describes. All backends start out
+// healthy so the tunnel can serve users before the first probe completes.
+func newBackendPool(addrs []string, policy string, opts health.ProbeOptions) *backendPool {
+	opts = opts.WithDefaults()
+	p := &backendPool{policy: policy, opts: opts, check: health.CheckTCP}
+	for _, addr := range addrs {
+		p.backends = append(p.backends, &backend{Addr: addr, healthy: true, tracker: health.NewTracker(opts)})
+	}
+	return p
+}
+
+// backendPolicy validates a configured policy, defaulting to round robin.
+func backendPolicy(requested string) (string, error) {
+	switch requested {
+	case "":
+		return backendRoundRobin, nil
+	case backendRoundRobin, backendLeastConn, backendRandom:
+		return requested, nil
+	}
+	return "", fmt.Errorf("unknown backend policy %q", requested)
+}
+
+// backendAddr normalises one client.backends entry: a bare port means a port on this host.
+func backendAddr(entry string) (string, error) {
+	entry = strings.TrimSpace(entry)
+	if port, err := strconv.Atoi(entry); err == nil {
+		if port <= 0 || port > 65535 {
+			return "", fmt.Errorf("invalid backend port %d", port)
+		}
+		return net.JoinHostPort("127.0.0.1", entry), nil
+	}
+	if _, _, err := net.SplitHostPort(entry); err != nil {
+		return "", fmt.Errorf("invalid backend %q: %v", entry, err)
+	}
+	return entry, nil
+}
+
+// validateBackends normalises the configured backends, policy and health check in place.
+func (c *ClientConfig) validateBackends() error {
+	policy, err := backendPolicy(c.BackendPolicy)
+	if err != nil {
+		return err
+	}
+	if _, err := health.NewChecker(c.HealthCheck); err != nil {
+		return err
+	}
+	c.BackendPolicy = policy
+	addrs := make([]string, 0, len(c.Backends))
+	for _, entry := range c.Backends {
+		addr, err := backendAddr(entry)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+	}
+	c.Backends = addrs
+	return nil
+}
+
+// backendAddrs returns the addresses the tunnel forwards to, the local port when no backends are configured.
+func (c *ClientConfig) backendAddrs() []string {
+	if len(c.Backends) > 0 {
+		return c.Backends
+	}
+	return []string{fmt.Sprintf("127.0.0.1:%d", c.LocalPort)}
+}
+
+// backendPoolMu guards the lazy creation of ClientConfig.backends.
+var backendPoolMu sync.Mutex
+
+// backendPool returns the tunnel's backend pool, creating it on first use.
+func (c *ClientConfig) backendPool() *backendPool {
+	backendPoolMu.Lock()
+	defer backendPoolMu.Unlock()
+	if c.backends == nil {
+		// The spec was checked by validateBackends, a nil checker falls back to TCP
+		opts := c.HealthProbe
+		opts.Checker, _ = health.NewChecker(c.HealthCheck)
+		c.backends = newBackendPool(c.backendAddrs(), c.BackendPolicy, opts)
+		if c.HealthCheck.Type != "" {
+			c.backends.check = c.HealthCheck.Type
+		}
+	}
+	return c.backends
+}
+
+// pick chooses a healthy backend according to the pool's policy and counts a relay against it.
+// It returns nil if no backend is healthy. Call release once the relay is done.
+func (p *backendPool) pick() *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var healthy []*backend
+	for _, b := range p.backends {
+		if b.healthy {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	var chosen *backend
+	switch p.policy {
+	case backendLeastConn:
+		chosen = healthy[0]
+		for _, b := range healthy[1:] {
+			if b.active < chosen.active {
+				chosen = b
+			}
+		}
+	case backendRandom:
+		chosen = healthy[rand.Intn(len(healthy))]
+	default:
+		chosen = healthy[p.rr%len(healthy)]
+		p.rr++
+	}
+	chosen.active++
+	return chosen
+}
+
+// watch sets the callbacks for the pool going down as a whole and coming back. If every backend
+// is already down, onAllDown fires right away so a fresh control connection learns about it.
+func (p *backendPool) watch(onAllDown, onAnyUp func()) {
+	p.mu.Lock()
+	p.onAllDown, p.onAnyUp = onAllDown, onAnyUp
+	down := p.healthyCount() == 0
+	p.mu.Unlock()
+	if down && onAllDown != nil {
+		onAllDown()
+	}
+}
+
+// watchChanges sets the callback run after any backend changes state.
+func (p *backendPool) watchChanges(onChange func()) {
+	p.mu.Lock()
+	p.onChange = onChange
+	p.mu.Unlock()
+}
+
+// release ends a relay counted by pick.
+func (p *backendPool) release(b *backend) {
+	p.mu.Lock()
+	b.active--
+	p.mu.Unlock()
+}
+
+// healthyCount returns how many backends are healthy. Callers hold p.mu.
+func (p *backendPool) healthyCount() int {
+	n := 0
+	for _, b := range p.backends {
+		if b.healthy {
+			n++
+		}
+	}
+	return n
+}
+
+// setHealthy records a check result for b, nil meaning healthy. Once the result tips b's
+// rise/fall thresholds it logs the change and fires onAllDown/onAnyUp when the pool as a whole
+// goes down or comes back.
+func (p *backendPool) setHealthy(b *backend, checkErr error) {
+	p.mu.Lock()
+	b.lastCheck = time.Now()
+	b.lastErr = ""
+	if checkErr != nil {
+		b.lastErr = checkErr.Error()
+	}
+	changed, held := b.tracker.Observe(checkErr == nil, b.lastCheck)
+	healthy := b.tracker.Alive()
+	b.healthy = healthy
+	n := p.healthyCount()
+	onAllDown, onAnyUp, onChange := p.onAllDown, p.onAnyUp, p.onChange
+	heldUntil := b.tracker.HeldUntil()
+	p.mu.Unlock()
+
+	if held {
+		log.Warn("client", "client.backend_flapping", map[string]interface{}{"Addr": b.Addr, "Until": heldUntil.Format(time.RFC3339)})
+	}
+	if !changed {
+		return
+	}
+	clientMetrics.healthTransitions.With(healthStatus(healthy)).Inc()
+	data := map[string]interface{}{"Addr": b.Addr, "Healthy": n, "Total": len(p.backends)}
+	if healthy {
+		log.Info("client", "client.backend_up", data)
+		if n == 1 && onAnyUp != nil {
+			onAnyUp()
+		}
+	} else {
+		data["Error"] = checkErr.Error()
+		log.Warn("client", "client.backend_down", data)
+		if n == 0 && onAllDown != nil {
+			onAllDown()
+		}
+	}
+	if onChange != nil {
+		onChange()
+	}
+}
+
+// report describes the health of every backend for a health_report.
+func (p *backendPool) report(port int) protocol.HealthReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rep := protocol.HealthReport{Type: "health_report", Port: port, Status: "down", Checker: p.check, Healthy: p.healthyCount()}
+	if rep.Healthy > 0 {
+		rep.Status = "up"
+	}
+	for _, b := range p.backends {
+		bh := protocol.BackendHealth{Addr: b.Addr, Status: "down", Error: b.lastErr, Latency: b.latency, Failures: b.tracker.Failures()}
+		if b.healthy {
+			bh.Status = "up"
+		}
+		if !b.lastCheck.IsZero() {
+			bh.LastCheck = b.lastCheck.Unix()
+		}
+		rep.Backends = append(rep.Backends, bh)
+	}
+	return rep
+}
+
+// probe checks every backend every interval until ctx is done. A check cut short by ctx is
+// dropped, so no callback fires once probe has returned.
+func (p *backendPool) probe(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	addrs := make([]string, len(p.backends))
+	for i, b := range p.backends {
+		addrs[i] = b.Addr
+	}
+	health.Probe(ctx, addrs, interval, p.opts, func(i int, r health.Result) {
+		b := p.backends[i]
+		p.mu.Lock()
+		b.latency = r.Latency
+		p.mu.Unlock()
+		p.setHealthy(b, r.Err)
+	})
+}
+
+// dialBackend connects to a healthy backend. A backend that refuses the connection counts as a
+// failed check and the next one is tried, so users do not wait for the next probe.
+func (p *backendPool) dialBackend() (net.Conn, *backend, error) {
+	var lastErr error
+	for range p.backends {
+		b := p.pick()
+		if b == nil {
+			break
+		}
+		log.Debugf("client", "client.connecting_local", b.Addr)
+		conn, err := net.DialTimeout("tcp", b.Addr, dialTimeout)
+		if err == nil {
+			return conn, b, nil
+		}
+		p.release(b)
+		p.setHealthy(b, err)
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no healthy backend")
+	}
+	return nil, nil, lastErr
+}
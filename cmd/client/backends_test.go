@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gotunnel/pkg/health"
+	"gotunnel/pkg/protocol"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var errDown = errors.New("connection refused")
+
+func TestValidateBackends(t *testing.T) {
+	conf := &ClientConfig{LocalPort: 22, Backends: []string{"8080", "10.0.0.2:80", "[::1]:443"}}
+	if err := conf.validateBackends(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"127.0.0.1:8080", "10.0.0.2:80", "[::1]:443"}
+	for i, addr := range conf.backendAddrs() {
+		if addr != want[i] {
+			t.Errorf("backend %d: expected %s, got %s", i, want[i], addr)
+		}
+	}
+	if conf.BackendPolicy != backendRoundRobin {
+		t.Errorf("expected round_robin by default, got %s", conf.BackendPolicy)
+	}
+
+	// 未配置后端时转发到本地端口
+	if addrs := (&ClientConfig{LocalPort: 22}).backendAddrs(); len(addrs) != 1 || addrs[0] != "127.0.0.1:22" {
+		t.Errorf("expected local port as only backend, got %v", addrs)
+	}
+	for _, bad := range []*ClientConfig{
+		{Backends: []string{"70000"}},
+		{Backends: []string{"no-port"}},
+		{BackendPolicy: "weighted"},
+	} {
+		if err := bad.validateBackends(); err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestBackendPool_Pick(t *testing.T) {
+	p := newBackendPool([]string{"a:1", "b:1", "c:1"}, backendRoundRobin, health.ProbeOptions{})
+	p.backends[1].healthy = false
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		b := p.pick()
+		seen[b.Addr]++
+		p.release(b)
+	}
+	// 不健康的后端不参与轮询
+	if seen["a:1"] != 2 || seen["c:1"] != 2 {
+		t.Errorf("expected even rotation over healthy backends, got %v", seen)
+	}
+
+	p = newBackendPool([]string{"a:1", "b:1"}, backendLeastConn, health.ProbeOptions{})
+	first := p.pick()
+	if second := p.pick(); second == first {
+		t.Error("least_conn should avoid the busy backend")
+	}
+
+	p = newBackendPool([]string{"a:1"}, backendRandom, health.ProbeOptions{})
+	p.backends[0].healthy = false
+	if p.pick() != nil {
+		t.Error("expected no backend when all are unhealthy")
+	}
+}
+
+func TestBackendPool_OfflineOnlyWhenAllDown(t *testing.T) {
+	p := newBackendPool([]string{"a:1", "b:1"}, backendRoundRobin, health.ProbeOptions{})
+	var down, up int
+	p.watch(func() { down++ }, func() { up++ })
+
+	p.setHealthy(p.backends[0], errDown)
+	if down != 0 {
+		t.Error("one healthy backend left, tunnel must stay online")
+	}
+	p.setHealthy(p.backends[1], errDown)
+	p.setHealthy(p.backends[1], errDown)
+	if down != 1 {
+		t.Errorf("expected one offline notification, got %d", down)
+	}
+	p.setHealthy(p.backends[0], nil)
+	p.setHealthy(p.backends[1], nil)
+	if up != 1 {
+		t.Errorf("expected one online notification, got %d", up)
+	}
+
+	// 新的控制连接接管时若后端已全部不可用，应立即通知下线
+	p.setHealthy(p.backends[0], errDown)
+	p.setHealthy(p.backends[1], errDown)
+	down = 0
+	p.watch(func() { down++ }, nil)
+	if down != 1 {
+		t.Error("expected immediate offline notification for a pool that is already down")
+	}
+}
+
+func TestBackendPool_DialSkipsDeadBackend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	p := newBackendPool([]string{deadAddr, ln.Addr().String()}, backendRoundRobin, health.ProbeOptions{})
+	conn, b, err := p.dialBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	p.release(b)
+	// 连接被拒的后端立即标记为不健康，不必等下一次探测
+	if b.Addr != ln.Addr().String() || p.backends[0].healthy {
+		t.Errorf("expected dead backend to be skipped and marked down, got %s", b.Addr)
+	}
+
+	ln.Close()
+	if _, _, err := p.dialBackend(); err == nil {
+		t.Error("expected error when no backend accepts")
+	}
+}
+
+func TestBackendPool_HealthCheck(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("client.health_check.type", "http")
+	viper.Set("client.health_check.path", "/healthz")
+	viper.Set("client.health_check.expect_status", 200)
+	viper.Set("client.health_check.min_cert_days", 7)
+	viper.Set("client.health_check.command", "check.sh --quick")
+	conf := loadClientConfig()
+	spec := conf.HealthCheck
+	if spec.Type != "http" || spec.Path != "/healthz" || spec.ExpectStatus != 200 ||
+		spec.MinCertValidity != 7*24*time.Hour || len(spec.Command) != 2 {
+		t.Fatalf("health check not loaded: %+v", spec)
+	}
+
+	// 端口能连上但应用返回500时，后端应判为不健康
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	conf = &ClientConfig{Backends: []string{srv.Listener.Addr().String()}, HealthCheck: spec}
+	if err := conf.validateBackends(); err != nil {
+		t.Fatal(err)
+	}
+	pool := conf.backendPool()
+	down := make(chan struct{}, 1)
+	pool.watch(func() { down <- struct{}{} }, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	go pool.probe(ctx, time.Hour)
+	select {
+	case <-down:
+	case <-time.After(2 * time.Second):
+		t.Error("expected backend answering 500 to be marked down")
+	}
+	cancel()
+
+	if err := (&ClientConfig{HealthCheck: health.CheckSpec{Type: "ping"}}).validateBackends(); err == nil {
+		t.Error("expected unknown health check type to be rejected")
+	}
+}
+
+func TestBackendPool_FallThreshold(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("client.health_check.fall", 2)
+	viper.Set("client.health_check.rise", 3)
+	viper.Set("client.health_check.timeout", 0.5)
+	viper.Set("client.health_check.flap_limit", 4)
+	conf := loadClientConfig()
+	opts := conf.HealthProbe
+	if opts.Fall != 2 || opts.Rise != 3 || opts.Timeout != 500*time.Millisecond || opts.FlapWindow != 5*time.Minute {
+		t.Fatalf("probe options not loaded: %+v", opts)
+	}
+
+	// 单次失败不下线，连续两次失败才触发 onAllDown
+	p := newBackendPool([]string{"a:1"}, backendRoundRobin, opts)
+	var down int
+	p.watch(func() { down++ }, nil)
+	p.setHealthy(p.backends[0], errDown)
+	if down != 0 || p.pick() == nil {
+		t.Fatal("one failure should not take the backend down with fall 2")
+	}
+	p.setHealthy(p.backends[0], errDown)
+	if down != 1 || p.pick() != nil {
+		t.Fatal("second failure should take the backend down")
+	}
+}
+
+func TestStartHealthReports(t *testing.T) {
+	conf := &ClientConfig{RemotePort: 20001, Backends: []string{"127.0.0.1:1", "127.0.0.1:2"}, HealthCheck: health.CheckSpec{Type: "http"}}
+	pool := conf.backendPool()
+	r, w := io.Pipe()
+	defer r.Close()
+	reports := make(chan protocol.HealthReport, 4)
+	go func() {
+		for {
+			packet, err := protocol.ReadPacket(r)
+			if err != nil {
+				return
+			}
+			var rep protocol.HealthReport
+			_ = json.Unmarshal(packet, &rep)
+			reports <- rep
+		}
+	}()
+	next := func() protocol.HealthReport {
+		select {
+		case rep := <-reports:
+			return rep
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected a health_report")
+		}
+		return protocol.HealthReport{}
+	}
+
+	stop := startHealthReports(conf, &mockConn{Writer: w})
+	defer stop()
+	// 启动时立即上报一次
+	if rep := next(); rep.Type != "health_report" || rep.Port != 20001 || rep.Status != "up" || rep.Checker != "http" || len(rep.Backends) != 2 {
+		t.Fatalf("unexpected initial report %+v", rep)
+	}
+	// 每次后端状态变化都上报，并带上错误与连续失败次数
+	pool.setHealthy(pool.backends[0], errDown)
+	rep := next()
+	if rep.Status != "up" || rep.Healthy != 1 || rep.Backends[0].Status != "down" || rep.Backends[0].Error != errDown.Error() || rep.Backends[0].Failures != 1 {
+		t.Fatalf("unexpected report after a backend went down %+v", rep)
+	}
+	pool.setHealthy(pool.backends[1], errDown)
+	if rep := next(); rep.Status != "down" || rep.Healthy != 0 {
+		t.Fatalf("expected tunnel reported down, got %+v", rep)
+	}
+}
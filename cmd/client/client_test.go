@@ -2,12 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"gotunnel/pkg/ha"
+	"gotunnel/pkg/health"
 	"gotunnel/pkg/log"
 	"gotunnel/pkg/protocol"
 	"io"
 	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -82,30 +88,9 @@ func TestRegisterPort_ReadPacketError(t *testing.T) {
 	}
 }
 
-func TestHeartbeatManager_StartStop(t *testing.T) {
-	var buf bytes.Buffer
-	conn := &mockConn{Reader: &buf, Writer: &buf}
-	mgr := &HeartbeatManager{Conn: conn, Interval: 1 * time.Millisecond, OnTimeout: func() {}}
-	mgr.StartHeartbeat()
-	time.Sleep(5 * time.Millisecond) // 确保至少发送一次心跳
-	mgr.StopHeartbeat()
-	time.Sleep(2 * time.Millisecond) // 确保停止后不再发送
-}
-
-func TestStartHeartbeat(t *testing.T) {
-	var buf bytes.Buffer
-	conn := &mockConn{Reader: &buf, Writer: &buf}
-	stop := StartHeartbeat(conn, 1*time.Millisecond, func() {})
-	time.Sleep(5 * time.Millisecond)
-	stop()
-	time.Sleep(2 * time.Millisecond)
-}
-
 func TestStartHealthProbe(t *testing.T) {
 	conf := &ClientConfig{Name: "test", LocalPort: 99999} // 使用不存在的端口
-	var buf bytes.Buffer
-	conn := &mockConn{Reader: &buf, Writer: &buf}
-	stop := StartHealthProbe(conf, conn,
+	stop := StartHealthProbe(conf,
 		func() { /* offline callback */ },
 		func() { /* online callback */ },
 	)
@@ -115,16 +100,75 @@ func TestStartHealthProbe(t *testing.T) {
 	time.Sleep(200 * time.Millisecond)
 }
 
+func TestHandleConnection_NoGoroutineLeak(t *testing.T) {
+	log.Init(log.LevelInfo, language.Chinese)
+	// 每次重连都会启动健康探针，断开后探针协程必须退出
+	var checks atomic.Int32
+	conf := &ClientConfig{
+		Name:                "test",
+		LocalPort:           99999,
+		RemotePort:          10022,
+		HeartbeatInterval:   1,
+		HealthCheckInterval: time.Millisecond,
+	}
+	conf.backends = newBackendPool(conf.backendAddrs(), backendRoundRobin, health.ProbeOptions{
+		Checker: checkerFunc(func(ctx context.Context, addr string) error {
+			checks.Add(1)
+			<-ctx.Done() // 模拟慢服务，检查只会被超时或停止打断
+			return ctx.Err()
+		}),
+		Timeout: time.Hour,
+	})
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		conn := &mockConn{Reader: bytes.NewReader(nil), Writer: &bytes.Buffer{}}
+		_ = handleConnection(conn, conf)
+	}
+	if checks.Load() == 0 {
+		t.Fatal("health probe never ran")
+	}
+	// 给已退出的协程一点时间完成调度
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		buf := make([]byte, 1<<16)
+		t.Fatalf("goroutines leaked across reconnects: %d before, %d after\n%s", before, after, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestStartHealthProbe_NoCallbackAfterStop(t *testing.T) {
+	conf := &ClientConfig{Name: "test", LocalPort: 99999, HealthCheckInterval: time.Millisecond}
+	var calls atomic.Int32
+	for i := 0; i < 20; i++ {
+		stop := StartHealthProbe(conf, func() { calls.Add(1) }, func() { calls.Add(1) })
+		time.Sleep(2 * time.Millisecond)
+		stop()
+		n := calls.Load()
+		time.Sleep(5 * time.Millisecond)
+		if calls.Load() != n {
+			t.Fatal("callback ran after stop returned")
+		}
+	}
+}
+
+// checkerFunc 把函数适配为 health.Checker
+type checkerFunc func(ctx context.Context, addr string) error
+
+func (f checkerFunc) Check(ctx context.Context, addr string) error { return f(ctx, addr) }
+
 func TestStartControlLoop_Pong(t *testing.T) {
 	var wbuf bytes.Buffer
-	pong := protocol.HeartbeatPong{Type: "pong", Time: time.Now().Unix()}
+	pong := protocol.HeartbeatPong{Type: "pong", Time: time.Now().UnixNano()}
 	b, _ := json.Marshal(pong)
 	protocol.WritePacket(&wbuf, b)
 	conn := &mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: &bytes.Buffer{}}
 	conf := &ClientConfig{LocalPort: 22}
 	done := make(chan error, 1)
 	go func() {
-		done <- StartControlLoop(conn, conf)
+		done <- StartControlLoop(conn, conf, nil)
 	}()
 	select {
 	case err := <-done:
@@ -146,11 +190,26 @@ func TestStartControlLoop_DataChannel(t *testing.T) {
 	protocol.WritePacket(&wbuf, []byte("invalid"))
 	conn := &mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: &bytes.Buffer{}}
 	conf := &ClientConfig{LocalPort: 22}
-	err := StartControlLoop(conn, conf)
+	err := StartControlLoop(conn, conf, nil)
 	// 由于本地端口22可能不存在，会返回错误或继续循环
 	_ = err
 }
 
+func TestStartControlLoop_GoAway(t *testing.T) {
+	var wbuf bytes.Buffer
+	b, _ := json.Marshal(protocol.GoAway{Type: "goaway", Reason: "server shutting down"})
+	protocol.WritePacket(&wbuf, b)
+	conn := &mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: &bytes.Buffer{}}
+	err := StartControlLoop(conn, &ClientConfig{LocalPort: 22}, nil)
+	goAway, ok := err.(*goAwayError)
+	if !ok {
+		t.Fatalf("expected goAwayError, got %v", err)
+	}
+	if goAway.reason != "server shutting down" {
+		t.Errorf("unexpected reason %q", goAway.reason)
+	}
+}
+
 func TestStartControlLoop_UnknownMessage(t *testing.T) {
 	// 测试未知消息类型（既不是pong也不是open_data_channel）
 	var wbuf bytes.Buffer
@@ -163,7 +222,7 @@ func TestStartControlLoop_UnknownMessage(t *testing.T) {
 	conf := &ClientConfig{LocalPort: 22}
 	done := make(chan error, 1)
 	go func() {
-		done <- StartControlLoop(conn, conf)
+		done <- StartControlLoop(conn, conf, nil)
 	}()
 	select {
 	case err := <-done:
@@ -228,7 +287,7 @@ func TestHandleConnection(t *testing.T) {
 	// Create a connection that will close immediately (simulating connection error)
 	var wbuf bytes.Buffer
 	// Send a pong message then close
-	pong := protocol.HeartbeatPong{Type: "pong", Time: time.Now().Unix()}
+	pong := protocol.HeartbeatPong{Type: "pong", Time: time.Now().UnixNano()}
 	b, _ := json.Marshal(pong)
 	protocol.WritePacket(&wbuf, b)
 
@@ -278,6 +337,125 @@ func TestLoadClientConfig_RemotePort(t *testing.T) {
 	}
 }
 
+func TestLoadClientConfig_RemotePortRange(t *testing.T) {
+	viper.Reset()
+	viper.Set("client.remote_port", "20000-20100")
+	conf := loadClientConfig()
+	if conf.RemotePort != 0 || conf.RemotePortRange != "20000-20100" {
+		t.Errorf("expected range 20000-20100 with port 0, got %d %q", conf.RemotePort, conf.RemotePortRange)
+	}
+}
+
+func TestRegisterPort_AssignedPort(t *testing.T) {
+	conf := &ClientConfig{Name: "test", Token: "tok", LocalPort: 1, RemotePortRange: "20000-20100"}
+	var rbuf, wbuf bytes.Buffer
+	resp := protocol.RegisterResponse{Type: "register_resp", Status: "ok", RemotePort: 20007, PublicAddr: "203.0.113.10:20007"}
+	b, _ := json.Marshal(resp)
+	protocol.WritePacket(&wbuf, b)
+	conn := &mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: &rbuf}
+	if err := RegisterPort(conn, conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.remotePort() != 20007 || conf.PublicAddr != "203.0.113.10:20007" {
+		t.Errorf("expected assigned port 20007, got %d %q", conf.remotePort(), conf.PublicAddr)
+	}
+	// 注册请求应携带端口范围
+	reqBytes, _ := protocol.ReadPacket(&rbuf)
+	var req protocol.RegisterRequest
+	_ = json.Unmarshal(reqBytes, &req)
+	if req.RemotePort != 0 || req.PortRange != "20000-20100" {
+		t.Errorf("unexpected register request %+v", req)
+	}
+}
+
+func TestRegisterPort_SessionResumed(t *testing.T) {
+	conf := &ClientConfig{Name: "test", Token: "tok", LocalPort: 1, SessionID: "abc123"}
+	var rbuf, wbuf bytes.Buffer
+	resp := protocol.RegisterResponse{Type: "register_resp", Status: "ok", RemotePort: 20001, Resumed: true}
+	b, _ := json.Marshal(resp)
+	protocol.WritePacket(&wbuf, b)
+	conn := &mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: &rbuf}
+	if err := RegisterPort(conn, conf); err != nil {
+		t.Fatal(err)
+	}
+	// 重连时应带上同一个会话ID，服务端据此恢复原映射
+	reqBytes, _ := protocol.ReadPacket(&rbuf)
+	var req protocol.RegisterRequest
+	_ = json.Unmarshal(reqBytes, &req)
+	if req.SessionID != "abc123" {
+		t.Errorf("expected session id in register request, got %q", req.SessionID)
+	}
+	if conf.remotePort() != 20001 {
+		t.Errorf("expected resumed port 20001, got %d", conf.remotePort())
+	}
+}
+
+func TestRegisterPort_AdaptedHeartbeatInterval(t *testing.T) {
+	conf := &ClientConfig{Name: "test", Token: "tok", LocalPort: 1, HeartbeatInterval: 30}
+	register := func(timeout int) protocol.RegisterRequest {
+		var rbuf, wbuf bytes.Buffer
+		b, _ := json.Marshal(protocol.RegisterResponse{Type: "register_resp", Status: "ok", HeartbeatTimeout: timeout})
+		protocol.WritePacket(&wbuf, b)
+		if err := RegisterPort(&mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: &rbuf}, conf); err != nil {
+			t.Fatal(err)
+		}
+		reqBytes, _ := protocol.ReadPacket(&rbuf)
+		var req protocol.RegisterRequest
+		_ = json.Unmarshal(reqBytes, &req)
+		return req
+	}
+	// 首次注册尚不知道服务端超时，上报配置的间隔，并声明会按超时调整，服务端据此不告警
+	if req := register(30); req.HeartbeatInterval != 30 || !req.HeartbeatAdapts {
+		t.Errorf("expected configured interval 30 with heartbeat_adapts on first registration, got %d/%v", req.HeartbeatInterval, req.HeartbeatAdapts)
+	}
+	// 重连时上报已按超时调整后的间隔，服务端不再告警
+	if req := register(30); req.HeartbeatInterval != 10 {
+		t.Errorf("expected adapted interval 10 on reconnect, got %d", req.HeartbeatInterval)
+	}
+}
+
+func TestLoadClientConfig_ShutdownTimeout(t *testing.T) {
+	viper.Reset()
+	if conf := loadClientConfig(); conf.ShutdownTimeout != 10*time.Second {
+		t.Errorf("expected default shutdown_timeout 10s, got %v", conf.ShutdownTimeout)
+	}
+	viper.Set("client.shutdown_timeout", 3)
+	if conf := loadClientConfig(); conf.ShutdownTimeout != 3*time.Second {
+		t.Errorf("expected shutdown_timeout 3s, got %v", conf.ShutdownTimeout)
+	}
+}
+
+func TestShutdownConnection(t *testing.T) {
+	out := &bytes.Buffer{}
+	conn := &mockConn{Reader: &bytes.Buffer{}, Writer: out}
+	conf := &ClientConfig{RemotePort: 10022, AssignedPort: 20001, ShutdownTimeout: 50 * time.Millisecond}
+
+	// 一条转发按时结束，另一条超时被强制断开
+	finished := conf.relayTracker().Track(&mockConn{}, &mockConn{})
+	stuck := &mockConn{}
+	conf.relayTracker().Track(stuck, &mockConn{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		finished()
+	}()
+
+	if cut := shutdownConnection(conn, conf); cut != 1 {
+		t.Errorf("expected 1 connection cut, got %d", cut)
+	}
+	if !stuck.closed {
+		t.Error("expected stuck relay to be closed")
+	}
+	packet, err := protocol.ReadPacket(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req protocol.UnregisterRequest
+	_ = json.Unmarshal(packet, &req)
+	if req.Type != "unregister" || req.Port != 20001 {
+		t.Errorf("expected unregister for assigned port, got %+v", req)
+	}
+}
+
 func TestLoadClientConfig_LogSettings(t *testing.T) {
 	viper.Reset()
 	viper.Set("client.log_level", "debug")
@@ -370,7 +548,7 @@ func TestHandleConnection_HealthProbeCallbacks(t *testing.T) {
 	log.Init(log.LevelInfo, language.Chinese)
 
 	var wbuf bytes.Buffer
-	pong := protocol.HeartbeatPong{Type: "pong", Time: time.Now().Unix()}
+	pong := protocol.HeartbeatPong{Type: "pong", Time: time.Now().UnixNano()}
 	b, _ := json.Marshal(pong)
 	protocol.WritePacket(&wbuf, b)
 
@@ -459,7 +637,7 @@ func TestStartControlLoop_DataChannelConnectError(t *testing.T) {
 	conf := &ClientConfig{LocalPort: 99999}
 	done := make(chan error, 1)
 	go func() {
-		done <- StartControlLoop(conn, conf)
+		done <- StartControlLoop(conn, conf, nil)
 	}()
 
 	select {
@@ -514,3 +692,249 @@ func TestLoadClientConfig_AllFields(t *testing.T) {
 		t.Errorf("expected health_check_interval %v, got %v", expected, conf.HealthCheckInterval)
 	}
 }
+
+func TestLoadClientConfig_Reconnect(t *testing.T) {
+	viper.Reset()
+	conf := loadClientConfig()
+	if conf.Reconnect.Base != time.Second || conf.Reconnect.Max != 60*time.Second || conf.Reconnect.MaxTries != 0 {
+		t.Errorf("unexpected default reconnect policy %+v", conf.Reconnect)
+	}
+	viper.Set("client.reconnect.base", 2)
+	viper.Set("client.reconnect.max", 30)
+	viper.Set("client.reconnect.jitter", 0)
+	viper.Set("client.reconnect.max_tries", 5)
+	viper.Set("client.reconnect.stable_after", 10)
+	conf = loadClientConfig()
+	if conf.Reconnect.Base != 2*time.Second || conf.Reconnect.Max != 30*time.Second ||
+		conf.Reconnect.Jitter != 0 || conf.Reconnect.MaxTries != 5 || conf.StableAfter != 10*time.Second {
+		t.Errorf("unexpected reconnect policy %+v stable_after=%v", conf.Reconnect, conf.StableAfter)
+	}
+}
+
+func TestWaitReconnect(t *testing.T) {
+	// 达到最大次数后放弃重连
+	attempts := clientMetrics.reconnectAttempts.Value()
+	b := &ha.Backoff{Base: time.Millisecond, MaxTries: 2}
+	if !waitReconnect(context.Background(), b) {
+		t.Error("first retry should be allowed")
+	}
+	if waitReconnect(context.Background(), b) {
+		t.Error("expected to give up after max tries")
+	}
+	// 只统计实际安排的重连
+	if got := clientMetrics.reconnectAttempts.Value() - attempts; got != 1 {
+		t.Errorf("expected 1 reconnect attempt counted, got %v", got)
+	}
+
+	// 退出时不再等待
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if waitReconnect(ctx, &ha.Backoff{Base: time.Hour}) {
+		t.Error("expected cancelled context to stop the reconnect loop")
+	}
+}
+
+func TestHandleConnection_PongTimeout(t *testing.T) {
+	// 服务端只读不回pong，模拟NAT丢弃后的半开连接
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+	conf := &ClientConfig{LocalPort: 1, HeartbeatInterval: 1, HeartbeatMaxMissed: 1, HealthCheckInterval: time.Hour}
+
+	done := make(chan error, 1)
+	go func() { done <- handleConnection(client, conf) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected control loop to end with an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dead control connection was not detected")
+	}
+}
+
+func TestStartControlLoop_RecordsPong(t *testing.T) {
+	// pong回显ping的纳秒时间戳，客户端据此计算往返时延
+	var wbuf bytes.Buffer
+	b, _ := json.Marshal(protocol.HeartbeatPong{Type: "pong", Time: time.Now().Add(-3 * time.Millisecond).UnixNano()})
+	protocol.WritePacket(&wbuf, b)
+	conn := &mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: &bytes.Buffer{}}
+	hb := &ha.HeartbeatManager{RTT: ha.NewRTTWindow(0)}
+	_ = StartControlLoop(conn, &ClientConfig{LocalPort: 22}, hb)
+	if time.Since(hb.LastPong()) > time.Second {
+		t.Error("expected pong to be recorded on the heartbeat manager")
+	}
+	if st := hb.RTT.Stats(); st.Samples != 1 || st.Last < 3*time.Millisecond {
+		t.Errorf("expected one rtt sample of at least 3ms, got %+v", st)
+	}
+}
+
+func TestLoadClientConfig_HeartbeatMaxMissed(t *testing.T) {
+	viper.Reset()
+	if conf := loadClientConfig(); conf.HeartbeatMaxMissed != 3 {
+		t.Errorf("expected default heartbeat_max_missed 3, got %d", conf.HeartbeatMaxMissed)
+	}
+	viper.Set("client.heartbeat_max_missed", 5)
+	if conf := loadClientConfig(); conf.HeartbeatMaxMissed != 5 {
+		t.Errorf("expected heartbeat_max_missed 5, got %d", conf.HeartbeatMaxMissed)
+	}
+}
+
+func TestClientConfig_HeartbeatInterval(t *testing.T) {
+	cases := []struct {
+		interval, timeout int
+		want              time.Duration
+	}{
+		{10, 0, 10 * time.Second},  // 服务端未通告超时，保持配置
+		{10, 30, 10 * time.Second}, // 配置合理
+		{40, 30, 10 * time.Second}, // 超过超时，缩短为超时的三分之一
+		{20, 30, 10 * time.Second}, // 一次丢包就会超时，同样缩短
+		{5, 2, time.Second},        // 不低于1秒
+	}
+	for _, c := range cases {
+		conf := &ClientConfig{HeartbeatInterval: c.interval, HeartbeatTimeout: c.timeout}
+		if got := conf.heartbeatInterval(); got != c.want {
+			t.Errorf("interval %ds timeout %ds: expected %v, got %v", c.interval, c.timeout, c.want, got)
+		}
+	}
+}
+
+func TestRegisterPort_HeartbeatTimeout(t *testing.T) {
+	conf := &ClientConfig{Name: "test", Token: "tok", LocalPort: 1, RemotePort: 10022, HeartbeatInterval: 40}
+	var rbuf, wbuf bytes.Buffer
+	b, _ := json.Marshal(protocol.RegisterResponse{Type: "register_resp", Status: "ok", HeartbeatTimeout: 30})
+	protocol.WritePacket(&wbuf, b)
+	conn := &mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: &rbuf}
+	if err := RegisterPort(conn, conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.HeartbeatTimeout != 30 || conf.heartbeatInterval() != 10*time.Second {
+		t.Errorf("expected interval adapted to server timeout, got timeout=%d interval=%v", conf.HeartbeatTimeout, conf.heartbeatInterval())
+	}
+	// 注册请求应上报客户端心跳间隔
+	reqBytes, _ := protocol.ReadPacket(&rbuf)
+	var req protocol.RegisterRequest
+	_ = json.Unmarshal(reqBytes, &req)
+	if req.HeartbeatInterval != 40 {
+		t.Errorf("expected heartbeat_interval 40 in request, got %d", req.HeartbeatInterval)
+	}
+}
+
+func TestStartControlLoop_EchoesConnID(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan protocol.RegisterRequest, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b, _ := protocol.ReadPacket(c)
+		var req protocol.RegisterRequest
+		_ = json.Unmarshal(b, &req)
+		got <- req
+	}()
+
+	// 数据通道注册须回传服务端分配的conn_id，组内用户才能对上号
+	var wbuf bytes.Buffer
+	b, _ := json.Marshal(protocol.RegisterRequest{Type: "open_data_channel", LocalPort: 22, ConnID: "c-42"})
+	protocol.WritePacket(&wbuf, b)
+	protocol.WritePacket(&wbuf, []byte("invalid"))
+	conn := &mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: &bytes.Buffer{}}
+	conf := &ClientConfig{ServerAddr: ln.Addr().String(), RemotePort: 9000}
+	_ = StartControlLoop(conn, conf, nil)
+
+	select {
+	case req := <-got:
+		if req.Type != "data_channel" || req.ConnID != "c-42" || req.RemotePort != 9000 {
+			t.Errorf("unexpected data channel registration %+v", req)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("data channel was not opened")
+	}
+}
+
+func TestRegisterPort_Group(t *testing.T) {
+	viper.Reset()
+	viper.Set("client.group", "web")
+	viper.Set("client.group_key", "secret")
+	viper.Set("client.lb_policy", "least_conn")
+	defer viper.Reset()
+	conf := loadClientConfig()
+	if conf.Group != "web" || conf.GroupKey != "secret" || conf.LBPolicy != "least_conn" {
+		t.Fatalf("group settings not loaded: %+v", conf)
+	}
+
+	var rbuf, wbuf bytes.Buffer
+	b, _ := json.Marshal(protocol.RegisterResponse{Type: "register_resp", Status: "ok", RemotePort: 20001})
+	protocol.WritePacket(&wbuf, b)
+	conn := &mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: &rbuf}
+	if err := RegisterPort(conn, conf); err != nil {
+		t.Fatal(err)
+	}
+	reqBytes, _ := protocol.ReadPacket(&rbuf)
+	var req protocol.RegisterRequest
+	_ = json.Unmarshal(reqBytes, &req)
+	if req.Group != "web" || req.GroupKey != "secret" || req.LBPolicy != "least_conn" {
+		t.Errorf("group fields missing from register request %+v", req)
+	}
+}
+
+func TestRegisterPort_BackupFor(t *testing.T) {
+	conf := &ClientConfig{Name: "db-standby", Token: "tok", LocalPort: 5432, BackupFor: "db"}
+	var rbuf, wbuf bytes.Buffer
+	b, _ := json.Marshal(protocol.RegisterResponse{Type: "register_resp", Status: "ok", RemotePort: 20001})
+	protocol.WritePacket(&wbuf, b)
+	conn := &mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: &rbuf}
+	if err := RegisterPort(conn, conf); err != nil {
+		t.Fatal(err)
+	}
+	// 备用隧道注册时须声明所备份的主隧道名称
+	reqBytes, _ := protocol.ReadPacket(&rbuf)
+	var req protocol.RegisterRequest
+	_ = json.Unmarshal(reqBytes, &req)
+	if req.BackupFor != "db" || conf.remotePort() != 20001 {
+		t.Errorf("unexpected backup registration %+v, port %d", req, conf.remotePort())
+	}
+}
+
+func TestRegisterPort_KeepOpen(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	page := t.TempDir() + "/maintenance.html"
+	if err := os.WriteFile(page, []byte("<h1>back soon</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("client.protocol", "http")
+	viper.Set("client.offline.keep_open", true)
+	viper.Set("client.offline.hold_timeout", 20)
+	viper.Set("client.offline.page", page)
+	conf := loadClientConfig()
+	if err := conf.loadMaintenancePage(); err != nil {
+		t.Fatal(err)
+	}
+
+	var rbuf, wbuf bytes.Buffer
+	b, _ := json.Marshal(protocol.RegisterResponse{Type: "register_resp", Status: "ok", RemotePort: 20001})
+	protocol.WritePacket(&wbuf, b)
+	conn := &mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: &rbuf}
+	if err := RegisterPort(conn, conf); err != nil {
+		t.Fatal(err)
+	}
+	// 注册时携带下线期间的处理方式及维护页内容
+	reqBytes, _ := protocol.ReadPacket(&rbuf)
+	var req protocol.RegisterRequest
+	_ = json.Unmarshal(reqBytes, &req)
+	if req.Protocol != "http" || !req.KeepOpen || req.HoldTimeout != 20 || req.MaintenancePage != "<h1>back soon</h1>" {
+		t.Errorf("unexpected keep_open registration %+v", req)
+	}
+
+	conf.MaintenancePageFile = page + ".missing"
+	if err := conf.loadMaintenancePage(); err == nil {
+		t.Error("expected a missing maintenance page to be reported")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"gotunnel/pkg/log"
+	"sync"
+)
+
+// legs returns the tunnels this client runs. Normally that is conf itself; in active-active mode
+// every server_addrs entry gets its own leg that registers the same mapping independently, so
+// either server can serve users and losing one does not interrupt the other.
+func (c *ClientConfig) legs() []*ClientConfig {
+	if !c.ActiveActive || len(c.ServerAddrs) < 2 {
+		return []*ClientConfig{c}
+	}
+	legs := make([]*ClientConfig, 0, len(c.ServerAddrs))
+	for i, addr := range c.ServerAddrs {
+		leg := *c
+		leg.Leg = addr
+		if c.SessionID != "" {
+			leg.SessionID = fmt.Sprintf("%s-%d", c.SessionID, i)
+		}
+		leg.ServerAddr = addr
+		leg.ServerAddrs = []string{addr}
+		leg.FailbackInterval = 0
+		leg.backends = nil // Each leg probes its backends and reports their health to its own server
+		leg.relays = nil   // and drains only its own data channels on shutdown
+		legs = append(legs, &leg)
+	}
+	return legs
+}
+
+// legStatus tracks which active-active legs are up so each one's state is reported on its own.
+type legStatus struct {
+	mu    sync.Mutex
+	up    map[string]bool
+	total int
+}
+
+func newLegStatus(legs []*ClientConfig) *legStatus {
+	return &legStatus{up: make(map[string]bool), total: len(legs)}
+}
+
+// reporter returns the onState callback for one leg. A single tunnel is not reported as a leg.
+func (s *legStatus) reporter(leg *ClientConfig) func(up bool) {
+	if leg.Leg == "" {
+		return func(bool) {}
+	}
+	return func(up bool) { s.set(leg.Leg, up) }
+}
+
+// set records a leg's state and logs it together with how many legs are still up.
+func (s *legStatus) set(leg string, up bool) {
+	s.mu.Lock()
+	if was, seen := s.up[leg]; seen && was == up {
+		s.mu.Unlock()
+		return
+	}
+	s.up[leg] = up
+	n := s.upCount()
+	s.mu.Unlock()
+
+	data := map[string]interface{}{"Leg": leg, "Up": n, "Total": s.total}
+	if up {
+		log.Info("client", "client.leg_up", data)
+	} else {
+		log.Warn("client", "client.leg_down", data)
+	}
+}
+
+// upCount returns the number of legs currently up. Callers hold s.mu.
+func (s *legStatus) upCount() int {
+	n := 0
+	for _, up := range s.up {
+		if up {
+			n++
+		}
+	}
+	return n
+}
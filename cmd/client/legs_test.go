@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"gotunnel/pkg/ha"
+	"gotunnel/pkg/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientConfig_Legs(t *testing.T) {
+	conf := &ClientConfig{ServerAddrs: []string{"a:17000", "b:17000"}, SessionID: "s", FailbackInterval: time.Second}
+	if legs := conf.legs(); len(legs) != 1 || legs[0] != conf {
+		t.Fatal("without active_active the client runs a single tunnel")
+	}
+	conf.ActiveActive = true
+	legs := conf.legs()
+	if len(legs) != 2 {
+		t.Fatalf("expected one leg per server, got %d", len(legs))
+	}
+	for i, leg := range legs {
+		if leg.Leg != conf.ServerAddrs[i] || len(leg.ServerAddrs) != 1 || leg.ServerAddrs[0] != conf.ServerAddrs[i] {
+			t.Errorf("leg %d should be pinned to %s, got %+v", i, conf.ServerAddrs[i], leg.ServerAddrs)
+		}
+		if leg.FailbackInterval != 0 {
+			t.Errorf("leg %d should not fail back", i)
+		}
+	}
+	// 各链路独立持有会话，互不影响
+	if legs[0].SessionID == legs[1].SessionID || legs[0] == conf {
+		t.Error("legs must not share session or config")
+	}
+}
+
+func TestShutdownConnection_OnlyDrainsOwnLeg(t *testing.T) {
+	conf := &ClientConfig{ServerAddrs: []string{"a:17000", "b:17000"}, ActiveActive: true, ShutdownTimeout: time.Second}
+	conf.relayTracker()
+	legs := conf.legs()
+	other := &mockConn{}
+	untrack := legs[1].relayTracker().Track(other, &mockConn{})
+	defer untrack()
+
+	// 一条链路关闭时只排空自己的数据通道，另一条链路的转发不受影响
+	start := time.Now()
+	if cut := shutdownConnection(&mockConn{Writer: &bytes.Buffer{}}, legs[0]); cut != 0 {
+		t.Errorf("expected nothing cut on leg a, got %d", cut)
+	}
+	if time.Since(start) > 500*time.Millisecond || other.closed {
+		t.Error("leg a waited for or cut a relay of leg b")
+	}
+	if legs[1].relayTracker().Active() != 1 {
+		t.Error("expected leg b's relay still tracked")
+	}
+}
+
+func TestLegStatus(t *testing.T) {
+	a, b := &ClientConfig{Leg: "a"}, &ClientConfig{Leg: "b"}
+	status := newLegStatus([]*ClientConfig{a, b})
+	status.reporter(a)(true)
+	status.reporter(b)(true)
+	status.reporter(a)(false)
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	if status.upCount() != 1 || status.up["a"] || !status.up["b"] {
+		t.Errorf("unexpected leg status %v", status.up)
+	}
+}
+
+func TestRunTunnel_ReportsState(t *testing.T) {
+	// 模拟服务端：注册成功后立即断开控制通道
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = protocol.ReadPacket(conn)
+			b, _ := json.Marshal(protocol.RegisterResponse{Type: "register_resp", Status: "ok"})
+			_ = protocol.WritePacket(conn, b)
+			conn.Close()
+		}
+	}()
+
+	conf := &ClientConfig{
+		ServerAddr: ln.Addr().String(), LocalPort: 1, HeartbeatInterval: 10, HealthCheckInterval: time.Hour,
+		Reconnect: ha.Backoff{Base: 10 * time.Millisecond},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	states := make(chan bool, 16)
+	done := make(chan struct{})
+	go func() {
+		runTunnel(ctx, conf, func(up bool) { states <- up })
+		close(done)
+	}()
+	for _, want := range []bool{true, false} {
+		select {
+		case got := <-states:
+			if got != want {
+				t.Fatalf("expected state %v, got %v", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("tunnel state not reported")
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("runTunnel did not stop on cancel")
+	}
+}
@@ -2,16 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"gotunnel/pkg/core"
 	"gotunnel/pkg/errors"
+	"gotunnel/pkg/ha"
 	"gotunnel/pkg/health"
 	"gotunnel/pkg/log"
 	"gotunnel/pkg/protocol"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -20,15 +27,84 @@ import (
 
 // ClientConfig holds the client configuration parameters.
 type ClientConfig struct {
-	Name                string
-	Token               string
-	ServerAddr          string
-	LocalPort           int
-	RemotePort          int
-	LogLevel            string
-	LogLang             string
-	HeartbeatInterval   int           // Heartbeat interval in seconds
-	HealthCheckInterval time.Duration // Health check interval
+	Name                 string
+	Token                string
+	ServerAddr           string
+	ServerAddrs          []string      // Servers to fail over between: "host:port" (all A/AAAA records) or "srv://name"
+	ServerSelection      string        // "priority" or "round_robin"
+	FailbackInterval     time.Duration // How often to probe the primary while on a backup, 0 disables failback
+	ActiveActive         bool          // Stay connected to every server in ServerAddrs at once instead of failing over
+	Leg                  string        // Server this copy of the config is dedicated to in active-active mode
+	LocalPort            int
+	Backends             []string // Addresses users are spread over, defaults to 127.0.0.1:LocalPort
+	BackendPolicy        string   // How users are spread over Backends: round_robin, least_conn or random
+	RemotePort           int      // Requested remote port, 0 lets the server allocate one
+	RemotePortRange      string   // Acceptable remote ports "min-max" when RemotePort is 0
+	BindAddr             string   // Server address or interface for the public listener, "" for the server default
+	Group                string   // Tunnel group to join, clients of one group share the remote port
+	GroupKey             string   // Key shared by the members of Group
+	LBPolicy             string   // How the server spreads users across the group: round_robin, least_conn or source_hash
+	BackupFor            string   // Name of the tunnel this client stands by for; it only gets users while that tunnel is down
+	Protocol             string   // "tcp" or "http", decides how the server answers users while the tunnel is offline
+	KeepOpen             bool     // Keep the public port open while the local service is down
+	HoldTimeout          int      // TCP: seconds users wait for the tunnel to come back while it is offline
+	MaintenancePageFile  string   // HTTP: page the server answers users with while the tunnel is offline
+	LogLevel             string
+	LogLang              string
+	HeartbeatInterval    int                 // Heartbeat interval in seconds
+	HeartbeatMaxMissed   int                 // Heartbeat intervals without a pong before reconnecting
+	HealthCheckInterval  time.Duration       // Health check interval
+	HealthReportInterval time.Duration       // Time between periodic health_report messages, 0 only reports transitions
+	HealthCheck          health.CheckSpec    // How backends are checked, TCP connect by default
+	HealthProbe          health.ProbeOptions // Probe timeout, rise/fall thresholds and flap damping
+	ShutdownTimeout      time.Duration       // Time open data channels get to finish on shutdown
+	Reconnect            ha.Backoff          // Delay policy between reconnect attempts
+	StableAfter          time.Duration       // A connection that lasted this long resets the reconnect backoff
+	MetricsAddr          string              // Listen address of the Prometheus /metrics endpoint, "" disables it
+
+	SessionID       string // Identifies this client process so the server can resume its mapping after a reconnect
+	nextServer      int    // Round-robin cursor into the server candidates
+	maintenancePage string // Contents of MaintenancePageFile
+	backends        *backendPool
+	relays          *core.Tracker // This leg's open data channels, so its shutdown only waits for its own
+
+	// Filled in by RegisterPort from the server's response
+	ActiveServer     string // Server address the control channel is connected to
+	AssignedPort     int    // Remote port granted by the server
+	PublicAddr       string // Public address users connect to
+	HeartbeatTimeout int    // Server's heartbeat timeout in seconds, 0 if the server does not advertise one
+}
+
+// newSessionID returns a random identifier for one client process.
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// heartbeatInterval returns the ping interval to use. A configured interval that leaves less than
+// two pings per server timeout is shortened to a third of the timeout so one lost ping is survivable.
+func (c *ClientConfig) heartbeatInterval() time.Duration {
+	interval := time.Duration(c.HeartbeatInterval) * time.Second
+	timeout := time.Duration(c.HeartbeatTimeout) * time.Second
+	if timeout <= 0 || 2*interval <= timeout {
+		return interval
+	}
+	adapted := timeout / 3
+	if adapted < time.Second {
+		adapted = time.Second
+	}
+	return adapted
+}
+
+// remotePort returns the remote port granted by the server, falling back to the configured one.
+func (c *ClientConfig) remotePort() int {
+	if c.AssignedPort > 0 {
+		return c.AssignedPort
+	}
+	return c.RemotePort
 }
 
 func loadClientConfig() *ClientConfig {
@@ -49,6 +125,15 @@ func loadClientConfig() *ClientConfig {
 	if serverAddr == "" {
 		serverAddr = "127.0.0.1:17000"
 	}
+	serverAddrs := viper.GetStringSlice("client.server_addrs")
+	selection := viper.GetString("client.server_selection")
+	if selection != selectRoundRobin {
+		selection = selectPriority
+	}
+	var failback time.Duration
+	if seconds := viper.GetInt("client.failback_interval"); seconds > 0 {
+		failback = time.Duration(seconds) * time.Second
+	}
 	localPort := 22
 	if viper.IsSet("client.local_ports") {
 		arr := viper.Get("client.local_ports").([]interface{})
@@ -60,8 +145,16 @@ func loadClientConfig() *ClientConfig {
 		}
 	}
 	remotePort := 10022 // Default value
+	var remotePortRange string
 	if viper.IsSet("client.remote_port") {
-		remotePort = viper.GetInt("client.remote_port")
+		// Accept either a fixed port or a range such as "20000-20100"
+		raw := strings.TrimSpace(viper.GetString("client.remote_port"))
+		if strings.Contains(raw, "-") {
+			remotePort = 0
+			remotePortRange = raw
+		} else {
+			remotePort = viper.GetInt("client.remote_port")
+		}
 	}
 	logLevel := viper.GetString("client.log_level")
 	if logLevel == "" {
@@ -78,6 +171,12 @@ func loadClientConfig() *ClientConfig {
 			heartbeatInterval = 10 // Ensure greater than 0
 		}
 	}
+	heartbeatMaxMissed := 3 // Default 3 intervals
+	if viper.IsSet("client.heartbeat_max_missed") {
+		if missed := viper.GetInt("client.heartbeat_max_missed"); missed >= 0 {
+			heartbeatMaxMissed = missed
+		}
+	}
 	healthCheckInterval := 30 * time.Second // Default 30 seconds
 	if viper.IsSet("client.health_check_interval") {
 		intervalSeconds := viper.GetInt("client.health_check_interval")
@@ -85,22 +184,117 @@ func loadClientConfig() *ClientConfig {
 			healthCheckInterval = time.Duration(intervalSeconds) * time.Second
 		}
 	}
+	healthCheck := health.CheckSpec{
+		Type:               viper.GetString("client.health_check.type"),
+		Path:               viper.GetString("client.health_check.path"),
+		Host:               viper.GetString("client.health_check.host"),
+		ExpectStatus:       viper.GetInt("client.health_check.expect_status"),
+		ExpectBody:         viper.GetString("client.health_check.expect_body"),
+		ServerName:         viper.GetString("client.health_check.server_name"),
+		InsecureSkipVerify: viper.GetBool("client.health_check.insecure_skip_verify"),
+		MinCertValidity:    time.Duration(viper.GetInt("client.health_check.min_cert_days")) * 24 * time.Hour,
+		Command:            viper.GetStringSlice("client.health_check.command"),
+	}
+	healthReportInterval := 60 * time.Second // Default 60 seconds
+	if viper.IsSet("client.health_report_interval") {
+		if seconds := viper.GetInt("client.health_report_interval"); seconds >= 0 {
+			healthReportInterval = time.Duration(seconds) * time.Second
+		}
+	}
+	healthProbe := health.ProbeOptions{
+		Rise:       viper.GetInt("client.health_check.rise"),
+		Fall:       viper.GetInt("client.health_check.fall"),
+		FlapLimit:  viper.GetInt("client.health_check.flap_limit"),
+		FlapWindow: time.Duration(viper.GetInt("client.health_check.flap_window")) * time.Second,
+	}
+	if seconds := viper.GetFloat64("client.health_check.timeout"); seconds > 0 {
+		healthProbe.Timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if healthProbe.FlapLimit > 0 && healthProbe.FlapWindow <= 0 {
+		healthProbe.FlapWindow = 5 * time.Minute
+	}
+	shutdownTimeout := 10 * time.Second // Default 10 seconds
+	if viper.IsSet("client.shutdown_timeout") {
+		if seconds := viper.GetInt("client.shutdown_timeout"); seconds >= 0 {
+			shutdownTimeout = time.Duration(seconds) * time.Second
+		}
+	}
+	protocolName := viper.GetString("client.protocol")
+	if protocolName == "" {
+		protocolName = "tcp"
+	}
+	reconnect := ha.Backoff{Base: time.Second, Max: 60 * time.Second, Jitter: 0.2}
+	if seconds := viper.GetInt("client.reconnect.base"); seconds > 0 {
+		reconnect.Base = time.Duration(seconds) * time.Second
+	}
+	if seconds := viper.GetInt("client.reconnect.max"); seconds > 0 {
+		reconnect.Max = time.Duration(seconds) * time.Second
+	}
+	if reconnect.Max < reconnect.Base {
+		reconnect.Max = reconnect.Base
+	}
+	if viper.IsSet("client.reconnect.jitter") {
+		if jitter := viper.GetFloat64("client.reconnect.jitter"); jitter >= 0 {
+			reconnect.Jitter = jitter
+		}
+	}
+	if tries := viper.GetInt("client.reconnect.max_tries"); tries > 0 {
+		reconnect.MaxTries = tries
+	}
+	stableAfter := 60 * time.Second // Default 60 seconds
+	if viper.IsSet("client.reconnect.stable_after") {
+		if seconds := viper.GetInt("client.reconnect.stable_after"); seconds >= 0 {
+			stableAfter = time.Duration(seconds) * time.Second
+		}
+	}
 	return &ClientConfig{
-		Name:                name,
-		Token:               token,
-		ServerAddr:          serverAddr,
-		LocalPort:           localPort,
-		RemotePort:          remotePort,
-		LogLevel:            logLevel,
-		LogLang:             logLang,
-		HeartbeatInterval:   heartbeatInterval,
-		HealthCheckInterval: healthCheckInterval,
+		Name:                 name,
+		Token:                token,
+		ServerAddr:           serverAddr,
+		ServerAddrs:          serverAddrs,
+		ServerSelection:      selection,
+		FailbackInterval:     failback,
+		ActiveActive:         viper.GetBool("client.active_active"),
+		LocalPort:            localPort,
+		Backends:             viper.GetStringSlice("client.backends"),
+		BackendPolicy:        viper.GetString("client.backend_policy"),
+		RemotePort:           remotePort,
+		RemotePortRange:      remotePortRange,
+		BindAddr:             viper.GetString("client.bind_addr"),
+		Group:                viper.GetString("client.group"),
+		GroupKey:             viper.GetString("client.group_key"),
+		LBPolicy:             viper.GetString("client.lb_policy"),
+		BackupFor:            viper.GetString("client.backup_for"),
+		LogLevel:             logLevel,
+		LogLang:              logLang,
+		HeartbeatInterval:    heartbeatInterval,
+		HeartbeatMaxMissed:   heartbeatMaxMissed,
+		HealthCheckInterval:  healthCheckInterval,
+		HealthReportInterval: healthReportInterval,
+		HealthCheck:          healthCheck,
+		HealthProbe:          healthProbe,
+		ShutdownTimeout:      shutdownTimeout,
+		Reconnect:            reconnect,
+		StableAfter:          stableAfter,
+		Protocol:             protocolName,
+		KeepOpen:             viper.GetBool("client.offline.keep_open"),
+		HoldTimeout:          viper.GetInt("client.offline.hold_timeout"),
+		MaintenancePageFile:  viper.GetString("client.offline.page"),
+		MetricsAddr:          viper.GetString("client.metrics_addr"),
 	}
 }
 
-// DialServer establishes a TCP connection to the server.
-func DialServer(conf *ClientConfig) (net.Conn, error) {
-	return net.Dial("tcp", conf.ServerAddr)
+// loadMaintenancePage reads MaintenancePageFile, if set, for the registration.
+func (c *ClientConfig) loadMaintenancePage() error {
+	if c.MaintenancePageFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(c.MaintenancePageFile)
+	if err != nil {
+		return err
+	}
+	c.maintenancePage = string(b)
+	return nil
 }
 
 // RegisterPort sends a port registration request to the server.
@@ -109,9 +303,26 @@ func RegisterPort(conn net.Conn, conf *ClientConfig) error {
 		Type:       "register",
 		LocalPort:  conf.LocalPort,
 		RemotePort: conf.RemotePort,
-		Protocol:   "tcp",
+		Protocol:   conf.Protocol,
 		Token:      conf.Token,
 		Name:       conf.Name,
+		PortRange:  conf.RemotePortRange,
+		BindAddr:   conf.BindAddr,
+		SessionID:  conf.SessionID,
+
+		// The interval in use, already shortened to a timeout advertised on an earlier registration
+		HeartbeatInterval: int(conf.heartbeatInterval() / time.Second),
+		HeartbeatAdapts:   true,
+
+		Group:    conf.Group,
+		GroupKey: conf.GroupKey,
+		LBPolicy: conf.LBPolicy,
+
+		BackupFor: conf.BackupFor,
+
+		KeepOpen:        conf.KeepOpen,
+		HoldTimeout:     conf.HoldTimeout,
+		MaintenancePage: conf.maintenancePage,
 	}
 	reqBytes, _ := json.Marshal(registerReq)
 	if err := protocol.WritePacket(conn, reqBytes); err != nil {
@@ -128,57 +339,102 @@ func RegisterPort(conn net.Conn, conf *ClientConfig) error {
 		log.Errorf("client", "error.register_failed", resp.Reason)
 		return fmt.Errorf("register failed: %s", resp.Reason)
 	}
+	if resp.RemotePort > 0 {
+		conf.AssignedPort = resp.RemotePort
+	}
+	conf.PublicAddr = resp.PublicAddr
+	conf.HeartbeatTimeout = resp.HeartbeatTimeout
+	if interval := conf.heartbeatInterval(); interval != time.Duration(conf.HeartbeatInterval)*time.Second {
+		log.Warn("client", "client.heartbeat_interval_adjusted", map[string]interface{}{
+			"Configured": time.Duration(conf.HeartbeatInterval) * time.Second,
+			"Timeout":    time.Duration(conf.HeartbeatTimeout) * time.Second,
+			"Interval":   interval,
+		})
+	}
+	if resp.Resumed {
+		log.Infof("client", "client.session_resumed", conf.remotePort())
+	}
+	if conf.BackupFor != "" {
+		log.Info("client", "client.standby_registered", map[string]interface{}{"Name": conf.BackupFor, "Port": conf.remotePort()})
+	}
+	log.Info("client", "client.port_assigned", map[string]interface{}{
+		"Port": conf.remotePort(),
+		"Addr": conf.PublicAddr,
+	})
 	return nil
 }
 
-// HeartbeatManager manages heartbeat sending and monitoring for control channel health.
-type HeartbeatManager struct {
-	Conn      net.Conn
-	Interval  time.Duration
-	OnTimeout func()
-	stop      chan struct{}
+// StartHealthProbe probes the tunnel's backends every HealthCheckInterval. onOffline is called
+// when the last healthy backend goes down, onOnline when one comes back. stop returns once the
+// probe goroutine has exited, neither callback runs after that.
+func StartHealthProbe(conf *ClientConfig, onOffline func(), onOnline func()) (stop func()) {
+	pool := conf.backendPool()
+	pool.watch(onOffline, onOnline)
+	ctx, cancel := context.WithCancel(context.Background())
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		pool.probe(ctx, conf.HealthCheckInterval)
+	}()
+	return func() {
+		pool.watch(nil, nil)
+		cancel()
+		<-exited
+	}
 }
 
-// StartHeartbeat starts the heartbeat goroutine that periodically sends ping packets.
-func (h *HeartbeatManager) StartHeartbeat() {
-	h.stop = make(chan struct{})
+// startHealthReports sends a health_report for the tunnel right away, after every backend state
+// change and every HealthReportInterval, so the server knows why the tunnel is up or down.
+// stop returns once no more reports are sent.
+func startHealthReports(conf *ClientConfig, conn net.Conn) (stop func()) {
+	pool := conf.backendPool()
+	send := func() {
+		b, _ := json.Marshal(pool.report(conf.remotePort()))
+		if err := protocol.WritePacket(conn, b); err != nil {
+			log.Errorf("client", "client.send_health_report_failed", err)
+		}
+	}
+	send()
+	pool.watchChanges(send)
+	ctx, cancel := context.WithCancel(context.Background())
+	exited := make(chan struct{})
 	go func() {
+		defer close(exited)
+		if conf.HealthReportInterval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(conf.HealthReportInterval)
+		defer ticker.Stop()
 		for {
 			select {
-			case <-h.stop:
+			case <-ctx.Done():
 				return
-			case <-time.After(h.Interval):
-				ping := protocol.HeartbeatPing{Type: "ping", Time: time.Now().Unix()}
-				b, _ := json.Marshal(ping)
-				_ = protocol.WritePacket(h.Conn, b)
+			case <-ticker.C:
+				send()
 			}
 		}
 	}()
+	return func() {
+		pool.watchChanges(nil)
+		cancel()
+		<-exited
+	}
 }
 
-// StopHeartbeat stops the heartbeat goroutine.
-func (h *HeartbeatManager) StopHeartbeat() { close(h.stop) }
-
-// StartHeartbeat creates and starts a heartbeat manager for the given connection.
-func StartHeartbeat(conn net.Conn, interval time.Duration, onTimeout func()) (stop func()) {
-	mgr := &HeartbeatManager{Conn: conn, Interval: interval, OnTimeout: onTimeout}
-	mgr.StartHeartbeat()
-	return mgr.StopHeartbeat
+// goAwayError is returned by StartControlLoop when the server asks the client to reconnect.
+// It marks a planned disconnect rather than a failure.
+type goAwayError struct {
+	reason string
 }
 
-// StartHealthProbe starts a periodic health probe for the local port.
-func StartHealthProbe(conf *ClientConfig, _ net.Conn, onOffline func(), onOnline func()) (stop func()) {
-	doneHealth := make(chan struct{})
-	go func() {
-		target := fmt.Sprintf("127.0.0.1:%d", conf.LocalPort)
-		health.PeriodicProbe(target, conf.HealthCheckInterval, onOffline, onOnline)
-		close(doneHealth)
-	}()
-	return func() { close(doneHealth) }
-}
+func (e *goAwayError) Error() string { return "server going away: " + e.reason }
 
 // StartControlLoop starts the main control loop that handles server messages.
-func StartControlLoop(conn net.Conn, conf *ClientConfig) error {
+// Pongs are reported to hb (may be nil) so it can detect a dead connection.
+func StartControlLoop(conn net.Conn, conf *ClientConfig, hb *ha.HeartbeatManager) error {
+	// Data channels belong to this connection's server and port. conf moves on with the next
+	// reconnect while late data channels of this one may still be opening.
+	server, remotePort := conf.activeServer(), conf.remotePort()
 	for {
 		packet, err := protocol.ReadPacket(conn)
 		if err != nil {
@@ -186,17 +442,30 @@ func StartControlLoop(conn net.Conn, conf *ClientConfig) error {
 		}
 		var ping protocol.HeartbeatPong
 		if err := json.Unmarshal(packet, &ping); err == nil && ping.Type == "pong" {
+			if hb != nil {
+				if rtt := hb.Pong(time.Unix(0, ping.Time)); rtt > 0 {
+					st := hb.RTT.Stats()
+					log.Debug("client", "client.heartbeat_rtt", map[string]interface{}{
+						"RTT": rtt.Round(time.Microsecond), "Min": st.Min.Round(time.Microsecond), "Avg": st.Avg.Round(time.Microsecond),
+						"Max": st.Max.Round(time.Microsecond), "Jitter": st.Jitter.Round(time.Microsecond),
+					})
+				}
+			}
 			continue
 		}
+		var goAway protocol.GoAway
+		if err := json.Unmarshal(packet, &goAway); err == nil && goAway.Type == "goaway" {
+			return &goAwayError{reason: goAway.Reason}
+		}
 		var ctrl protocol.RegisterRequest
 		_ = json.Unmarshal(packet, &ctrl)
 		if ctrl.Type == "open_data_channel" {
 			log.Infof("client", "client.data_channel_received", ctrl.LocalPort)
 			// Handle data channel establishment in a separate goroutine to avoid blocking control loop
-			go func(localPort int) {
+			go func(localPort int, connID string) {
 				startTime := time.Now()
 				// Establish a separate data channel connection
-				dataConn, dataConnErr := net.Dial("tcp", conf.ServerAddr)
+				dataConn, dataConnErr := net.Dial("tcp", server)
 				if dataConnErr != nil {
 					log.Errorf("client", "client.connect_data_channel_failed", dataConnErr)
 					return
@@ -211,9 +480,10 @@ func StartControlLoop(conn net.Conn, conf *ClientConfig) error {
 				dataReq := protocol.RegisterRequest{
 					Type:       "data_channel",
 					LocalPort:  localPort,
-					RemotePort: conf.RemotePort,
+					RemotePort: remotePort,
 					Token:      conf.Token,
 					Name:       conf.Name,
+					ConnID:     connID,
 				}
 				dataReqBytes, _ := json.Marshal(dataReq)
 				if writePacketErr := protocol.WritePacket(dataConn, dataReqBytes); writePacketErr != nil {
@@ -234,42 +504,114 @@ func StartControlLoop(conn net.Conn, conf *ClientConfig) error {
 				}
 				regDuration := time.Since(startTime)
 				log.Debugf("client", "client.data_channel_registered", regDuration.Milliseconds())
-				// Connect to local service
-				localAddr := fmt.Sprintf("127.0.0.1:%d", localPort)
-				log.Debugf("client", "client.connecting_local", localAddr)
-				localConn, err := net.Dial("tcp", localAddr)
+				// Connect to a healthy backend
+				pool := conf.backendPool()
+				localConn, target, err := pool.dialBackend()
 				if err != nil {
 					log.Errorf("client", "client.connect_local_failed", err)
 					_ = dataConn.Close()
 					return
 				}
+				defer pool.release(target)
 				totalDuration := time.Since(startTime)
 				log.Infof("client", "client.data_channel_ready", localPort, totalDuration.Milliseconds())
 				log.Debugf("client", "client.relay_starting", localPort)
 				// Relay on separate data channel connection
-				core.RelayConn(localConn, dataConn)
-				log.Debugf("client", "client.relay_finished", localPort)
-			}(ctrl.LocalPort)
+				untrack := conf.relayTracker().Track(localConn, dataConn)
+				clientMetrics.activeRelays.Inc()
+				stats := core.RelayConn(localConn, dataConn, clientMetrics.trafficFor(remotePort))
+				clientMetrics.activeRelays.Dec()
+				untrack()
+				closedBy := "backend"
+				if stats.ClosedBy == "b" {
+					closedBy = "server"
+				}
+				log.Debug("client", "client.relay_summary", map[string]interface{}{
+					"Port": localPort, "Target": target.Addr, "In": stats.BToA, "Out": stats.AToB,
+					"Duration": stats.Duration.Round(time.Millisecond), "ClosedBy": closedBy,
+				})
+			}(ctrl.LocalPort, ctrl.ConnID)
 		}
 	}
 }
 
+// waitReconnect sleeps until the next reconnect attempt allowed by b and logs when it will happen.
+// It returns false if the client should stop instead: ctx was cancelled or max tries were exhausted.
+func waitReconnect(ctx context.Context, b *ha.Backoff) bool {
+	delay, ok := b.Next()
+	if !ok {
+		log.Error("client", "client.reconnect_gave_up", map[string]interface{}{"MaxTries": b.MaxTries})
+		return false
+	}
+	clientMetrics.reconnectAttempts.Inc()
+	log.Info("client", "client.reconnect_scheduled", map[string]interface{}{
+		"Tries": b.Tries(),
+		"Delay": delay.Round(time.Millisecond),
+		"At":    time.Now().Add(delay).Format("15:04:05"),
+	})
+	return ha.Sleep(ctx, delay) == nil
+}
+
+// relayTrackerMu guards the lazy creation of ClientConfig.relays.
+var relayTrackerMu sync.Mutex
+
+// relayTracker returns the tracker of the tunnel's open data channels, creating it on first use.
+func (c *ClientConfig) relayTracker() *core.Tracker {
+	relayTrackerMu.Lock()
+	defer relayTrackerMu.Unlock()
+	if c.relays == nil {
+		c.relays = &core.Tracker{}
+	}
+	return c.relays
+}
+
+// shutdownConnection ends a session on purpose: it unregisters the mapping so the server stops
+// accepting users, then gives the leg's open data channels up to conf.ShutdownTimeout to finish.
+// It returns the number of relays that had to be cut.
+func shutdownConnection(conn net.Conn, conf *ClientConfig) int {
+	req := protocol.UnregisterRequest{Type: "unregister", Port: conf.remotePort()}
+	b, _ := json.Marshal(req)
+	if err := protocol.WritePacket(conn, b); err != nil {
+		log.Warnf("client", "client.send_unregister_failed", err)
+	}
+	relays := conf.relayTracker()
+	log.Info("client", "client.draining_relays", map[string]interface{}{
+		"Count":   relays.Active(),
+		"Timeout": conf.ShutdownTimeout,
+	})
+	cut := relays.Drain(conf.ShutdownTimeout)
+	if cut > 0 {
+		log.Warn("client", "client.shutdown_relays_cut", map[string]interface{}{"Count": cut})
+	} else {
+		log.Info("client", "client.shutdown_relays_drained", nil)
+	}
+	return cut
+}
+
 // handleConnection handles a single connection lifecycle.
 func handleConnection(conn net.Conn, conf *ClientConfig) error {
-	// Start heartbeat goroutine
-	heartbeatStop := StartHeartbeat(conn, time.Duration(conf.HeartbeatInterval)*time.Second, func() {
-		log.Warn("client", "client.heartbeat_timeout", nil)
-		_ = conn.Close()
-	})
-	defer heartbeatStop()
+	// Start heartbeat goroutine; a send failure or missing pongs close conn, which ends the control loop
+	hb := &ha.HeartbeatManager{
+		Conn:      conn,
+		Interval:  conf.heartbeatInterval(),
+		MaxMissed: conf.HeartbeatMaxMissed,
+		RTT:       ha.NewRTTWindow(0),
+		OnTimeout: func() {
+			log.Warn("client", "client.heartbeat_timeout", nil)
+			clientMetrics.heartbeatTimeouts.Inc()
+			_ = conn.Close()
+		},
+	}
+	hb.StartHeartbeat()
+	defer hb.StopHeartbeat()
 
 	// Start health probe (using closure to capture state variable)
 	var healthDown bool
-	stopHealth := StartHealthProbe(conf, conn,
+	stopHealth := StartHealthProbe(conf,
 		func() {
 			if !healthDown {
 				log.Warnf("client", "client.local_port_health_lost", conf.LocalPort)
-				req := protocol.OfflinePortRequest{Type: "offline_port", Port: conf.RemotePort}
+				req := protocol.OfflinePortRequest{Type: "offline_port", Port: conf.remotePort()}
 				b, _ := json.Marshal(req)
 				if err := protocol.WritePacket(conn, b); err != nil {
 					log.Errorf("client", "client.send_offline_port_failed", err)
@@ -280,7 +622,7 @@ func handleConnection(conn net.Conn, conf *ClientConfig) error {
 		func() {
 			if healthDown {
 				log.Infof("client", "client.local_port_recovered", conf.LocalPort)
-				req := protocol.OnlinePortRequest{Type: "online_port", Port: conf.RemotePort}
+				req := protocol.OnlinePortRequest{Type: "online_port", Port: conf.remotePort()}
 				b, _ := json.Marshal(req)
 				if err := protocol.WritePacket(conn, b); err != nil {
 					log.Errorf("client", "client.send_online_port_failed", err)
@@ -290,16 +632,122 @@ func handleConnection(conn net.Conn, conf *ClientConfig) error {
 		},
 	)
 	defer stopHealth()
+	stopReports := startHealthReports(conf, conn)
+	defer stopReports()
+
+	// While on a backup server, go back to the primary once it is reachable again
+	var failedBack atomic.Bool
+	stopFailback := watchFailback(conf, func() {
+		failedBack.Store(true)
+		_ = conn.Close()
+	})
+	defer stopFailback()
+
+	err := StartControlLoop(conn, conf, hb)
+	if failedBack.Load() {
+		return errFailback
+	}
+	return err
+}
+
+// runTunnel keeps one control connection to conf's servers alive until ctx is cancelled or the
+// reconnect backoff gives up. onState is told whenever the tunnel comes up or goes down.
+func runTunnel(ctx context.Context, conf *ClientConfig, onState func(up bool)) {
+	log.Infof("client", "client.port_registered", conf.LocalPort, conf.RemotePort)
+	backoff := conf.Reconnect
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		conn, err := DialServer(conf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			errors.PrintError(errors.ErrConnectFailed, err)
+			if !waitReconnect(ctx, &backoff) {
+				return
+			}
+			continue
+		}
+
+		if err := RegisterPort(conn, conf); err != nil {
+			_ = conn.Close()
+			if ctx.Err() != nil {
+				return
+			}
+			log.Errorf("client", "client.port_register_failed", err)
+			if !waitReconnect(ctx, &backoff) {
+				return
+			}
+			continue
+		}
+
+		log.Info("client", "client.port_register_success", nil)
+		connectedAt := time.Now()
+		onState(true)
+		clientMetrics.connectedTunnels.Inc()
+
+		// Handle connection in a goroutine so we can check for shutdown
+		connDone := make(chan struct{})
+		var connErr error
+		go func() {
+			defer close(connDone)
+			connErr = handleConnection(conn, conf)
+		}()
 
-	return StartControlLoop(conn, conf)
+		// Wait for connection to close or shutdown signal
+		select {
+		case <-ctx.Done():
+			shutdownConnection(conn, conf)
+			_ = conn.Close()
+			<-connDone
+			clientMetrics.connectedTunnels.Dec()
+			return
+		case <-connDone:
+			_ = conn.Close()
+			onState(false)
+			clientMetrics.connectedTunnels.Dec()
+			// Only a connection that stayed up for a while counts as recovered, a flapping
+			// server keeps backing off
+			if time.Since(connectedAt) >= conf.StableAfter {
+				backoff.Reset()
+			}
+			if connErr == errFailback {
+				continue
+			}
+			if goAway, ok := connErr.(*goAwayError); ok {
+				// Planned server restart: reconnect right away, in-flight relays keep running on their own connections
+				log.Infof("client", "client.server_goaway", goAway.reason)
+				continue
+			}
+			log.Warnf("client", "client.control_channel_disconnected", connErr)
+			if !waitReconnect(ctx, &backoff) {
+				return
+			}
+		}
+	}
 }
 
 func main() {
 	conf := loadClientConfig()
+	conf.SessionID = newSessionID()
 
 	// Initialize logger
 	log.Init(log.ParseLevel(conf.LogLevel), log.ParseLanguage(conf.LogLang))
 
+	if err := conf.validateBackends(); err != nil {
+		log.Errorf("client", "client.invalid_backends", err)
+		os.Exit(1)
+	}
+	if err := conf.loadMaintenancePage(); err != nil {
+		log.Errorf("client", "client.invalid_maintenance_page", err)
+		os.Exit(1)
+	}
+
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -308,73 +756,44 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	// Start reconnection loop in a goroutine
+	// Prometheus metrics, off unless client.metrics_addr is set
+	if conf.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", clientMetrics.registry.Handler())
+		metricsServer := &http.Server{Addr: conf.MetricsAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		defer metricsServer.Close()
+		go func() {
+			log.Infof("client", "client.metrics_listening", conf.MetricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Errorf("client", "client.metrics_failed", err)
+			}
+		}()
+	}
+
+	// Start one reconnection loop per leg: a single one normally, one per server in active-active mode
 	reconnectDone := make(chan struct{})
 	go func() {
 		defer close(reconnectDone)
-		log.Infof("client", "client.port_registered", conf.LocalPort, conf.RemotePort)
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
-
-			conn, err := DialServer(conf)
-			if err != nil {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					errors.PrintError(errors.ErrConnectFailed, err)
-					time.Sleep(3 * time.Second)
-					continue
-				}
-			}
-
-			if err := RegisterPort(conn, conf); err != nil {
-				_ = conn.Close()
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					log.Errorf("client", "client.port_register_failed", err)
-					time.Sleep(3 * time.Second)
-					continue
-				}
-			}
-
-			log.Info("client", "client.port_register_success", nil)
-
-			// Handle connection in a goroutine so we can check for shutdown
-			connDone := make(chan struct{})
-			go func() {
-				defer close(connDone)
-				_ = handleConnection(conn, conf)
-			}()
-
-			// Wait for connection to close or shutdown signal
-			select {
-			case <-ctx.Done():
-				_ = conn.Close()
-				<-connDone
-				return
-			case <-connDone:
-				log.Warn("client", "client.control_channel_disconnected", nil)
-				_ = conn.Close()
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					time.Sleep(3 * time.Second)
-				}
-			}
+		legs := conf.legs()
+		status := newLegStatus(legs)
+		var wg sync.WaitGroup
+		for _, leg := range legs {
+			wg.Add(1)
+			go func(leg *ClientConfig) {
+				defer wg.Done()
+				runTunnel(ctx, leg, status.reporter(leg))
+			}(leg)
 		}
+		wg.Wait()
 	}()
 
-	// Wait for shutdown signal
-	<-sigChan
-	log.Info("client", "client.shutdown_signal_received", nil)
+	// Wait for shutdown signal, or for the reconnect loop to give up
+	select {
+	case <-sigChan:
+		log.Info("client", "client.shutdown_signal_received", nil)
+	case <-reconnectDone:
+		os.Exit(1)
+	}
 
 	// Start graceful shutdown
 	log.Info("client", "client.shutdown_started", nil)
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"gotunnel/pkg/metrics"
+	"strconv"
+)
+
+// clientMetrics is what the client exposes on client.metrics_addr for Prometheus.
+var clientMetrics = newClientMetrics()
+
+type clientMetricSet struct {
+	registry          *metrics.Registry
+	connectedTunnels  *metrics.Gauge // Registered control connections, one per leg in active-active mode
+	activeRelays      *metrics.Gauge // Data channels relaying, across all legs
+	reconnectAttempts *metrics.Counter
+	heartbeatTimeouts *metrics.Counter
+	healthTransitions *metrics.CounterVec // status
+	bytes             *metrics.CounterVec // port, direction
+}
+
+func newClientMetrics() *clientMetricSet {
+	r := metrics.NewRegistry()
+	s := &clientMetricSet{
+		registry: r,
+		connectedTunnels: r.NewGauge("gotunnel_client_connected_tunnels",
+			"Control connections currently registered with a server."),
+		reconnectAttempts: r.NewCounter("gotunnel_client_reconnect_attempts_total",
+			"Reconnects scheduled after the server could not be reached or the connection dropped."),
+		heartbeatTimeouts: r.NewCounter("gotunnel_client_heartbeat_timeouts_total",
+			"Control connections dropped because the server stopped answering heartbeats."),
+		healthTransitions: r.NewCounterVec("gotunnel_client_health_transitions_total",
+			"Backends going up or down after passing the rise/fall thresholds.", "status"),
+		bytes: r.NewCounterVec("gotunnel_client_bytes_total",
+			"Bytes relayed for users of a remote port, in from and out to the user.", "port", "direction"),
+	}
+	s.activeRelays = r.NewGauge("gotunnel_client_active_relays", "Data channels currently relaying to a backend.")
+	return s
+}
+
+// relayTraffic feeds a relay's live byte counts into the client's traffic metrics. The client
+// relays with the backend on side a, so a to b is out to the user.
+type relayTraffic struct{ in, out *metrics.Counter }
+
+func (t relayTraffic) Add(aToB, bToA int64) {
+	t.out.Add(float64(aToB))
+	t.in.Add(float64(bToA))
+}
+
+// trafficFor returns the traffic counter for relays of remote port.
+func (s *clientMetricSet) trafficFor(port int) relayTraffic {
+	p := strconv.Itoa(port)
+	return relayTraffic{in: s.bytes.With(p, "in"), out: s.bytes.With(p, "out")}
+}
+
+// healthStatus is the status label of a health transition.
+func healthStatus(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"gotunnel/pkg/log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server selection modes for client.server_selection.
+const (
+	selectPriority   = "priority"    // Always start from the first server, later ones are backups
+	selectRoundRobin = "round_robin" // Start each reconnect from the server after the last one used
+)
+
+// srvPrefix marks a server_addrs entry that is looked up as a DNS SRV name, e.g. "srv://_gotunnel._tcp.example.com".
+const srvPrefix = "srv://"
+
+// dialTimeout bounds each connection attempt so a dead server does not stall failover.
+var dialTimeout = 5 * time.Second
+
+// Resolvers, replaced in tests.
+var (
+	lookupHost = net.LookupHost
+	lookupSRV  = net.LookupSRV
+)
+
+// expandServerAddr turns one configured server entry into dialable addresses: an SRV name yields
+// its targets by priority and weight, a host name yields one address per A/AAAA record.
+func expandServerAddr(entry string) ([]string, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.HasPrefix(entry, srvPrefix) {
+		_, records, err := lookupSRV("", "", strings.TrimPrefix(entry, srvPrefix))
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i].Priority != records[j].Priority {
+				return records[i].Priority < records[j].Priority
+			}
+			return records[i].Weight > records[j].Weight
+		})
+		addrs := make([]string, 0, len(records))
+		for _, r := range records {
+			addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+		}
+		return addrs, nil
+	}
+	host, port, err := net.SplitHostPort(entry)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{entry}, nil
+	}
+	ips, err := lookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return addrs, nil
+}
+
+// serverCandidates expands every configured server and returns them in the order to try,
+// honouring the selection mode. Entries that fail to resolve are logged and skipped.
+func (c *ClientConfig) serverCandidates() []string {
+	entries := c.ServerAddrs
+	if len(entries) == 0 {
+		entries = []string{c.ServerAddr}
+	}
+	var addrs []string
+	for _, entry := range entries {
+		expanded, err := expandServerAddr(entry)
+		if err != nil {
+			log.Warn("client", "client.server_resolve_failed", map[string]interface{}{"Addr": entry, "Error": err.Error()})
+			continue
+		}
+		addrs = append(addrs, expanded...)
+	}
+	if c.ServerSelection == selectRoundRobin && len(addrs) > 1 {
+		start := c.nextServer % len(addrs)
+		addrs = append(addrs[start:], addrs[:start]...)
+		c.nextServer = start + 1
+	}
+	return addrs
+}
+
+// primaryServer returns the address failback returns to: the first candidate in priority order.
+func (c *ClientConfig) primaryServer() string {
+	if len(c.ServerAddrs) == 0 {
+		return c.ServerAddr
+	}
+	addrs, err := expandServerAddr(c.ServerAddrs[0])
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0]
+}
+
+// activeServer returns the server the control channel is connected to; data channels must use the same one.
+func (c *ClientConfig) activeServer() string {
+	if c.ActiveServer != "" {
+		return c.ActiveServer
+	}
+	return c.ServerAddr
+}
+
+// DialServer establishes a TCP connection to the first reachable server and records it as active.
+func DialServer(conf *ClientConfig) (net.Conn, error) {
+	candidates := conf.serverCandidates()
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no server address could be resolved")
+	}
+	var lastErr error
+	for _, addr := range candidates {
+		conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+		if err != nil {
+			if len(candidates) > 1 {
+				log.Warn("client", "client.server_dial_failed", map[string]interface{}{"Addr": addr, "Error": err.Error()})
+			}
+			lastErr = err
+			continue
+		}
+		if addr != conf.ActiveServer && conf.ActiveServer != "" {
+			log.Infof("client", "client.server_switched", addr)
+		}
+		conf.ActiveServer = addr
+		return conn, nil
+	}
+	return nil, lastErr
+}
+
+// errFailback ends a control channel on purpose so the client reconnects to the primary server.
+var errFailback = fmt.Errorf("primary server is back, failing back")
+
+// watchFailback probes the primary server every FailbackInterval while the client is connected to a
+// backup one, and calls onPrimaryUp once the primary accepts connections again.
+func watchFailback(conf *ClientConfig, onPrimaryUp func()) (stop func()) {
+	done := make(chan struct{})
+	if conf.FailbackInterval <= 0 || conf.ServerSelection == selectRoundRobin {
+		return func() {}
+	}
+	primary := conf.primaryServer()
+	if primary == "" || primary == conf.activeServer() {
+		return func() {}
+	}
+	go func() {
+		ticker := time.NewTicker(conf.FailbackInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				probe, err := net.DialTimeout("tcp", primary, dialTimeout)
+				if err != nil {
+					continue
+				}
+				_ = probe.Close()
+				log.Infof("client", "client.server_failback", primary)
+				onPrimaryUp()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
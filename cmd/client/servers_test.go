@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// closedAddr 返回一个当前无人监听的本地地址
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestExpandServerAddr(t *testing.T) {
+	defer func() { lookupHost, lookupSRV = net.LookupHost, net.LookupSRV }()
+	lookupHost = func(host string) ([]string, error) {
+		if host == "tunnel.example.com" {
+			return []string{"192.0.2.1", "2001:db8::1"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return "", []*net.SRV{
+			{Target: "backup.example.com.", Port: 17001, Priority: 20, Weight: 10},
+			{Target: "b.example.com.", Port: 17000, Priority: 10, Weight: 5},
+			{Target: "a.example.com.", Port: 17000, Priority: 10, Weight: 50},
+		}, nil
+	}
+
+	if got, _ := expandServerAddr("10.0.0.1:17000"); !reflect.DeepEqual(got, []string{"10.0.0.1:17000"}) {
+		t.Errorf("ip literal should pass through, got %v", got)
+	}
+	// 域名按每条 A/AAAA 记录展开
+	got, err := expandServerAddr("tunnel.example.com:17000")
+	if err != nil || !reflect.DeepEqual(got, []string{"192.0.2.1:17000", "[2001:db8::1]:17000"}) {
+		t.Errorf("unexpected host expansion %v err=%v", got, err)
+	}
+	// SRV 记录按优先级升序、权重降序排列
+	got, err = expandServerAddr("srv://_gotunnel._tcp.example.com")
+	want := []string{"a.example.com:17000", "b.example.com:17000", "backup.example.com:17001"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v err=%v", want, got, err)
+	}
+	if _, err := expandServerAddr("missing.example.com:17000"); err == nil {
+		t.Error("expected resolve error")
+	}
+}
+
+func TestServerCandidates_RoundRobin(t *testing.T) {
+	conf := &ClientConfig{ServerAddrs: []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1"}, ServerSelection: selectRoundRobin}
+	first := conf.serverCandidates()
+	second := conf.serverCandidates()
+	if first[0] != "10.0.0.1:1" || second[0] != "10.0.0.2:1" || len(second) != 3 {
+		t.Errorf("round robin should rotate the start, got %v then %v", first, second)
+	}
+
+	conf.ServerSelection = selectPriority
+	for i := 0; i < 2; i++ {
+		if got := conf.serverCandidates(); got[0] != "10.0.0.1:1" {
+			t.Errorf("priority mode should always start from the primary, got %v", got)
+		}
+	}
+}
+
+func TestDialServer_Failover(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conf := &ClientConfig{ServerAddrs: []string{closedAddr(t), ln.Addr().String()}}
+
+	// 主服务不可达时切换到备用服务，数据通道也应使用备用服务
+	conn, err := DialServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if conf.activeServer() != ln.Addr().String() {
+		t.Errorf("expected active server %s, got %s", ln.Addr(), conf.activeServer())
+	}
+}
+
+func TestWatchFailback(t *testing.T) {
+	primary, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	conf := &ClientConfig{
+		ServerAddrs:      []string{primary.Addr().String(), "127.0.0.1:1"},
+		ActiveServer:     "127.0.0.1:1",
+		FailbackInterval: 20 * time.Millisecond,
+	}
+	back := make(chan struct{}, 1)
+	stop := watchFailback(conf, func() { back <- struct{}{} })
+	defer stop()
+	select {
+	case <-back:
+	case <-time.After(time.Second):
+		t.Fatal("expected failback once the primary is reachable")
+	}
+
+	// 已连在主服务上时不探测
+	conf.ActiveServer = primary.Addr().String()
+	stop2 := watchFailback(conf, func() { t.Error("no failback expected on the primary") })
+	time.Sleep(60 * time.Millisecond)
+	stop2()
+}
+
+func TestLoadClientConfig_ServerAddrs(t *testing.T) {
+	viper.Reset()
+	conf := loadClientConfig()
+	if conf.ServerSelection != selectPriority || conf.FailbackInterval != 0 || len(conf.ServerAddrs) != 0 {
+		t.Errorf("unexpected defaults %+v", conf)
+	}
+	viper.Set("client.server_addrs", []string{"a:17000", "srv://_gotunnel._tcp.example.com"})
+	viper.Set("client.server_selection", "round_robin")
+	viper.Set("client.failback_interval", 30)
+	conf = loadClientConfig()
+	if len(conf.ServerAddrs) != 2 || conf.ServerSelection != selectRoundRobin || conf.FailbackInterval != 30*time.Second {
+		t.Errorf("unexpected server settings %v %s %v", conf.ServerAddrs, conf.ServerSelection, conf.FailbackInterval)
+	}
+	viper.Reset()
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gotunnel/pkg/log"
+	"gotunnel/pkg/protocol"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// disabledPorts are public ports an operator switched off through the admin API. A disabled port
+// does not listen, whoever registers it, until it is enabled again. Guarded by mappingTableMu.
+var disabledPorts = make(map[int]bool)
+
+// traffic counts the bytes relayed for users, In from the user and Out to the user. It is the
+// core.Counter of relays that have the user on side a.
+type traffic struct {
+	In  atomic.Int64
+	Out atomic.Int64
+}
+
+func (t *traffic) Add(in, out int64) {
+	t.In.Add(in)
+	t.Out.Add(out)
+}
+
+// maxTrackedUsers bounds userTraffic; the user seen longest ago makes room for a new one.
+const maxTrackedUsers = 4096
+
+// userStats is the traffic of one user address across all ports.
+type userStats struct {
+	traffic
+	Connections int       // Relays started, guarded by userTrafficMu
+	LastSeen    time.Time // Start of the latest relay, guarded by userTrafficMu
+}
+
+var (
+	userTraffic   = make(map[string]*userStats)
+	userTrafficMu sync.Mutex
+)
+
+// trafficFor returns the counters of the user at ip and counts a new connection.
+func trafficFor(ip string) *userStats {
+	userTrafficMu.Lock()
+	defer userTrafficMu.Unlock()
+	u, ok := userTraffic[ip]
+	if !ok {
+		if len(userTraffic) >= maxTrackedUsers {
+			var oldest string
+			for addr, candidate := range userTraffic {
+				if oldest == "" || candidate.LastSeen.Before(userTraffic[oldest].LastSeen) {
+					oldest = addr
+				}
+			}
+			delete(userTraffic, oldest)
+		}
+		u = &userStats{}
+		userTraffic[ip] = u
+	}
+	u.Connections++
+	u.LastSeen = time.Now()
+	return u
+}
+
+// userInfo is one user address as the admin API lists it.
+type userInfo struct {
+	ClientIP    string    `json:"client_ip"`
+	Connections int       `json:"connections"`
+	LastSeen    time.Time `json:"last_seen"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+}
+
+// listUsers snapshots userTraffic, busiest first.
+func listUsers() []userInfo {
+	userTrafficMu.Lock()
+	list := make([]userInfo, 0, len(userTraffic))
+	for ip, u := range userTraffic {
+		list = append(list, userInfo{ClientIP: ip, Connections: u.Connections, LastSeen: u.LastSeen, BytesIn: u.In.Load(), BytesOut: u.Out.Load()})
+	}
+	userTrafficMu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].BytesIn+list[i].BytesOut > list[j].BytesIn+list[j].BytesOut
+	})
+	return list
+}
+
+// newMemberID returns a random identifier for a member, used in admin API paths.
+func newMemberID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// clientInfo is one member as the admin API lists it.
+type clientInfo struct {
+	ID            string                   `json:"id"`
+	Name          string                   `json:"name"`
+	RemotePort    int                      `json:"remote_port"`
+	LocalPort     int                      `json:"local_port"`
+	RemoteAddr    string                   `json:"remote_addr"`
+	ConnectedAt   time.Time                `json:"connected_since"`
+	LastHeartbeat time.Time                `json:"last_heartbeat"`
+	ActiveConns   int                      `json:"active_conns"`
+	BytesIn       int64                    `json:"bytes_in"`
+	BytesOut      int64                    `json:"bytes_out"`
+	BackupFor     string                   `json:"backup_for,omitempty"`
+	Offline       bool                     `json:"offline"`
+	Unhealthy     bool                     `json:"unhealthy"`
+	Detached      bool                     `json:"detached"`
+	CheckError    string                   `json:"check_error,omitempty"`
+	Health        string                   `json:"health,omitempty"` // Status of the client's last health report
+	Backends      []protocol.BackendHealth `json:"backends,omitempty"`
+	LastCheck     *time.Time               `json:"last_check,omitempty"`
+}
+
+// mappingInfo is one public port as the admin API lists it.
+type mappingInfo struct {
+	Port        int          `json:"port"`
+	BindAddr    string       `json:"bind_addr,omitempty"`
+	Group       string       `json:"group,omitempty"`
+	Policy      string       `json:"policy,omitempty"`
+	Protocol    string       `json:"protocol,omitempty"`
+	KeepOpen    bool         `json:"keep_open"`
+	Listening   bool         `json:"listening"`
+	Disabled    bool         `json:"disabled"`
+	ActiveConns int          `json:"active_conns"`
+	BytesIn     int64        `json:"bytes_in"`
+	BytesOut    int64        `json:"bytes_out"`
+	Members     []clientInfo `json:"members"`
+}
+
+// describeMember snapshots mem for the admin API. Callers must hold mappingTableMu.
+func describeMember(port int, mem *Member) clientInfo {
+	info := clientInfo{
+		ID:            mem.ID,
+		Name:          mem.Name,
+		RemotePort:    port,
+		LocalPort:     mem.LocalPort,
+		ConnectedAt:   mem.ConnectedAt,
+		LastHeartbeat: mem.LastHeartbeat,
+		ActiveConns:   mem.Active,
+		BytesIn:       mem.Traffic.In.Load(),
+		BytesOut:      mem.Traffic.Out.Load(),
+		BackupFor:     mem.BackupFor,
+		Offline:       mem.Offline,
+		Unhealthy:     mem.Unhealthy,
+		Detached:      mem.Detached,
+		CheckError:    mem.CheckError,
+	}
+	if mem.ClientConn != nil && mem.ClientConn.RemoteAddr() != nil {
+		info.RemoteAddr = mem.ClientConn.RemoteAddr().String()
+	}
+	if mem.Health != nil {
+		info.Health = mem.Health.Status
+		info.Backends = mem.Health.Backends
+	}
+	if !mem.LastCheck.IsZero() {
+		last := mem.LastCheck
+		info.LastCheck = &last
+	}
+	return info
+}
+
+// listMappings snapshots mappingTable for the admin API, sorted by port.
+func listMappings() []mappingInfo {
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	list := make([]mappingInfo, 0, len(mappingTable))
+	for port, m := range mappingTable {
+		info := mappingInfo{
+			Port:      port,
+			BindAddr:  m.BindAddr,
+			Group:     m.Group,
+			Policy:    m.Policy,
+			Protocol:  m.Protocol,
+			KeepOpen:  m.KeepOpen,
+			Listening: isListening(m),
+			Disabled:  disabledPorts[port],
+			BytesIn:   m.Traffic.In.Load(),
+			BytesOut:  m.Traffic.Out.Load(),
+			Members:   make([]clientInfo, 0, len(m.Members)),
+		}
+		for _, mem := range m.Members {
+			info.ActiveConns += mem.Active
+			info.Members = append(info.Members, describeMember(port, mem))
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Port < list[j].Port })
+	return list
+}
+
+// listClients is every member of every mapping, sorted by port.
+func listClients() []clientInfo {
+	var list []clientInfo
+	for _, m := range listMappings() {
+		list = append(list, m.Members...)
+	}
+	if list == nil {
+		list = []clientInfo{}
+	}
+	return list
+}
+
+// kickClient closes the control connection of the member with the given ID and drops it from its
+// mapping without a session grace period. The client is free to reconnect.
+func kickClient(id string) bool {
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	for port, m := range mappingTable {
+		for _, mem := range m.Members {
+			if mem.ID != id {
+				continue
+			}
+			log.Warn("server", "server.admin_kick", map[string]interface{}{"Port": port, "Name": mem.Name})
+			_ = mem.ClientConn.Close()
+			dropMember(port, m, mem)
+			return true
+		}
+	}
+	return false
+}
+
+// setPortDisabled switches the public listener of a registered port off or back on. A disabled
+// port can be enabled after its mapping went away.
+func setPortDisabled(port int, disabled bool) bool {
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	m, exists := mappingTable[port]
+	if !exists && (disabled || !disabledPorts[port]) {
+		return false
+	}
+	if disabled {
+		disabledPorts[port] = true
+		log.Warnf("server", "server.mapping_disabled", port)
+	} else {
+		delete(disabledPorts, port)
+		log.Infof("server", "server.mapping_enabled", port)
+	}
+	if exists {
+		refreshListener(port, m)
+	}
+	return true
+}
+
+// newAdminHandler serves the admin API and the dashboard. API requests must carry the bearer
+// token or a dashboard session, see requireAdmin.
+func newAdminHandler(auth adminAuth) http.Handler {
+	sessions := newSessionStore(auth.SessionTTL)
+	limiter := newLoginLimiter()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/clients", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, listClients())
+	})
+	mux.HandleFunc("GET /api/mappings", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, listMappings())
+	})
+	mux.HandleFunc("GET /api/connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, recentConnections())
+	})
+	mux.HandleFunc("GET /api/users", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, listUsers())
+	})
+	mux.HandleFunc("POST /api/clients/{id}/kick", func(w http.ResponseWriter, r *http.Request) {
+		if !kickClient(r.PathValue("id")) {
+			writeError(w, http.StatusNotFound, "client not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	for action, disabled := range map[string]bool{"disable": true, "enable": false} {
+		disabled := disabled
+		mux.HandleFunc("POST /api/mappings/{port}/"+action, func(w http.ResponseWriter, r *http.Request) {
+			port, err := strconv.Atoi(r.PathValue("port"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid port")
+				return
+			}
+			if !setPortDisabled(port, disabled) {
+				writeError(w, http.StatusNotFound, "mapping not found")
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		})
+	}
+	mux.HandleFunc("POST /api/reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := reloadConfig(); err != nil {
+			log.Errorf("server", "server.config_reload_failed", err)
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Info("server", "server.config_reloaded", nil)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	root := http.NewServeMux()
+	root.Handle("/api/", requireAdmin(auth, sessions, limiter, mux))
+	root.HandleFunc("POST /login", handleLogin(auth, sessions, limiter))
+	root.HandleFunc("POST /logout", handleLogout(sessions))
+	root.Handle("/", dashboardFiles())
+	return root
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
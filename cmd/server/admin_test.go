@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdmin_RequiresToken(t *testing.T) {
+	h := newAdminHandler(adminAuth{Token: "secret"})
+	for _, token := range []string{"", "wrong"} {
+		if rec := adminRequest(t, h, http.MethodGet, "/api/clients", token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: expected 401, got %d", token, rec.Code)
+		}
+	}
+	if rec := adminRequest(t, h, http.MethodGet, "/api/clients", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 with the right token, got %d", rec.Code)
+	}
+}
+
+func TestAdmin_ListMappings(t *testing.T) {
+	mem := &Member{ID: "abc", Name: "web", LocalPort: 8080, ClientConn: &mockConn{}, ConnectedAt: time.Now(), Active: 2}
+	mem.Traffic.In.Add(10)
+	m := &Mapping{Members: []*Member{mem}}
+	m.Traffic.Out.Add(20)
+	mappingTableMu.Lock()
+	mappingTable = map[int]*Mapping{9400: m}
+	mappingTableMu.Unlock()
+
+	rec := adminRequest(t, newAdminHandler(adminAuth{Token: "secret"}), http.MethodGet, "/api/mappings", "secret")
+	var got []mappingInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Port != 9400 || got[0].ActiveConns != 2 || got[0].BytesOut != 20 {
+		t.Fatalf("unexpected mappings %+v", got)
+	}
+	if c := got[0].Members[0]; c.ID != "abc" || c.LocalPort != 8080 || c.BytesIn != 10 {
+		t.Errorf("unexpected member %+v", c)
+	}
+}
+
+func TestAdmin_KickClient(t *testing.T) {
+	conn := &mockConn{}
+	m := &Mapping{Members: []*Member{{ID: "abc", Name: "web", ClientConn: conn, SessionID: "s1"}}}
+	mappingTableMu.Lock()
+	mappingTable = map[int]*Mapping{9401: m}
+	mappingTableMu.Unlock()
+
+	h := newAdminHandler(adminAuth{Token: "secret"})
+	if rec := adminRequest(t, h, http.MethodPost, "/api/clients/nope/kick", "secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown client, got %d", rec.Code)
+	}
+	// 踢出的客户端不保留会话，映射立即释放
+	if rec := adminRequest(t, h, http.MethodPost, "/api/clients/abc/kick", "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	if !conn.closed || mappingTable[9401] != nil {
+		t.Error("expected the control connection closed and the mapping gone")
+	}
+}
+
+func TestAdmin_DisableMapping(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	m := &Mapping{BindAddr: "127.0.0.1", Members: []*Member{{ID: "abc", Name: "web", ClientConn: &mockConn{}}}}
+	mappingTableMu.Lock()
+	mappingTable = map[int]*Mapping{port: m}
+	refreshListener(port, m)
+	mappingTableMu.Unlock()
+	defer func() {
+		mappingTableMu.Lock()
+		delete(disabledPorts, port)
+		stopListening(m)
+		mappingTableMu.Unlock()
+	}()
+
+	h := newAdminHandler(adminAuth{Token: "secret"})
+	if rec := adminRequest(t, h, http.MethodPost, "/api/mappings/"+strconv.Itoa(port)+"/disable", "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	// 禁用后即使成员在线也不监听，刷新监听状态也不会重新打开
+	mappingTableMu.Lock()
+	refreshListener(port, m)
+	if isListening(m) {
+		t.Error("disabled mapping should not listen")
+	}
+	mappingTableMu.Unlock()
+
+	if rec := adminRequest(t, h, http.MethodPost, "/api/mappings/"+strconv.Itoa(port)+"/enable", "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	if !isListening(m) {
+		t.Error("enabled mapping should listen again")
+	}
+}
+
+func TestForwardUser_CountsTraffic(t *testing.T) {
+	var up atomic.Bool
+	up.Store(true)
+	mem := &Member{ID: "abc", Name: "web", LocalPort: 3000, ClientConn: fakeTunnelClient(t, 9402, &up)}
+	m := &Mapping{Members: []*Member{mem}}
+	mappingTableMu.Lock()
+	mappingTable = map[int]*Mapping{9402: m}
+	mappingTableMu.Unlock()
+	userTrafficMu.Lock()
+	delete(userTraffic, "192.0.2.7")
+	userTrafficMu.Unlock()
+
+	user, userPeer := net.Pipe()
+	defer user.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		forwardUserFrom(9402, userPeer, "192.0.2.7")
+	}()
+	req := "GET / HTTP/1.1\r\nHost: x\r\n\r\n"
+	go io.WriteString(user, req)
+	resp, _ := io.ReadAll(user)
+	<-done
+
+	// 成员、端口和用户三处的流量一致
+	in, out := int64(len(req)), int64(len(resp))
+	if mem.Traffic.In.Load() != in || mem.Traffic.Out.Load() != out || m.Traffic.In.Load() != in || m.Traffic.Out.Load() != out {
+		t.Errorf("expected %d/%d bytes, member %d/%d mapping %d/%d", in, out,
+			mem.Traffic.In.Load(), mem.Traffic.Out.Load(), m.Traffic.In.Load(), m.Traffic.Out.Load())
+	}
+	users := listUsers()
+	found := false
+	for _, u := range users {
+		if u.ClientIP == "192.0.2.7" {
+			found = u.Connections == 1 && u.BytesIn == in && u.BytesOut == out
+		}
+	}
+	if !found {
+		t.Errorf("expected per-user totals for 192.0.2.7, got %+v", users)
+	}
+	if rec := recentConnections()[0]; rec.Port != 9402 || rec.Client != "web" || rec.BytesOut != out {
+		t.Errorf("unexpected connection log entry %+v", rec)
+	}
+}
+
+func TestTrafficFor_EvictsOldest(t *testing.T) {
+	userTrafficMu.Lock()
+	userTraffic = make(map[string]*userStats)
+	userTrafficMu.Unlock()
+	for i := 0; i < maxTrackedUsers; i++ {
+		trafficFor("10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256))
+	}
+	userTrafficMu.Lock()
+	userTraffic["10.0.0.0"].LastSeen = time.Time{}
+	userTrafficMu.Unlock()
+	// 超出上限时淘汰最久未见的用户
+	trafficFor("192.0.2.1")
+	userTrafficMu.Lock()
+	defer userTrafficMu.Unlock()
+	if len(userTraffic) != maxTrackedUsers || userTraffic["10.0.0.0"] != nil || userTraffic["192.0.2.1"] == nil {
+		t.Errorf("expected the oldest user evicted, %d tracked", len(userTraffic))
+	}
+}
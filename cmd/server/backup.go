@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"gotunnel/pkg/log"
+	"gotunnel/pkg/protocol"
+)
+
+// joinAsBackup adds mem as a hot standby to the mapping served by the tunnel named reg.BackupFor.
+// The backup takes the primary's port; its own remote port and bind address are ignored.
+// Callers must hold mappingTableMu.
+func joinAsBackup(reg protocol.RegisterRequest, mem *Member) (int, *Mapping, error) {
+	if reg.Group != "" {
+		return 0, nil, fmt.Errorf("a backup tunnel cannot join a group")
+	}
+	if reg.BackupFor == reg.Name {
+		return 0, nil, fmt.Errorf("tunnel %s cannot be its own backup", reg.Name)
+	}
+	port, m := primaryMapping(reg.BackupFor)
+	if m == nil {
+		// Also find a mapping the primary has left, kept alive by its other backups
+		port, m = standbyMapping(reg.BackupFor)
+	}
+	if m == nil {
+		return 0, nil, fmt.Errorf("primary tunnel %s is not registered", reg.BackupFor)
+	}
+	if m.Group != "" && subtle.ConstantTimeCompare([]byte(m.GroupKey), []byte(reg.GroupKey)) != 1 {
+		log.Warn("server", "server.group_key_mismatch", map[string]interface{}{"Group": m.Group, "Name": reg.Name})
+		return 0, nil, fmt.Errorf("group key mismatch for group %s", m.Group)
+	}
+	mem.BackupFor = reg.BackupFor
+	m.Members = append(m.Members, mem)
+	log.Info("server", "server.backup_registered", map[string]interface{}{
+		"Name": mem.Name, "Primary": mem.BackupFor, "Port": port,
+	})
+	updateFailover(port, m)
+	m.notify()
+	return port, m, nil
+}
+
+// primaryMapping returns the mapping a primary member named name belongs to.
+// Callers must hold mappingTableMu.
+func primaryMapping(name string) (int, *Mapping) {
+	for port, m := range mappingTable {
+		for _, mem := range m.Members {
+			if mem.BackupFor == "" && mem.Name == name {
+				return port, m
+			}
+		}
+	}
+	return 0, nil
+}
+
+// standbyMapping returns the mapping holding backups for the tunnel named name.
+// Callers must hold mappingTableMu.
+func standbyMapping(name string) (int, *Mapping) {
+	for port, m := range mappingTable {
+		for _, mem := range m.Members {
+			if mem.BackupFor == name {
+				return port, m
+			}
+		}
+	}
+	return 0, nil
+}
+
+// takeOver makes mem the primary of a mapping kept by its backups. Like a plain registration
+// taking over a port, any primary still attached is closed; the backups stay on standby.
+// Callers must hold mappingTableMu.
+func takeOver(port int, m *Mapping, mem *Member) {
+	kept := m.Members[:0]
+	for _, old := range m.Members {
+		if old.BackupFor == mem.Name {
+			kept = append(kept, old)
+			continue
+		}
+		endSession(old)
+		_ = old.ClientConn.Close()
+	}
+	m.Members = append(kept, mem)
+	m.notify()
+}
+
+// availableMembers returns the members pickMember chooses from: the primaries that can take users,
+// or the backups that can when no primary is left. Callers must hold mappingTableMu.
+func availableMembers(m *Mapping) (available []*Member, backups bool) {
+	var standby []*Member
+	for _, mem := range m.Members {
+		if mem.Detached || mem.Offline || mem.Unhealthy {
+			continue
+		}
+		if mem.BackupFor != "" {
+			standby = append(standby, mem)
+		} else {
+			available = append(available, mem)
+		}
+	}
+	if len(available) == 0 && len(standby) > 0 {
+		return standby, true
+	}
+	return available, false
+}
+
+// updateFailover logs when the mapping on port switches between its primaries and its backups.
+// Callers must hold mappingTableMu.
+func updateFailover(port int, m *Mapping) {
+	available, backups := availableMembers(m)
+	if backups == m.failedOver {
+		return
+	}
+	m.failedOver = backups
+	if backups {
+		log.Warn("server", "server.backup_activated", map[string]interface{}{
+			"Port": port, "Primary": available[0].BackupFor, "Name": available[0].Name,
+		})
+		return
+	}
+	log.Info("server", "server.backup_deactivated", map[string]interface{}{"Port": port})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"gotunnel/pkg/protocol"
+	"testing"
+)
+
+func TestAvailableMembers_Backup(t *testing.T) {
+	primary := &Member{Name: "db"}
+	backup := &Member{Name: "db-standby", BackupFor: "db"}
+	m := &Mapping{Members: []*Member{backup, primary}}
+
+	// 主隧道可用时备用隧道不接流量
+	if got := pickMember(m, ""); got != primary {
+		t.Fatalf("expected primary, got %s", got.Name)
+	}
+	for _, down := range []func(){
+		func() { primary.Offline = true },
+		func() { primary.Offline, primary.Detached = false, true },
+	} {
+		down()
+		if got := pickMember(m, ""); got != backup {
+			t.Errorf("expected backup while primary is unavailable, got %v", got)
+		}
+	}
+	primary.Detached = false
+	if got := pickMember(m, ""); got != primary {
+		t.Errorf("expected switch back to primary, got %s", got.Name)
+	}
+}
+
+func TestHandleControlConn_BackupFailover(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+
+	primaryReq := protocol.RegisterRequest{Type: "register", LocalPort: 5432, Token: "test-token", Name: "db"}
+	primary, closePrimary := openControl(t, primaryReq)
+	backup, closeBackup := openControl(t, protocol.RegisterRequest{Type: "register", LocalPort: 5432, RemotePort: 10022, Token: "test-token", Name: "db-standby", BackupFor: "db"})
+	defer closeBackup()
+	if primary.Status != "ok" || backup.Status != "ok" || backup.RemotePort != primary.RemotePort {
+		t.Fatalf("backup should stand by on the primary's port, got %+v and %+v", primary, backup)
+	}
+	port := primary.RemotePort
+
+	pick := func() string {
+		mappingTableMu.Lock()
+		defer mappingTableMu.Unlock()
+		m, ok := mappingTable[port]
+		if !ok {
+			return ""
+		}
+		if mem := pickMember(m, ""); mem != nil {
+			return mem.Name
+		}
+		return ""
+	}
+	if got := pick(); got != "db" {
+		t.Errorf("expected primary to serve users, got %q", got)
+	}
+
+	// 主隧道断开后，备用隧道接管且端口保持监听
+	closePrimary()
+	if got := pick(); got != "db-standby" {
+		t.Fatalf("expected backup to take over, got %q", got)
+	}
+	mappingTableMu.Lock()
+	listening := isListening(mappingTable[port])
+	mappingTableMu.Unlock()
+	if !listening {
+		t.Error("public listener should stay open while the backup serves")
+	}
+
+	// 主隧道重新注册时回到原端口，备用隧道继续待命
+	again, closeAgain := openControl(t, primaryReq)
+	defer closeAgain()
+	if again.Status != "ok" || again.RemotePort != port {
+		t.Fatalf("expected primary back on port %d, got %+v", port, again)
+	}
+	mappingTableMu.Lock()
+	members := len(mappingTable[port].Members)
+	mappingTableMu.Unlock()
+	if got := pick(); got != "db" || members != 2 {
+		t.Errorf("expected switch back with backup kept, got %q with %d members", got, members)
+	}
+}
+
+func TestHandleControlConn_BackupRejected(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+
+	for _, req := range []protocol.RegisterRequest{
+		{Type: "register", LocalPort: 22, Token: "test-token", Name: "b", BackupFor: "missing"},
+		{Type: "register", LocalPort: 22, Token: "test-token", Name: "self", BackupFor: "self"},
+		{Type: "register", LocalPort: 22, Token: "test-token", Name: "b", BackupFor: "x", Group: "g"},
+	} {
+		resp, closeConn := openControl(t, req)
+		closeConn()
+		if resp.Status != "fail" {
+			t.Errorf("expected %+v to be rejected, got %+v", req, resp)
+		}
+	}
+}
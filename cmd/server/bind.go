@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// defaultBindAddr is the address public listeners bind to when the client does not ask for one ("" = all interfaces).
+var defaultBindAddr string
+
+// allowedBindAddrs lists the addresses clients may request: IPs, CIDRs or interface names.
+// An empty list only allows the default bind address.
+var allowedBindAddrs []string
+
+// resolveBindAddr validates a client-requested bind address against allowedBindAddrs and
+// returns the IP literal to listen on ("" means all interfaces).
+func resolveBindAddr(requested string) (string, error) {
+	requested = strings.Trim(strings.TrimSpace(requested), "[]")
+	if requested == "" || requested == defaultBindAddr {
+		return lookupBindIP(defaultBindAddr)
+	}
+	ip, err := lookupBindIP(requested)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range allowedBindAddrs {
+		if bindAddrAllowed(entry, requested, ip) {
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("bind address %s is not allowed by server policy", requested)
+}
+
+// lookupBindIP turns an IP literal or interface name into an IP literal.
+func lookupBindIP(addr string) (string, error) {
+	if addr == "" {
+		return "", nil
+	}
+	if ip := net.ParseIP(stripZone(addr)); ip != nil {
+		return addr, nil
+	}
+	ips, err := interfaceIPs(addr)
+	if err != nil {
+		return "", fmt.Errorf("unknown bind address %s: %w", addr, err)
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("interface %s has no usable address", addr)
+	}
+	return ips[0].String(), nil
+}
+
+// bindAddrAllowed reports whether one allowed_bind_addrs entry permits the requested address.
+func bindAddrAllowed(entry, requested, ip string) bool {
+	entry = strings.Trim(strings.TrimSpace(entry), "[]")
+	if entry == requested || entry == ip {
+		return true
+	}
+	parsed := net.ParseIP(stripZone(ip))
+	if parsed == nil {
+		return false
+	}
+	if _, cidr, err := net.ParseCIDR(entry); err == nil {
+		return cidr.Contains(parsed)
+	}
+	if allowed := net.ParseIP(stripZone(entry)); allowed != nil {
+		return allowed.Equal(parsed)
+	}
+	ips, err := interfaceIPs(entry)
+	if err != nil {
+		return false
+	}
+	for _, candidate := range ips {
+		if candidate.Equal(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// interfaceIPs returns the unicast addresses of a network interface, IPv4 first.
+func interfaceIPs(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 []net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			v4 = append(v4, ipNet.IP)
+		} else {
+			v6 = append(v6, ipNet.IP)
+		}
+	}
+	return append(v4, v6...), nil
+}
+
+// stripZone drops an IPv6 zone suffix such as "%eth0" so the address can be parsed.
+func stripZone(addr string) string {
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		return addr[:i]
+	}
+	return addr
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"gotunnel/pkg/protocol"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// loopbackInterface 返回本机回环网卡名（linux 为 lo，macOS 为 lo0）
+func loopbackInterface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestResolveBindAddr_Policy(t *testing.T) {
+	defer func() { allowedBindAddrs, defaultBindAddr = nil, "" }()
+
+	// 未配置白名单时只允许默认地址
+	if addr, err := resolveBindAddr(""); err != nil || addr != "" {
+		t.Errorf("expected all interfaces, got %q err=%v", addr, err)
+	}
+	if _, err := resolveBindAddr("127.0.0.1"); err == nil {
+		t.Error("expected rejection without allowed_bind_addrs")
+	}
+
+	allowedBindAddrs = []string{"127.0.0.1", "10.0.0.0/8", "::1"}
+	for _, ok := range []string{"127.0.0.1", "10.1.2.3", "::1", "[::1]"} {
+		if _, err := resolveBindAddr(ok); err != nil {
+			t.Errorf("%s should be allowed: %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"192.168.1.1", "::2", "no-such-iface0"} {
+		if _, err := resolveBindAddr(bad); err == nil {
+			t.Errorf("%s should be rejected", bad)
+		}
+	}
+
+	// 默认地址无需出现在白名单中
+	defaultBindAddr = "127.0.0.2"
+	if addr, err := resolveBindAddr(""); err != nil || addr != "127.0.0.2" {
+		t.Errorf("expected default bind addr, got %q err=%v", addr, err)
+	}
+}
+
+func TestResolveBindAddr_Interface(t *testing.T) {
+	defer func() { allowedBindAddrs = nil }()
+	lo := loopbackInterface(t)
+
+	// 白名单写网卡名时，请求该网卡名或其地址都应放行
+	allowedBindAddrs = []string{lo}
+	addr, err := resolveBindAddr(lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := net.ParseIP(addr); ip == nil || !ip.IsLoopback() {
+		t.Errorf("expected loopback ip for %s, got %q", lo, addr)
+	}
+	if _, err := resolveBindAddr("127.0.0.1"); err != nil {
+		t.Errorf("address of allowed interface should pass: %v", err)
+	}
+}
+
+func TestHandleControlConn_BindAddrRejected(t *testing.T) {
+	var wbuf bytes.Buffer
+	req := protocol.RegisterRequest{Type: "register", LocalPort: 22, RemotePort: 8080, Token: "test-token", BindAddr: "192.0.2.1"}
+	b, _ := json.Marshal(req)
+	protocol.WritePacket(&wbuf, b)
+	out := &bytes.Buffer{}
+	conn := &mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: out}
+	handleControlConn(conn, "test-token")
+
+	respBytes, err := protocol.ReadPacket(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp protocol.RegisterResponse
+	_ = json.Unmarshal(respBytes, &resp)
+	if resp.Status != "fail" {
+		t.Errorf("expected bind addr to be rejected, got %+v", resp)
+	}
+}
+
+func TestPublicAddrFor_BindAddr(t *testing.T) {
+	publicHost = "203.0.113.10"
+	defer func() { publicHost = "" }()
+	conn := &mockConn{}
+	if got := publicAddrFor(conn, "10.0.0.5", 20001); got != "10.0.0.5:20001" {
+		t.Errorf("specific bind addr should win, got %s", got)
+	}
+	if got := publicAddrFor(conn, "::1", 20001); got != "[::1]:20001" {
+		t.Errorf("expected bracketed ipv6, got %s", got)
+	}
+	if got := publicAddrFor(conn, "0.0.0.0", 20001); got != "203.0.113.10:20001" {
+		t.Errorf("wildcard bind should use public_host, got %s", got)
+	}
+}
+
+func TestListenAndForwardWithStop_BindAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		listenAndForwardWithStop(port, "127.0.0.1", stop)
+		close(done)
+	}()
+	defer func() { close(stop); <-done }()
+
+	// 等待监听启动后，端口应只绑定在回环地址上
+	var probe net.Conn
+	for i := 0; i < 20 && probe == nil; i++ {
+		probe, _ = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if probe == nil {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	if probe == nil {
+		t.Fatal("listener on 127.0.0.1 not reachable")
+	}
+	probe.Close()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gotunnel/pkg/health"
+	"gotunnel/pkg/log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// End-to-end tunnel checks: the server opens a data channel to each member like a user would and
+// runs tunnelCheck over it. A zero tunnelCheckInterval disables them.
+var (
+	tunnelCheck         health.CheckSpec
+	tunnelCheckProbe    = health.ProbeOptions{Timeout: 5 * time.Second}.WithDefaults()
+	tunnelCheckInterval time.Duration
+)
+
+// validateTunnelCheck rejects check specs the server cannot run through a tunnel.
+func validateTunnelCheck(spec health.CheckSpec) error {
+	if spec.Type == health.CheckCommand {
+		return fmt.Errorf("command checks cannot run through a tunnel")
+	}
+	_, err := health.NewChecker(spec)
+	return err
+}
+
+// checkTarget is a member to check, with what is needed to reach it outside mappingTableMu.
+type checkTarget struct {
+	port       int
+	m          *Mapping
+	mem        *Member
+	clientConn net.Conn
+	localPort  int
+}
+
+// checkTunnels checks every attached member that reports its service up, concurrently, and
+// returns once all checks are done or ctx ends.
+func checkTunnels(ctx context.Context) {
+	mappingTableMu.Lock()
+	var targets []checkTarget
+	for port, m := range mappingTable {
+		for _, mem := range m.Members {
+			if mem.Detached || mem.Offline {
+				continue
+			}
+			if mem.checks == nil {
+				mem.checks = health.NewTracker(tunnelCheckProbe)
+			}
+			targets = append(targets, checkTarget{port: port, m: m, mem: mem, clientConn: mem.ClientConn, localPort: mem.LocalPort})
+		}
+	}
+	mappingTableMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t checkTarget) {
+			defer wg.Done()
+			checkMember(ctx, t)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// checkMember runs the tunnel check against one member and records the result.
+func checkMember(ctx context.Context, t checkTarget) {
+	spec := tunnelCheck
+	spec.Dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return openDataChannel(ctx, t.port, t.clientConn, t.localPort)
+	}
+	checker, err := health.NewChecker(spec)
+	if err != nil {
+		// The spec was validated at startup
+		return
+	}
+	checkCtx, cancel := context.WithTimeout(ctx, tunnelCheckProbe.Timeout)
+	// The client only sees its own local port, so that is the address HTTP and TLS checks name
+	err = checker.Check(checkCtx, net.JoinHostPort("127.0.0.1", strconv.Itoa(t.localPort)))
+	cancel()
+	if ctx.Err() != nil {
+		return
+	}
+	recordCheck(t, err)
+}
+
+// recordCheck applies a check result to the member, taking it out of rotation once the check
+// has failed tunnelCheckProbe.Fall times in a row and back in after Rise successes.
+func recordCheck(t checkTarget, checkErr error) {
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	if mappingTable[t.port] != t.m || t.mem.Detached || t.mem.ClientConn != t.clientConn {
+		// The member left or reconnected while the check ran
+		return
+	}
+	mem := t.mem
+	mem.LastCheck = time.Now()
+	mem.CheckError = ""
+	if checkErr != nil {
+		mem.CheckError = checkErr.Error()
+		log.Debug("server", "server.tunnel_check_error", map[string]interface{}{"Port": t.port, "Name": mem.Name, "Error": mem.CheckError})
+	}
+	changed, _ := mem.checks.Observe(checkErr == nil, mem.LastCheck)
+	if !changed {
+		return
+	}
+	mem.Unhealthy = !mem.checks.Alive()
+	serverMetrics.healthTransitions.With("tunnel_check", healthStatus(!mem.Unhealthy)).Inc()
+	if mem.Unhealthy {
+		log.Warn("server", "server.tunnel_check_failed", map[string]interface{}{"Port": t.port, "Name": mem.Name, "Error": mem.CheckError})
+	} else {
+		log.Info("server", "server.tunnel_check_recovered", map[string]interface{}{"Port": t.port, "Name": mem.Name})
+	}
+	refreshListener(t.port, t.m)
+	t.m.notify()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"gotunnel/pkg/health"
+	"gotunnel/pkg/protocol"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidateTunnelCheck(t *testing.T) {
+	for _, spec := range []health.CheckSpec{{}, {Type: health.CheckHTTP}, {Type: health.CheckTLS}} {
+		if err := validateTunnelCheck(spec); err != nil {
+			t.Errorf("%q should be accepted: %v", spec.Type, err)
+		}
+	}
+	// 命令检查只能在本机执行，无法穿过隧道
+	if err := validateTunnelCheck(health.CheckSpec{Type: health.CheckCommand, Command: []string{"true"}}); err == nil {
+		t.Error("expected command check to be rejected")
+	}
+	if err := validateTunnelCheck(health.CheckSpec{Type: "ping"}); err == nil {
+		t.Error("expected unknown check type to be rejected")
+	}
+}
+
+// fakeTunnelClient 模拟客户端：收到 open_data_channel 后在 answer 为真时建立数据通道并应答一次 HTTP 请求
+func fakeTunnelClient(t *testing.T, port int, answer *atomic.Bool) net.Conn {
+	ctrlR, ctrlW := io.Pipe()
+	t.Cleanup(func() { ctrlR.Close() })
+	go func() {
+		for {
+			packet, err := protocol.ReadPacket(ctrlR)
+			if err != nil {
+				return
+			}
+			var open protocol.RegisterRequest
+			_ = json.Unmarshal(packet, &open)
+			if open.Type != "open_data_channel" || !answer.Load() {
+				continue
+			}
+			data, dataPeer := net.Pipe()
+			if !deliverDataChannel(open.ConnID, port, dataPeer) {
+				data.Close()
+				continue
+			}
+			go func() {
+				defer data.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(data)); err != nil {
+					return
+				}
+				io.WriteString(data, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+			}()
+		}
+	}()
+	return &mockConn{Writer: ctrlW}
+}
+
+func TestCheckTunnels_MarksBrokenPath(t *testing.T) {
+	oldCheck, oldProbe := tunnelCheck, tunnelCheckProbe
+	defer func() { tunnelCheck, tunnelCheckProbe = oldCheck, oldProbe }()
+	tunnelCheck = health.CheckSpec{Type: health.CheckHTTP, ExpectBody: "ok"}
+	tunnelCheckProbe = health.ProbeOptions{Timeout: 300 * time.Millisecond, Rise: 1, Fall: 1}.WithDefaults()
+
+	var goodUp, brokenUp atomic.Bool
+	goodUp.Store(true)
+	good := &Member{Name: "good", LocalPort: 3000, ClientConn: fakeTunnelClient(t, 9200, &goodUp)}
+	broken := &Member{Name: "broken", LocalPort: 3000, ClientConn: fakeTunnelClient(t, 9200, &brokenUp)}
+	m := &Mapping{Policy: policyRoundRobin, Members: []*Member{good, broken}, ListenDone: make(chan struct{})}
+	mappingTableMu.Lock()
+	mappingTable = map[int]*Mapping{9200: m}
+	mappingTableMu.Unlock()
+	defer stopListening(m)
+
+	// 心跳正常但数据通道打不开的成员被判为不健康，不再分配用户
+	checkTunnels(context.Background())
+	mappingTableMu.Lock()
+	if good.Unhealthy || !broken.Unhealthy || broken.CheckError == "" || broken.LastCheck.IsZero() {
+		t.Fatalf("expected only broken member unhealthy, good=%+v broken=%+v", good, broken)
+	}
+	for i := 0; i < 3; i++ {
+		if got := pickMember(m, ""); got != good {
+			t.Fatalf("expected users to go to the healthy member, got %v", got)
+		}
+	}
+	mappingTableMu.Unlock()
+
+	// 数据通道恢复后重新加入轮询
+	brokenUp.Store(true)
+	checkTunnels(context.Background())
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	if broken.Unhealthy || broken.CheckError != "" {
+		t.Errorf("expected broken member to recover, got %+v", broken)
+	}
+}
+
+func TestCheckTunnels_AllUnhealthyStopsListener(t *testing.T) {
+	oldCheck, oldProbe := tunnelCheck, tunnelCheckProbe
+	defer func() { tunnelCheck, tunnelCheckProbe = oldCheck, oldProbe }()
+	tunnelCheck = health.CheckSpec{}
+	tunnelCheckProbe = health.ProbeOptions{Timeout: 100 * time.Millisecond, Fall: 2}.WithDefaults()
+
+	var up atomic.Bool
+	mem := &Member{Name: "only", LocalPort: 3000, ClientConn: fakeTunnelClient(t, 9201, &up)}
+	m := &Mapping{Members: []*Member{mem}, ListenDone: make(chan struct{})}
+	mappingTableMu.Lock()
+	mappingTable = map[int]*Mapping{9201: m}
+	mappingTableMu.Unlock()
+
+	// 未达到连续失败次数前保持监听
+	checkTunnels(context.Background())
+	if mem.Unhealthy || !isListening(m) {
+		t.Fatal("a single failure should not take the tunnel down with fall 2")
+	}
+	checkTunnels(context.Background())
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	if !mem.Unhealthy || isListening(m) {
+		t.Error("expected the public listener to stop once every member fails the check")
+	}
+}
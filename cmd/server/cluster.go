@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gotunnel/pkg/cluster"
+	"gotunnel/pkg/core"
+	"gotunnel/pkg/log"
+	"gotunnel/pkg/protocol"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Cluster membership. With a nil clusterStore the server runs alone and none of this is used.
+var (
+	clusterStore cluster.Store
+	nodeID       string             // This node's ID in the store
+	nodePeerAddr string             // Control address other nodes forward users to
+	clusterToken string             // Secret peers present when forwarding users, never the client token
+	clusterLease = 30 * time.Second // How long a claim lives without renewal
+
+	peerDialTimeout = 5 * time.Second
+)
+
+// peerListener accepts users on a port whose client is connected to another node.
+type peerListener struct {
+	ln    net.Listener
+	owner cluster.Owner
+}
+
+var (
+	peerListeners   = make(map[int]*peerListener)
+	peerListenersMu sync.Mutex
+)
+
+// Store writes of this node. The store may be slow, e.g. the file store waiting for its lock, so
+// it is never called with mappingTableMu held: registrations reserve a port in claiming, claim it
+// without the lock and re-check the mapping table afterwards. claimMu keeps a claim and a release
+// of the same port from overtaking each other.
+var (
+	claimMu  sync.Mutex
+	claiming = make(map[int]int) // Ports registrations are claiming, guarded by mappingTableMu
+)
+
+// servesPort reports whether this node serves port or a registration is claiming it.
+func servesPort(port int) bool {
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	_, exists := mappingTable[port]
+	return exists || claiming[port] > 0
+}
+
+// claimPort records this node as the owner of port, public on bindAddr, in the cluster store and
+// stops forwarding the port to a peer. A port this node no longer serves is left alone. Callers
+// must not hold mappingTableMu.
+func claimPort(port int, bindAddr string) error {
+	if clusterStore == nil {
+		return nil
+	}
+	claimMu.Lock()
+	defer claimMu.Unlock()
+	if !servesPort(port) {
+		return nil
+	}
+	err := clusterStore.Claim(cluster.Owner{Port: port, Node: nodeID, PeerAddr: nodePeerAddr, BindAddr: bindAddr, Expires: time.Now().Add(clusterLease)})
+	if err != nil {
+		return err
+	}
+	stopPeerListener(port)
+	return nil
+}
+
+// releasePort drops this node's claim on port in the background, unless a new registration
+// serves the port by then. Callers must hold mappingTableMu.
+func releasePort(port int) {
+	if clusterStore == nil {
+		return
+	}
+	store, node := clusterStore, nodeID
+	go func() {
+		claimMu.Lock()
+		defer claimMu.Unlock()
+		if servesPort(port) {
+			return
+		}
+		if err := store.Release(port, node); err != nil {
+			log.Warnf("server", "server.cluster_store_failed", err)
+		}
+	}()
+}
+
+// claimedByPeer reports whether another node serves port.
+func claimedByPeer(port int) bool {
+	peerListenersMu.Lock()
+	defer peerListenersMu.Unlock()
+	_, ok := peerListeners[port]
+	return ok
+}
+
+// renewClaims extends the lease on every port this node serves. A port whose lease was lost to
+// another node, e.g. after this node could not reach the store for too long, is evicted locally.
+func renewClaims() {
+	mappingTableMu.Lock()
+	type served struct {
+		m        *Mapping
+		bindAddr string
+	}
+	ports := make(map[int]served, len(mappingTable))
+	for port, m := range mappingTable {
+		ports[port] = served{m, m.BindAddr}
+	}
+	mappingTableMu.Unlock()
+	for port, p := range ports {
+		m := p.m
+		err := claimPort(port, p.bindAddr)
+		var claimed *cluster.ClaimedError
+		switch {
+		case errors.As(err, &claimed):
+			mappingTableMu.Lock()
+			// The mapping may have been replaced while the store was asked
+			if mappingTable[port] == m {
+				log.Warn("server", "server.cluster_claim_lost", map[string]interface{}{"Port": port, "Name": claimed.Owner.Node})
+				evictMapping(port, m)
+			}
+			mappingTableMu.Unlock()
+		case err != nil:
+			log.Warnf("server", "server.cluster_store_failed", err)
+		}
+	}
+}
+
+// syncPeers listens on every port served by another node, on the address the owner binds it to,
+// and stops listening on ports whose owner is gone, so users can reach any tunnel through any node.
+func syncPeers() {
+	owners, err := clusterStore.Owners()
+	if err != nil {
+		log.Warnf("server", "server.cluster_store_failed", err)
+		return
+	}
+	mappingTableMu.Lock()
+	local := make(map[int]bool, len(mappingTable))
+	for port := range mappingTable {
+		local[port] = true
+	}
+	mappingTableMu.Unlock()
+
+	remote := make(map[int]cluster.Owner)
+	for _, o := range owners {
+		if o.Node != nodeID && !local[o.Port] {
+			remote[o.Port] = o
+		}
+	}
+	peerListenersMu.Lock()
+	defer peerListenersMu.Unlock()
+	for port, pl := range peerListeners {
+		if o, ok := remote[port]; !ok || o.BindAddr != pl.owner.BindAddr {
+			_ = pl.ln.Close()
+			delete(peerListeners, port)
+			log.Infof("server", "server.peer_stopped", port)
+		}
+	}
+	for port, o := range remote {
+		if pl, ok := peerListeners[port]; ok {
+			pl.owner = o
+			continue
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(o.BindAddr, strconv.Itoa(port)))
+		if err != nil {
+			log.Errorf("server", "server.listen_port_failed", err)
+			continue
+		}
+		pl := &peerListener{ln: ln, owner: o}
+		peerListeners[port] = pl
+		log.Info("server", "server.peer_listening", map[string]interface{}{"Port": port, "Name": o.Node})
+		go acceptForPeer(port, pl)
+	}
+}
+
+// stopPeerListener stops forwarding port to another node.
+func stopPeerListener(port int) {
+	peerListenersMu.Lock()
+	defer peerListenersMu.Unlock()
+	if pl, ok := peerListeners[port]; ok {
+		_ = pl.ln.Close()
+		delete(peerListeners, port)
+	}
+}
+
+// leaveCluster releases every claim of this node and stops all peer listeners, so the other
+// nodes take over as soon as clients reconnect to them. Callers must not hold mappingTableMu.
+func leaveCluster(ports []int) {
+	if clusterStore == nil {
+		return
+	}
+	claimMu.Lock()
+	for _, port := range ports {
+		if err := clusterStore.Release(port, nodeID); err != nil {
+			log.Warnf("server", "server.cluster_store_failed", err)
+		}
+	}
+	claimMu.Unlock()
+	peerListenersMu.Lock()
+	for port, pl := range peerListeners {
+		_ = pl.ln.Close()
+		delete(peerListeners, port)
+	}
+	peerListenersMu.Unlock()
+}
+
+// acceptForPeer accepts users on a peer listener until it is closed.
+func acceptForPeer(port int, pl *peerListener) {
+	for {
+		userConn, err := pl.ln.Accept()
+		if err != nil {
+			return
+		}
+		peerListenersMu.Lock()
+		addr := pl.owner.PeerAddr
+		peerListenersMu.Unlock()
+		go forwardToPeer(port, addr, userConn)
+	}
+}
+
+// forwardToPeer hands userConn to the node at addr that serves port and relays between them.
+func forwardToPeer(port int, addr string, userConn net.Conn) {
+	peerConn, err := net.DialTimeout("tcp", addr, peerDialTimeout)
+	if err != nil {
+		log.Warn("server", "server.peer_forward_failed", map[string]interface{}{"Port": port, "Addr": addr, "Error": err.Error()})
+		_ = userConn.Close()
+		return
+	}
+	req := protocol.RegisterRequest{Type: "peer_forward", RemotePort: port, Token: clusterToken, Name: nodeID, ClientIP: remoteIP(userConn)}
+	b, _ := json.Marshal(req)
+	var resp protocol.RegisterResponse
+	if err = protocol.WritePacket(peerConn, b); err == nil {
+		var packet []byte
+		if packet, err = protocol.ReadPacket(peerConn); err == nil {
+			_ = json.Unmarshal(packet, &resp)
+		}
+	}
+	if err == nil && resp.Status != "ok" {
+		err = errors.New(resp.Reason)
+	}
+	if err != nil {
+		log.Warn("server", "server.peer_forward_failed", map[string]interface{}{"Port": port, "Addr": addr, "Error": err.Error()})
+		_ = peerConn.Close()
+		_ = userConn.Close()
+		return
+	}
+	untrack := relayTracker.Track(userConn, peerConn)
+	core.RelayConn(userConn, peerConn)
+	untrack()
+}
+
+// handlePeerForward serves a user another node forwarded to this one as if it had connected here.
+func handlePeerForward(conn net.Conn, reg protocol.RegisterRequest) {
+	mappingTableMu.Lock()
+	_, exists := mappingTable[reg.RemotePort]
+	mappingTableMu.Unlock()
+	resp := protocol.RegisterResponse{Type: "register_resp", Status: "ok"}
+	if !exists {
+		resp = protocol.RegisterResponse{Type: "register_resp", Status: "fail", Reason: fmt.Sprintf("port %d is not served here", reg.RemotePort)}
+	}
+	msg, _ := json.Marshal(resp)
+	if err := protocol.WritePacket(conn, msg); err != nil {
+		log.Errorf("server", "server.send_response_failed", err)
+		_ = conn.Close()
+		return
+	}
+	if !exists {
+		log.Warnf("server", "server.mapping_not_found", reg.RemotePort)
+		_ = conn.Close()
+		return
+	}
+	log.Debug("server", "server.peer_forward_received", map[string]interface{}{"Port": reg.RemotePort, "Name": reg.Name})
+	forwardUserFrom(reg.RemotePort, conn, reg.ClientIP)
+}
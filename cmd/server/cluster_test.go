@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"gotunnel/pkg/cluster"
+	"gotunnel/pkg/protocol"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// joinTestCluster 让本进程以 node-b 身份加入一个内存集群
+func joinTestCluster(t *testing.T) *cluster.MemoryStore {
+	store := cluster.NewMemoryStore()
+	clusterStore, nodeID, nodePeerAddr, clusterToken = store, "node-b", "127.0.0.1:17000", "cluster-secret"
+	t.Cleanup(func() {
+		leaveCluster(nil)
+		clusterStore, nodeID, nodePeerAddr, clusterToken = nil, "", "", ""
+	})
+	return store
+}
+
+// freePort 返回一个当前空闲的本地端口
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestClusterClaim(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+	store := joinTestCluster(t)
+
+	// 端口已被其他节点持有时拒绝注册
+	taken := freePort(t)
+	_ = store.Claim(cluster.Owner{Port: taken, Node: "node-a", PeerAddr: "10.0.0.1:17000", Expires: time.Now().Add(time.Minute)})
+	resp, closeConn := openControl(t, protocol.RegisterRequest{Type: "register", LocalPort: 22, RemotePort: taken, Token: "test-token"})
+	closeConn()
+	if resp.Status != "fail" {
+		t.Errorf("expected port owned by node-a to be rejected, got %+v", resp)
+	}
+
+	// 注册成功后登记归属，映射释放时一并释放
+	resp, closeConn = openControl(t, protocol.RegisterRequest{Type: "register", LocalPort: 22, Token: "test-token"})
+	owners, _ := store.Owners()
+	var ours bool
+	for _, o := range owners {
+		ours = ours || (o.Port == resp.RemotePort && o.Node == "node-b" && o.PeerAddr == "127.0.0.1:17000")
+	}
+	if resp.Status != "ok" || !ours {
+		t.Fatalf("expected node-b to own port %d, got %+v", resp.RemotePort, owners)
+	}
+	closeConn()
+	// 释放在后台进行，不占用映射表锁
+	deadline := time.Now().Add(2 * time.Second)
+	for ours && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		owners, _ = store.Owners()
+		ours = false
+		for _, o := range owners {
+			ours = ours || o.Port == resp.RemotePort
+		}
+	}
+	if ours {
+		t.Errorf("claim should be released with the mapping, got %+v", owners)
+	}
+}
+
+// slowStore 在 Claim 中阻塞，模拟等待文件锁的存储
+type slowStore struct {
+	*cluster.MemoryStore
+	entered, proceed chan struct{}
+}
+
+func (s *slowStore) Claim(o cluster.Owner) error {
+	s.entered <- struct{}{}
+	<-s.proceed
+	return s.MemoryStore.Claim(o)
+}
+
+func TestClusterClaim_StoreOutsideLock(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+	joinTestCluster(t)
+	store := &slowStore{MemoryStore: cluster.NewMemoryStore(), entered: make(chan struct{}), proceed: make(chan struct{})}
+	clusterStore = store
+
+	port := freePort(t)
+	done := make(chan protocol.RegisterResponse, 1)
+	go func() {
+		resp, closeConn := openControl(t, protocol.RegisterRequest{Type: "register", Name: "slow", LocalPort: 22, RemotePort: port, Token: "test-token"})
+		closeConn()
+		done <- resp
+	}()
+	<-store.entered
+	// 存储阻塞期间映射表仍可访问，端口也不会被分配给别的注册
+	locked := make(chan struct{})
+	go func() {
+		listMappings()
+		mappingTableMu.Lock()
+		reserved := claiming[port] > 0
+		mappingTableMu.Unlock()
+		if !reserved {
+			t.Error("expected the port to be reserved while it is claimed")
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("mapping table locked while waiting for the cluster store")
+	}
+	close(store.proceed)
+	if resp := <-done; resp.Status != "ok" || resp.RemotePort != port {
+		t.Errorf("expected registration to succeed once the store answers, got %+v", resp)
+	}
+}
+
+func TestRenewClaims_LostClaimEvicts(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+	store := joinTestCluster(t)
+
+	resp, closeConn := openControl(t, protocol.RegisterRequest{Type: "register", LocalPort: 22, Token: "test-token"})
+	defer closeConn()
+	// 模拟租约过期后被其他节点接管
+	_ = store.Release(resp.RemotePort, "node-b")
+	_ = store.Claim(cluster.Owner{Port: resp.RemotePort, Node: "node-a", Expires: time.Now().Add(time.Minute)})
+	renewClaims()
+	mappingTableMu.Lock()
+	_, exists := mappingTable[resp.RemotePort]
+	mappingTableMu.Unlock()
+	if exists {
+		t.Error("mapping should be evicted once another node holds its port")
+	}
+}
+
+func TestSyncPeers_ForwardsToOwner(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+	store := joinTestCluster(t)
+
+	// 模拟 node-a：校验 peer_forward 请求后回显用户数据
+	nodeA, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nodeA.Close()
+	got := make(chan protocol.RegisterRequest, 1)
+	go func() {
+		c, err := nodeA.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b, _ := protocol.ReadPacket(c)
+		var req protocol.RegisterRequest
+		_ = json.Unmarshal(b, &req)
+		got <- req
+		ok, _ := json.Marshal(protocol.RegisterResponse{Type: "register_resp", Status: "ok"})
+		_ = protocol.WritePacket(c, ok)
+		_, _ = io.Copy(c, c)
+	}()
+
+	port := freePort(t)
+	_ = store.Claim(cluster.Owner{Port: port, Node: "node-a", PeerAddr: nodeA.Addr().String(), BindAddr: "127.0.0.1", Expires: time.Now().Add(time.Minute)})
+	syncPeers()
+	if !claimedByPeer(port) {
+		t.Fatal("expected a peer listener for the port served by node-a")
+	}
+	// 代为监听的地址与归属节点的绑定地址一致
+	peerListenersMu.Lock()
+	bound := peerListeners[port].ln.Addr().(*net.TCPAddr).IP.String()
+	peerListenersMu.Unlock()
+	if bound != "127.0.0.1" {
+		t.Errorf("expected the peer listener on node-a's bind address, got %s", bound)
+	}
+
+	user, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Close()
+	_, _ = user.Write([]byte("hi"))
+	buf := make([]byte, 2)
+	user.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(user, buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("expected user to be relayed through node-a, got %q err=%v", buf, err)
+	}
+	req := <-got
+	if req.Type != "peer_forward" || req.RemotePort != port || req.Token != "cluster-secret" || req.ClientIP != "127.0.0.1" {
+		t.Errorf("unexpected peer_forward request %+v", req)
+	}
+
+	// 归属消失后停止代为监听
+	_ = store.Release(port, "node-a")
+	syncPeers()
+	if claimedByPeer(port) {
+		t.Error("peer listener should stop once node-a releases the port")
+	}
+}
+
+func TestHandleControlConn_PeerForward(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	ctrlR, ctrlW := io.Pipe()
+	defer ctrlR.Close()
+	mappingTable[9200] = &Mapping{Policy: policyRoundRobin, Members: []*Member{{ClientConn: &mockConn{Writer: ctrlW}, LocalPort: 3000}}}
+	mappingTableMu.Unlock()
+	clusterToken = "cluster-secret"
+	defer func() { clusterToken = "" }()
+
+	// 客户端持有的 token 不能用于 peer_forward，防止伪造 client_ip
+	spoof, spoofSide := net.Pipe()
+	defer spoof.Close()
+	go handleControlConn(spoofSide, "test-token")
+	b, _ := json.Marshal(protocol.RegisterRequest{Type: "peer_forward", RemotePort: 9200, Token: "test-token", ClientIP: "192.0.2.99"})
+	_ = protocol.WritePacket(spoof, b)
+	respBytes, _ := protocol.ReadPacket(spoof)
+	var resp protocol.RegisterResponse
+	_ = json.Unmarshal(respBytes, &resp)
+	if resp.Status != "fail" {
+		t.Fatalf("expected peer_forward with the client token to be refused, got %+v", resp)
+	}
+
+	peer, peerSide := net.Pipe()
+	defer peer.Close()
+	go handleControlConn(peerSide, "test-token")
+	b, _ = json.Marshal(protocol.RegisterRequest{Type: "peer_forward", RemotePort: 9200, Token: "cluster-secret", Name: "node-a", ClientIP: "192.0.2.7"})
+	_ = protocol.WritePacket(peer, b)
+	respBytes, err := protocol.ReadPacket(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = json.Unmarshal(respBytes, &resp)
+	if resp.Status != "ok" {
+		t.Fatalf("expected peer forward to be accepted, got %+v", resp)
+	}
+
+	// 转发来的用户按本地用户处理：向客户端请求数据通道
+	packet, err := protocol.ReadPacket(ctrlR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var open protocol.RegisterRequest
+	_ = json.Unmarshal(packet, &open)
+	if open.Type != "open_data_channel" || open.RemotePort != 9200 {
+		t.Fatalf("unexpected open_data_channel %+v", open)
+	}
+	data, dataPeer := net.Pipe()
+	defer data.Close()
+	deliverDataChannel(open.ConnID, 9200, dataPeer)
+	go peer.Write([]byte("ok"))
+	buf := make([]byte, 2)
+	data.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(data, buf); err != nil || string(buf) != "ok" {
+		t.Errorf("expected peer bytes on the data channel, got %q err=%v", buf, err)
+	}
+
+	// 本节点没有该端口时拒绝
+	other, otherSide := net.Pipe()
+	defer other.Close()
+	go handleControlConn(otherSide, "test-token")
+	b, _ = json.Marshal(protocol.RegisterRequest{Type: "peer_forward", RemotePort: 9201, Token: "cluster-secret"})
+	_ = protocol.WritePacket(other, b)
+	respBytes, _ = protocol.ReadPacket(other)
+	_ = json.Unmarshal(respBytes, &resp)
+	if resp.Status != "fail" {
+		t.Errorf("expected unknown port to be refused, got %+v", resp)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"gotunnel/pkg/log"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webFiles is the dashboard, served from the admin listener. It is plain HTML and JavaScript,
+// nothing needs building.
+//
+//go:embed web
+var webFiles embed.FS
+
+const (
+	sessionCookie     = "gotunnel_session"
+	defaultSessionTTL = 12 * time.Hour
+	connLogSize       = 200 // Recent user connections kept for the dashboard
+
+	loginFreeAttempts = 5                // Failed logins or tokens after which an address has to wait
+	loginBaseDelay    = time.Second      // Wait after failure number loginFreeAttempts, doubled after each further one
+	loginMaxDelay     = 15 * time.Minute // Longest wait; an address quiet for this long starts over
+)
+
+// adminAuth is who may use the admin listener: API clients send Token as a bearer token, people
+// log in to the dashboard with Username and Password and get a session cookie.
+type adminAuth struct {
+	Token      string
+	Username   string
+	Password   string
+	SessionTTL time.Duration
+}
+
+// sessionStore holds the dashboard's logged-in sessions in memory; a restart logs everyone out.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]time.Time // Session ID to expiry
+	ttl      time.Duration
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	return &sessionStore{sessions: make(map[string]time.Time), ttl: ttl}
+}
+
+// create starts a session and returns its ID.
+func (s *sessionStore) create() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	id := hex.EncodeToString(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for old, expiry := range s.sessions {
+		if now.After(expiry) {
+			delete(s.sessions, old)
+		}
+	}
+	s.sessions[id] = now.Add(s.ttl)
+	return id
+}
+
+// valid reports whether id is a live session.
+func (s *sessionStore) valid(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiry, ok := s.sessions[id]
+	if ok && time.Now().After(expiry) {
+		delete(s.sessions, id)
+		return false
+	}
+	return ok
+}
+
+func (s *sessionStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// loginLimiter slows down guessing the admin password or token: once an address failed
+// loginFreeAttempts times it must wait before trying again, twice as long after every further
+// failure. A successful login clears the address.
+type loginLimiter struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailures // Address to its failed attempts
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time // Latest failure
+	until time.Time // No attempt is accepted before this
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{failures: make(map[string]*loginFailures)}
+}
+
+// wait returns how long ip must wait before its next attempt, 0 if it may try now.
+func (l *loginLimiter) wait(ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.failures[ip]; ok {
+		if wait := time.Until(f.until); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// fail records a failed attempt from ip.
+func (l *loginLimiter) fail(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for addr, f := range l.failures {
+		if now.Sub(f.last) > loginMaxDelay && now.After(f.until) {
+			delete(l.failures, addr)
+		}
+	}
+	f, ok := l.failures[ip]
+	if !ok {
+		f = &loginFailures{}
+		l.failures[ip] = f
+	}
+	f.count++
+	f.last = now
+	if over := f.count - loginFreeAttempts; over >= 0 {
+		delay := loginMaxDelay
+		if over < 20 && loginBaseDelay<<over < loginMaxDelay {
+			delay = loginBaseDelay << over
+		}
+		f.until = now.Add(delay)
+		log.Warn("server", "server.admin_login_throttled", map[string]interface{}{"Addr": ip, "Wait": delay})
+	}
+}
+
+// succeed forgets the failures of ip.
+func (l *loginLimiter) succeed(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, ip)
+}
+
+// throttled answers 429 if ip has to wait before its next attempt.
+func (l *loginLimiter) throttled(w http.ResponseWriter, ip string) bool {
+	wait := l.wait(ip)
+	if wait <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	writeError(w, http.StatusTooManyRequests, "too many failed attempts, try again later")
+	return true
+}
+
+// connRecord is one user connection as the dashboard's connection log shows it.
+type connRecord struct {
+	Time     time.Time `json:"time"`
+	Port     int       `json:"port"`
+	ClientIP string    `json:"client_ip"`
+	Client   string    `json:"client,omitempty"` // Name of the member that served the user
+	Duration int64     `json:"duration_ms"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// connLog keeps the last connLogSize user connections, oldest first.
+var connLog = struct {
+	sync.Mutex
+	records []connRecord
+}{}
+
+// logConnection adds a finished or failed user connection to connLog.
+func logConnection(rec connRecord) {
+	connLog.Lock()
+	defer connLog.Unlock()
+	if len(connLog.records) >= connLogSize {
+		connLog.records = append(connLog.records[:0], connLog.records[1:]...)
+	}
+	connLog.records = append(connLog.records, rec)
+}
+
+// recentConnections returns connLog newest first.
+func recentConnections() []connRecord {
+	connLog.Lock()
+	defer connLog.Unlock()
+	list := make([]connRecord, len(connLog.records))
+	for i, rec := range connLog.records {
+		list[len(list)-1-i] = rec
+	}
+	return list
+}
+
+// handleLogin checks the dashboard credentials and sets the session cookie.
+func handleLogin(auth adminAuth, sessions *sessionStore, limiter *loginLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := requestIP(r)
+		if limiter.throttled(w, ip) {
+			return
+		}
+		var creds struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&creds); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request")
+			return
+		}
+		userOK := subtle.ConstantTimeCompare([]byte(creds.Username), []byte(auth.Username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(creds.Password), []byte(auth.Password)) == 1
+		if auth.Username == "" || !userOK || !passOK {
+			log.Warnf("server", "server.admin_login_failed", ip)
+			serverMetrics.authFailures.With("admin").Inc()
+			limiter.fail(ip)
+			writeError(w, http.StatusUnauthorized, "invalid username or password")
+			return
+		}
+		limiter.succeed(ip)
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    sessions.create(),
+			Path:     "/",
+			MaxAge:   int(sessions.ttl / time.Second),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+		log.Infof("server", "server.admin_login", ip)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+// handleLogout ends the caller's dashboard session.
+func handleLogout(sessions *sessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			sessions.remove(c.Value)
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+// requireAdmin lets a request through with the bearer token or a dashboard session. Requests that
+// change something on a session must also send X-Requested-With, which another site's form cannot.
+// Wrong tokens count against the caller's address in limiter, like failed logins.
+func requireAdmin(auth adminAuth, sessions *sessionStore, limiter *loginLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+			if limiter.throttled(w, requestIP(r)) {
+				return
+			}
+			if auth.Token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(auth.Token)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		} else if c, err := r.Cookie(sessionCookie); err == nil && sessions.valid(c.Value) {
+			if r.Method == http.MethodGet || r.Header.Get("X-Requested-With") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			writeError(w, http.StatusForbidden, "missing X-Requested-With header")
+			return
+		}
+		if r.Header.Get("Authorization") != "" {
+			// A missing or expired session only means the dashboard has to log in
+			log.Warnf("server", "server.admin_auth_failed", requestIP(r))
+			serverMetrics.authFailures.With("admin").Inc()
+			limiter.fail(requestIP(r))
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gotunnel"`)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+	})
+}
+
+// requestIP is the caller's address without the port.
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// dashboardFiles serves the embedded dashboard.
+func dashboardFiles() http.Handler {
+	sub, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(sub))
+}
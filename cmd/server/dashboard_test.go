@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboard_ServesEmbeddedPage(t *testing.T) {
+	rec := adminRequest(t, newAdminHandler(adminAuth{Token: "secret"}), http.MethodGet, "/", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "app.js") {
+		t.Fatalf("expected the dashboard page without login, got %d", rec.Code)
+	}
+}
+
+func TestDashboard_LoginSession(t *testing.T) {
+	h := newAdminHandler(adminAuth{Username: "admin", Password: "pw"})
+	login := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := login(`{"username":"admin","password":"wrong"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected wrong password to be rejected, got %d", rec.Code)
+	}
+	rec := login(`{"username":"admin","password":"pw"}`)
+	cookies := rec.Result().Cookies()
+	if rec.Code != http.StatusOK || len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("expected an HttpOnly session cookie, got %d %v", rec.Code, cookies)
+	}
+
+	call := func(method, path string, csrf bool) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.AddCookie(cookies[0])
+		if csrf {
+			req.Header.Set("X-Requested-With", "gotunnel")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := call(http.MethodGet, "/api/connections", false); code != http.StatusOK {
+		t.Errorf("expected the session to read the API, got %d", code)
+	}
+	// 携带会话的修改请求必须带 X-Requested-With，防止跨站提交
+	if code := call(http.MethodPost, "/api/mappings/1/disable", false); code != http.StatusForbidden {
+		t.Errorf("expected 403 without X-Requested-With, got %d", code)
+	}
+	if code := call(http.MethodPost, "/api/mappings/1/disable", true); code != http.StatusNotFound {
+		t.Errorf("expected the request through to the API, got %d", code)
+	}
+	if code := call(http.MethodPost, "/logout", false); code != http.StatusOK {
+		t.Fatalf("logout failed: %d", code)
+	}
+	if code := call(http.MethodGet, "/api/connections", false); code != http.StatusUnauthorized {
+		t.Errorf("expected the session to end on logout, got %d", code)
+	}
+}
+
+func TestDashboard_LoginThrottled(t *testing.T) {
+	h := newAdminHandler(adminAuth{Token: "secret", Username: "admin", Password: "pw"})
+	login := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"admin","password":"`+password+`"}`))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < loginFreeAttempts; i++ {
+		if rec := login("wrong"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i+1, rec.Code)
+		}
+	}
+	// 连续失败超过上限后，同一地址即使密码正确也要等待，令牌同样受限
+	if rec := login("pw"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After, got %d", rec.Code)
+	}
+	if rec := adminRequest(t, h, http.MethodGet, "/api/clients", "secret"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the token throttled for the same address, got %d", rec.Code)
+	}
+}
+
+func TestLoginLimiter_Backoff(t *testing.T) {
+	l := newLoginLimiter()
+	for i := 0; i < loginFreeAttempts-1; i++ {
+		l.fail("192.0.2.1")
+	}
+	if l.wait("192.0.2.1") != 0 {
+		t.Fatal("expected no wait within the free attempts")
+	}
+	l.fail("192.0.2.1")
+	first := l.wait("192.0.2.1")
+	l.fail("192.0.2.1")
+	if first <= 0 || first > loginBaseDelay || l.wait("192.0.2.1") <= loginBaseDelay {
+		t.Errorf("expected the wait to double, got %v then %v", first, l.wait("192.0.2.1"))
+	}
+	if l.wait("192.0.2.2") != 0 {
+		t.Error("other addresses must not wait")
+	}
+	l.succeed("192.0.2.1")
+	if l.wait("192.0.2.1") != 0 {
+		t.Error("expected a success to clear the address")
+	}
+}
+
+func TestSessionStore_Expires(t *testing.T) {
+	s := newSessionStore(10 * time.Millisecond)
+	id := s.create()
+	if !s.valid(id) {
+		t.Fatal("new session should be valid")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if s.valid(id) {
+		t.Error("expected the session to expire")
+	}
+}
+
+func TestConnLog_KeepsRecent(t *testing.T) {
+	connLog.Lock()
+	connLog.records = nil
+	connLog.Unlock()
+	for i := 0; i < connLogSize+5; i++ {
+		logConnection(connRecord{Port: i})
+	}
+	// 只保留最近的记录，最新的在前
+	got := recentConnections()
+	if len(got) != connLogSize || got[0].Port != connLogSize+4 || got[len(got)-1].Port != 5 {
+		t.Errorf("unexpected log: %d records, first %d last %d", len(got), got[0].Port, got[len(got)-1].Port)
+	}
+}
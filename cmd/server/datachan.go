@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync"
+)
+
+// pendingDataChannel is a user waiting for the client to open its data channel.
+type pendingDataChannel struct {
+	port int
+	ch   chan net.Conn
+}
+
+// pendingDataChannels maps the conn_id sent in open_data_channel to the user waiting for it, so a
+// data channel always reaches the user it was opened for even when several clients serve a port.
+var (
+	pendingDataChannels   = make(map[string]*pendingDataChannel)
+	pendingDataChannelsMu sync.Mutex
+)
+
+// expectDataChannel registers a user waiting for a data channel on port. The returned cancel must be
+// called once the user stops waiting; it closes a data channel that arrives too late.
+func expectDataChannel(port int) (connID string, dataChan <-chan net.Conn, cancel func()) {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	connID = hex.EncodeToString(b)
+	p := &pendingDataChannel{port: port, ch: make(chan net.Conn, 1)}
+	pendingDataChannelsMu.Lock()
+	pendingDataChannels[connID] = p
+	pendingDataChannelsMu.Unlock()
+	return connID, p.ch, func() {
+		pendingDataChannelsMu.Lock()
+		delete(pendingDataChannels, connID)
+		pendingDataChannelsMu.Unlock()
+		select {
+		case late := <-p.ch:
+			_ = late.Close()
+		default:
+		}
+	}
+}
+
+// deliverDataChannel hands a client's data connection to the user identified by connID. Clients that
+// do not echo a conn_id get any user waiting on port. It reports whether a waiting user was found.
+func deliverDataChannel(connID string, port int, conn net.Conn) bool {
+	pendingDataChannelsMu.Lock()
+	defer pendingDataChannelsMu.Unlock()
+	p, ok := pendingDataChannels[connID]
+	if !ok && connID == "" {
+		for id, candidate := range pendingDataChannels {
+			if candidate.port == port {
+				connID, p, ok = id, candidate, true
+				break
+			}
+		}
+	}
+	if !ok || p.port != port {
+		return false
+	}
+	delete(pendingDataChannels, connID)
+	p.ch <- conn
+	return true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"gotunnel/pkg/log"
+	"gotunnel/pkg/protocol"
+	"hash/fnv"
+	"net"
+)
+
+// Load balancing policies for tunnel groups, chosen by the group's first member.
+const (
+	policyRoundRobin = "round_robin" // Members take turns
+	policyLeastConn  = "least_conn"  // Member with the fewest users
+	policySourceHash = "source_hash" // Same user IP keeps hitting the same member
+)
+
+// groupPolicy validates a requested policy, defaulting to round robin.
+func groupPolicy(requested string) (string, error) {
+	switch requested {
+	case "":
+		return policyRoundRobin, nil
+	case policyRoundRobin, policyLeastConn, policySourceHash:
+		return requested, nil
+	}
+	return "", fmt.Errorf("unknown load balancing policy %q", requested)
+}
+
+// joinGroup adds mem to the group mapping m on port after checking the group key.
+// Callers must hold mappingTableMu.
+func joinGroup(port int, m *Mapping, reg protocol.RegisterRequest, mem *Member) error {
+	if subtle.ConstantTimeCompare([]byte(m.GroupKey), []byte(reg.GroupKey)) != 1 {
+		log.Warn("server", "server.group_key_mismatch", map[string]interface{}{"Group": m.Group, "Name": reg.Name})
+		return fmt.Errorf("group key mismatch for group %s", m.Group)
+	}
+	if reg.LBPolicy != "" && reg.LBPolicy != m.Policy {
+		log.Warn("server", "server.group_policy_ignored", map[string]interface{}{
+			"Group": m.Group, "Name": reg.Name, "Policy": m.Policy,
+		})
+	}
+	m.Members = append(m.Members, mem)
+	log.Info("server", "server.group_member_joined", map[string]interface{}{
+		"Group": m.Group, "Port": port, "Name": mem.Name, "Members": len(m.Members),
+	})
+	m.notify()
+	return nil
+}
+
+// pickMember chooses the member that serves a user from clientIP according to the mapping's
+// policy, skipping members that are detached or whose local service is down. Backup members are
+// only used while no primary is available. It returns nil when no member can take the user right
+// now. Callers must hold mappingTableMu.
+func pickMember(m *Mapping, clientIP string) *Member {
+	available, _ := availableMembers(m)
+	if len(available) == 0 {
+		return nil
+	}
+	switch m.Policy {
+	case policyLeastConn:
+		best := available[0]
+		for _, mem := range available[1:] {
+			if mem.Active < best.Active {
+				best = mem
+			}
+		}
+		return best
+	case policySourceHash:
+		// Rendezvous hashing: only the users of a member that leaves move elsewhere
+		var best *Member
+		var bestScore uint64
+		for _, mem := range available {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(clientIP))
+			_, _ = h.Write([]byte{0})
+			_, _ = h.Write([]byte(mem.id()))
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = mem, score
+			}
+		}
+		return best
+	default:
+		m.rr++
+		return available[m.rr%len(available)]
+	}
+}
+
+// id identifies a member stably across reconnects where possible, for source hashing.
+func (mem *Member) id() string {
+	if mem.SessionID != "" {
+		return mem.SessionID
+	}
+	if mem.ClientConn != nil && mem.ClientConn.RemoteAddr() != nil {
+		return mem.ClientConn.RemoteAddr().String()
+	}
+	return fmt.Sprintf("%s/%d", mem.Name, mem.LocalPort)
+}
+
+// remoteIP returns the IP part of a connection's remote address.
+func remoteIP(conn net.Conn) string {
+	if conn.RemoteAddr() == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
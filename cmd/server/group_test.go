@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"gotunnel/pkg/protocol"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// openControl 建立一个保持打开的控制通道并完成注册，返回注册响应和关闭函数
+func openControl(t *testing.T, req protocol.RegisterRequest) (protocol.RegisterResponse, func()) {
+	t.Helper()
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleControlConn(&mockConn{Reader: inR, Writer: outW}, "test-token")
+		close(done)
+	}()
+	b, _ := json.Marshal(req)
+	go protocol.WritePacket(inW, b)
+	respBytes, err := protocol.ReadPacket(outR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp protocol.RegisterResponse
+	_ = json.Unmarshal(respBytes, &resp)
+	// 持续读取服务端下发的消息，避免写阻塞
+	go io.Copy(io.Discard, outR)
+	return resp, func() {
+		inW.Close()
+		<-done
+		outR.Close()
+	}
+}
+
+func TestGroupPolicy(t *testing.T) {
+	for _, ok := range []string{"", policyRoundRobin, policyLeastConn, policySourceHash} {
+		if _, err := groupPolicy(ok); err != nil {
+			t.Errorf("%q should be accepted: %v", ok, err)
+		}
+	}
+	if p, _ := groupPolicy(""); p != policyRoundRobin {
+		t.Errorf("expected round_robin by default, got %s", p)
+	}
+	if _, err := groupPolicy("random"); err == nil {
+		t.Error("expected unknown policy to be rejected")
+	}
+}
+
+func TestPickMember_RoundRobin(t *testing.T) {
+	a, b := &Member{Name: "a"}, &Member{Name: "b"}
+	m := &Mapping{Policy: policyRoundRobin, Members: []*Member{a, {Name: "down", Offline: true}, b, {Name: "gone", Detached: true}}}
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[pickMember(m, "").Name]++
+	}
+	// 下线和断开的成员不参与轮询
+	if seen["a"] != 2 || seen["b"] != 2 {
+		t.Errorf("expected even rotation over available members, got %v", seen)
+	}
+	if pickMember(&Mapping{Members: []*Member{{Offline: true}}}, "") != nil {
+		t.Error("expected no member when all are offline")
+	}
+}
+
+func TestPickMember_LeastConn(t *testing.T) {
+	busy, idle := &Member{Name: "busy", Active: 3}, &Member{Name: "idle", Active: 1}
+	m := &Mapping{Policy: policyLeastConn, Members: []*Member{busy, idle}}
+	if got := pickMember(m, ""); got != idle {
+		t.Errorf("expected least loaded member, got %s", got.Name)
+	}
+}
+
+func TestPickMember_SourceHash(t *testing.T) {
+	members := []*Member{{SessionID: "a"}, {SessionID: "b"}, {SessionID: "c"}}
+	m := &Mapping{Policy: policySourceHash, Members: members}
+	ips := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5", "192.0.2.6"}
+	before := map[string]*Member{}
+	for _, ip := range ips {
+		before[ip] = pickMember(m, ip)
+		if pickMember(m, ip) != before[ip] {
+			t.Fatalf("same source %s should map to the same member", ip)
+		}
+	}
+	// 移除一个成员后，只有原本落在该成员上的用户会迁移
+	m.Members = members[:2]
+	for _, ip := range ips {
+		if before[ip] != members[2] && pickMember(m, ip) != before[ip] {
+			t.Errorf("user %s moved although its member stayed", ip)
+		}
+	}
+}
+
+func TestHandleControlConn_GroupJoin(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+
+	req := protocol.RegisterRequest{Type: "register", LocalPort: 80, Token: "test-token", Group: "web", GroupKey: "k", LBPolicy: policyLeastConn}
+	first, closeFirst := openControl(t, req)
+	req.LocalPort = 8080
+	second, closeSecond := openControl(t, req)
+	if first.Status != "ok" || second.Status != "ok" || first.RemotePort != second.RemotePort {
+		t.Fatalf("both clients should share one port, got %+v and %+v", first, second)
+	}
+	port := first.RemotePort
+
+	// 组密钥错误、或普通注册占用组端口，都应被拒绝
+	req.GroupKey = "wrong"
+	bad, closeBad := openControl(t, req)
+	closeBad()
+	if bad.Status != "fail" {
+		t.Errorf("expected wrong group key to be rejected, got %+v", bad)
+	}
+	plain, closePlain := openControl(t, protocol.RegisterRequest{Type: "register", LocalPort: 22, RemotePort: port, Token: "test-token"})
+	closePlain()
+	if plain.Status != "fail" {
+		t.Errorf("expected plain registration on a group port to be rejected, got %+v", plain)
+	}
+
+	mappingTableMu.Lock()
+	m := mappingTable[port]
+	members, policy := len(m.Members), m.Policy
+	mappingTableMu.Unlock()
+	if members != 2 || policy != policyLeastConn {
+		t.Fatalf("expected 2 members with least_conn, got %d %s", members, policy)
+	}
+
+	// 一个成员离开后映射保留，最后一个离开后释放端口
+	closeFirst()
+	mappingTableMu.Lock()
+	members = len(m.Members)
+	_, exists := mappingTable[port]
+	mappingTableMu.Unlock()
+	if !exists || members != 1 {
+		t.Errorf("expected mapping to stay with 1 member, got exists=%v members=%d", exists, members)
+	}
+	closeSecond()
+	mappingTableMu.Lock()
+	_, exists = mappingTable[port]
+	mappingTableMu.Unlock()
+	if exists {
+		t.Error("expected mapping to be released with its last member")
+	}
+}
+
+func TestHandleControlConn_RejectedRegistrationKeepsPort(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+
+	first, closeFirst := openControl(t, protocol.RegisterRequest{Type: "register", LocalPort: 22, Token: "test-token", Name: "ssh"})
+	defer closeFirst()
+	mappingTableMu.Lock()
+	m := mappingTable[first.RemotePort]
+	mappingTableMu.Unlock()
+
+	// 参数非法的注册被拒绝前不能踢掉已在服务的隧道
+	for _, bad := range []protocol.RegisterRequest{
+		{Type: "register", Name: "other", LocalPort: 23, RemotePort: first.RemotePort, Token: "test-token", LBPolicy: "random"},
+		{Type: "register", Name: "other", LocalPort: 23, RemotePort: first.RemotePort, Token: "test-token", Protocol: "udp"},
+	} {
+		resp, closeBad := openControl(t, bad)
+		closeBad()
+		if resp.Status != "fail" {
+			t.Errorf("expected %+v to be rejected, got %+v", bad, resp)
+		}
+	}
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	if mappingTable[first.RemotePort] != m || len(m.Members) != 1 {
+		t.Error("expected the working tunnel to keep its port")
+	}
+}
+
+func TestHandleControlConn_OfflineMemberKeepsGroupListening(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+
+	req := protocol.RegisterRequest{Type: "register", LocalPort: 80, Token: "test-token", Group: "api", GroupKey: "k"}
+	resp, closeFirst := openControl(t, req)
+	defer closeFirst()
+	_, closeSecond := openControl(t, req)
+	defer closeSecond()
+
+	mappingTableMu.Lock()
+	m := mappingTable[resp.RemotePort]
+	m.Members[0].Offline = true
+	refreshListener(resp.RemotePort, m)
+	listening := isListening(m)
+	m.Members[1].Offline = true
+	refreshListener(resp.RemotePort, m)
+	stopped := !isListening(m)
+	m.Members[1].Offline = false
+	refreshListener(resp.RemotePort, m)
+	restarted := isListening(m)
+	mappingTableMu.Unlock()
+	if !listening || !stopped || !restarted {
+		t.Errorf("listener should follow member health: listening=%v stopped=%v restarted=%v", listening, stopped, restarted)
+	}
+}
+
+func TestForwardUser_DataChannelCorrelation(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	ctrlR, ctrlW := io.Pipe()
+	defer ctrlR.Close()
+	mem := &Member{ClientConn: &mockConn{Writer: ctrlW}, Name: "only", LocalPort: 3000}
+	mappingTable[9000] = &Mapping{Policy: policyRoundRobin, Members: []*Member{mem}}
+	mappingTableMu.Unlock()
+
+	user, userPeer := net.Pipe()
+	defer user.Close()
+	go forwardUser(9000, userPeer)
+
+	// 客户端收到带conn_id的open_data_channel，用同一conn_id建立数据通道
+	packet, err := protocol.ReadPacket(ctrlR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var open protocol.RegisterRequest
+	_ = json.Unmarshal(packet, &open)
+	if open.Type != "open_data_channel" || open.ConnID == "" || open.LocalPort != 3000 {
+		t.Fatalf("unexpected open_data_channel %+v", open)
+	}
+	data, dataPeer := net.Pipe()
+	defer data.Close()
+	if deliverDataChannel(open.ConnID, 9001, dataPeer) {
+		t.Error("data channel for another port must not be accepted")
+	}
+	if !deliverDataChannel(open.ConnID, 9000, dataPeer) {
+		t.Fatal("expected data channel to reach the waiting user")
+	}
+
+	go user.Write([]byte("hi"))
+	buf := make([]byte, 2)
+	data.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(data, buf); err != nil || string(buf) != "hi" {
+		t.Errorf("expected user bytes relayed over the data channel, got %q err=%v", buf, err)
+	}
+}
+
+func TestDeliverDataChannel_Fallback(t *testing.T) {
+	// 旧客户端不回传conn_id时，交给同端口上任一等待的用户
+	_, ch, cancel := expectDataChannel(9100)
+	defer cancel()
+	conn := &mockConn{}
+	if !deliverDataChannel("", 9100, conn) {
+		t.Fatal("expected fallback delivery by port")
+	}
+	if got := <-ch; got != conn {
+		t.Error("wrong connection delivered")
+	}
+	if deliverDataChannel("", 9100, conn) {
+		t.Error("no user should be left waiting")
+	}
+
+	// 用户放弃等待后迟到的数据通道会被关闭
+	id, _, cancel2 := expectDataChannel(9100)
+	late := &mockConn{}
+	deliverDataChannel(id, 9100, late)
+	cancel2()
+	if !late.closed {
+		t.Error("late data channel should be closed")
+	}
+}
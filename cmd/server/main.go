@@ -3,13 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"gotunnel/pkg/cluster"
 	"gotunnel/pkg/core"
+	"gotunnel/pkg/health"
 	"gotunnel/pkg/log"
 	"gotunnel/pkg/protocol"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -17,19 +22,86 @@ import (
 	"github.com/spf13/viper"
 )
 
-// Mapping represents a port mapping between a remote port and a local port.
+// Mapping is a public port and the clients serving it. A plain registration has a single member;
+// a tunnel group spreads users across every member that joined with the same group name and key.
 type Mapping struct {
+	BindAddr   string        // Address the public listener binds to, "" for all interfaces
+	ListenDone chan struct{} // Channel to stop listening
+	Members    []*Member     // Clients serving this port
+
+	Group    string        // Tunnel group name, "" for a single-client mapping
+	GroupKey string        // Key a client must present to join the group
+	Policy   string        // How users are spread across members, see pickMember
+	rr       int           // Round-robin cursor
+	changed  chan struct{} // Closed when a member becomes available or the mapping goes away, wakes queued users
+
+	failedOver bool // Users are currently sent to backup members because no primary is available
+
+	// While every member is down a KeepOpen mapping keeps its listener: HTTP users get a 503 with
+	// the maintenance page, TCP users wait up to HoldTimeout for the tunnel to come back
+	Protocol        string        // "tcp" or "http"
+	KeepOpen        bool          // Keep the public port open while the tunnel is offline
+	HoldTimeout     time.Duration // TCP: how long users wait for the tunnel while offline
+	MaintenancePage string        // HTTP: page served while offline, "" for the server's page
+
+	Traffic traffic // Bytes relayed for the port's users
+}
+
+// Member is one client control channel serving a mapping.
+type Member struct {
 	ClientConn    net.Conn
+	Name          string
 	LocalPort     int
-	LastHeartbeat time.Time     // Last heartbeat time received
-	DataChan      chan net.Conn // Channel for pending data channel connections
-	ListenDone    chan struct{} // Channel to stop listening
+	LastHeartbeat time.Time         // Last heartbeat time received
+	RTT           protocol.RTTStats // Round-trip statistics last reported by the client
+	Offline       bool              // Local service reported down via offline_port, no users are sent here
+	Active        int               // Users currently assigned, used by least_conn
+	BackupFor     string            // Name of the primary tunnel this member stands by for, "" for a primary
+
+	Health   *protocol.HealthReport // Last health_report from the client, nil if it never sent one
+	HealthAt time.Time              // When Health was received
+
+	Unhealthy  bool            // The end-to-end check through the tunnel fails, no users are sent here
+	CheckError string          // Error of the last failed tunnel check, "" after a success
+	LastCheck  time.Time       // When the tunnel was last checked
+	checks     *health.Tracker // Rise/fall state of the tunnel check
+
+	ID          string    // Identifies the member in the admin API
+	ConnectedAt time.Time // When the current control connection registered
+	Traffic     traffic   // Bytes relayed for this member's users
+
+	SessionID  string      // Client session, lets a reconnecting client resume this membership
+	Detached   bool        // Control channel lost, kept until the session grace expires
+	graceTimer *time.Timer // Expires a detached session
 }
 
 var mappingTable = make(map[int]*Mapping)
 var mappingTableMu sync.Mutex
 
-var heartbeatTimeout = 30 // seconds
+// heartbeatTimeout is how long a control channel may stay silent before the client is dropped.
+// It is advertised to clients so they can pick a heartbeat interval that fits.
+var heartbeatTimeout = 30 * time.Second
+
+// heartbeatCheckInterval is how often checkClientHeartbeat scans the mapping table.
+var heartbeatCheckInterval = 5 * time.Second
+
+// sessionGrace is how long a mapping with a session outlives its control channel, waiting for the client to resume it.
+var sessionGrace = 30 * time.Second
+
+// drainTimeout bounds how long shutdown waits for in-flight relays before cutting them.
+var drainTimeout = 30 * time.Second
+
+// goAwayTimeout bounds the goaway write to one client, so a stuck client cannot hold up shutdown.
+var goAwayTimeout = 5 * time.Second
+
+// relayTracker tracks every user from accept until its relay ends, so shutdown can drain them.
+var relayTracker core.Tracker
+
+// remotePortPool is the range server-assigned remote ports are taken from; the zero value lets the OS pick.
+var remotePortPool protocol.PortRange
+
+// publicHost is the host advertised to clients in RegisterResponse.PublicAddr.
+var publicHost string
 
 // ServerConfig holds the server configuration parameters.
 type ServerConfig struct {
@@ -37,6 +109,39 @@ type ServerConfig struct {
 	Token      string
 	LogLevel   string
 	LogLang    string
+	PortRange  string // Pool for remote_port: 0 registrations, e.g. "20000-30000"
+	PublicHost string // Host or IP users reach the server on, defaults to the control connection's local address
+
+	DefaultBindAddr  string   // Bind address for public listeners when the client does not request one
+	AllowedBindAddrs []string // IPs, CIDRs or interface names clients may bind public listeners to
+
+	DrainTimeout time.Duration // Time in-flight relays get to finish on shutdown
+	SessionGrace time.Duration // Time a disconnected client has to resume its session
+
+	HeartbeatTimeout       time.Duration // Silence after which a client is considered dead
+	HeartbeatCheckInterval time.Duration // How often heartbeats are checked
+	hbCheckTooLong         time.Duration // Configured check interval that had to be shortened, 0 if none
+
+	ClusterStore     string        // Shared state backend: "" runs alone, "memory" or "file"
+	ClusterStorePath string        // Directory of the file store
+	NodeID           string        // This node's ID, defaults to the host name
+	AdvertiseAddr    string        // Control address other nodes reach this one on
+	ClusterLease     time.Duration // How long a port claim lives without renewal
+	ClusterSecret    string        // Token nodes present to each other when forwarding users
+
+	TunnelCheck         health.CheckSpec    // End-to-end check run through each tunnel
+	TunnelCheckProbe    health.ProbeOptions // Timeout and rise/fall thresholds of the tunnel check
+	TunnelCheckInterval time.Duration       // Time between tunnel checks, 0 disables them
+
+	MaintenancePage string // File served to users of offline HTTP tunnels that keep their port open
+
+	AdminAddr       string        // Listen address of the admin HTTP API and dashboard, "" disables it
+	AdminToken      string        // Bearer token for API clients
+	AdminUsername   string        // Dashboard login
+	AdminPassword   string        // Dashboard password
+	AdminSessionTTL time.Duration // How long a dashboard login lasts
+
+	MetricsAddr string // Listen address of the Prometheus /metrics endpoint, "" disables it
 }
 
 func loadServerConfig() *ServerConfig {
@@ -62,11 +167,114 @@ func loadServerConfig() *ServerConfig {
 		logLang = "zh"
 	}
 
+	drain := 30 * time.Second // Default 30 seconds
+	if viper.IsSet("server.drain_timeout") {
+		if seconds := viper.GetInt("server.drain_timeout"); seconds >= 0 {
+			drain = time.Duration(seconds) * time.Second
+		}
+	}
+
+	grace := 30 * time.Second // Default 30 seconds
+	if viper.IsSet("server.session_grace") {
+		if seconds := viper.GetInt("server.session_grace"); seconds >= 0 {
+			grace = time.Duration(seconds) * time.Second
+		}
+	}
+
+	hbTimeout := 30 * time.Second // Default 30 seconds
+	if seconds := viper.GetInt("server.heartbeat_timeout"); seconds > 0 {
+		hbTimeout = time.Duration(seconds) * time.Second
+	}
+	hbCheck := 5 * time.Second // Default 5 seconds
+	if seconds := viper.GetInt("server.heartbeat_check_interval"); seconds > 0 {
+		hbCheck = time.Duration(seconds) * time.Second
+	}
+	var hbCheckTooLong time.Duration
+	if hbCheck >= hbTimeout {
+		// A check slower than the timeout would let dead clients linger for up to twice as long.
+		// The logger is not set up yet, main reports the adjustment.
+		hbCheckTooLong = hbCheck
+		hbCheck = hbTimeout / 2
+	}
+
+	nodeName := viper.GetString("server.cluster.node_id")
+	if nodeName == "" {
+		nodeName, _ = os.Hostname()
+	}
+	advertise := viper.GetString("server.cluster.advertise_addr")
+	if host, port, err := net.SplitHostPort(addr); advertise == "" && err == nil {
+		if host == "" {
+			host = nodeName
+		}
+		advertise = net.JoinHostPort(host, port)
+	}
+	lease := 30 * time.Second // Default 30 seconds
+	if seconds := viper.GetInt("server.cluster.lease"); seconds > 0 {
+		lease = time.Duration(seconds) * time.Second
+	}
+
+	checkInterval := time.Duration(viper.GetInt("server.tunnel_check.interval")) * time.Second
+	checkProbe := health.ProbeOptions{
+		Timeout: 5 * time.Second, // Default 5 seconds, opening a data channel takes a round trip
+		Rise:    viper.GetInt("server.tunnel_check.rise"),
+		Fall:    viper.GetInt("server.tunnel_check.fall"),
+	}
+	if seconds := viper.GetFloat64("server.tunnel_check.timeout"); seconds > 0 {
+		checkProbe.Timeout = time.Duration(seconds * float64(time.Second))
+	}
+
+	sessionTTL := defaultSessionTTL
+	if seconds := viper.GetInt("server.admin.session_ttl"); seconds > 0 {
+		sessionTTL = time.Duration(seconds) * time.Second
+	}
+
 	return &ServerConfig{
 		ListenAddr: addr,
 		Token:      token,
 		LogLevel:   logLevel,
 		LogLang:    logLang,
+		PortRange:  viper.GetString("server.port_range"),
+		PublicHost: viper.GetString("server.public_host"),
+
+		DefaultBindAddr:  viper.GetString("server.default_bind_addr"),
+		AllowedBindAddrs: viper.GetStringSlice("server.allowed_bind_addrs"),
+
+		DrainTimeout: drain,
+		SessionGrace: grace,
+
+		HeartbeatTimeout:       hbTimeout,
+		HeartbeatCheckInterval: hbCheck,
+		hbCheckTooLong:         hbCheckTooLong,
+
+		ClusterStore:     viper.GetString("server.cluster.store"),
+		ClusterStorePath: viper.GetString("server.cluster.store_path"),
+		NodeID:           nodeName,
+		AdvertiseAddr:    advertise,
+		ClusterLease:     lease,
+		ClusterSecret:    viper.GetString("server.cluster.secret"),
+
+		TunnelCheck: health.CheckSpec{
+			Type:               viper.GetString("server.tunnel_check.type"),
+			Path:               viper.GetString("server.tunnel_check.path"),
+			Host:               viper.GetString("server.tunnel_check.host"),
+			ExpectStatus:       viper.GetInt("server.tunnel_check.expect_status"),
+			ExpectBody:         viper.GetString("server.tunnel_check.expect_body"),
+			ServerName:         viper.GetString("server.tunnel_check.server_name"),
+			InsecureSkipVerify: viper.GetBool("server.tunnel_check.insecure_skip_verify"),
+			MinCertValidity:    time.Duration(viper.GetInt("server.tunnel_check.min_cert_days")) * 24 * time.Hour,
+		},
+		TunnelCheckProbe:    checkProbe.WithDefaults(),
+		TunnelCheckInterval: checkInterval,
+
+		MaintenancePage: viper.GetString("server.maintenance_page"),
+
+		AdminAddr:       viper.GetString("server.admin.addr"),
+		AdminToken:      viper.GetString("server.admin.token"),
+		AdminUsername:   viper.GetString("server.admin.username"),
+		AdminPassword:   viper.GetString("server.admin.password"),
+		AdminSessionTTL: sessionTTL,
+
+		MetricsAddr: viper.GetString("server.metrics_addr"),
 	}
 }
 
@@ -75,6 +283,50 @@ func main() {
 
 	// Initialize logger
 	log.Init(log.ParseLevel(conf.LogLevel), log.ParseLanguage(conf.LogLang))
+	if conf.hbCheckTooLong > 0 {
+		log.Warn("server", "server.heartbeat_check_interval_too_long", map[string]interface{}{
+			"Interval": conf.hbCheckTooLong, "Timeout": conf.HeartbeatTimeout,
+		})
+	}
+
+	pool, err := protocol.ParsePortRange(conf.PortRange)
+	if err != nil {
+		log.Errorf("server", "server.invalid_port_range", err)
+		os.Exit(1)
+	}
+	if err := validateTunnelCheck(conf.TunnelCheck); err != nil {
+		log.Errorf("server", "server.invalid_tunnel_check", err)
+		os.Exit(1)
+	}
+	page, err := readMaintenancePage(conf.MaintenancePage)
+	if err != nil {
+		log.Errorf("server", "server.invalid_maintenance_page", err)
+		os.Exit(1)
+	}
+	setRuntimeConfig(conf, pool, page)
+	heartbeatCheckInterval = conf.HeartbeatCheckInterval
+	tunnelCheckInterval = conf.TunnelCheckInterval
+	if conf.AdminAddr != "" && conf.AdminToken == "" && (conf.AdminUsername == "" || conf.AdminPassword == "") {
+		log.Error("server", "server.admin_auth_missing", nil)
+		os.Exit(1)
+	}
+	if conf.ClusterStore != "" {
+		if conf.ClusterSecret == "" || conf.ClusterSecret == conf.Token {
+			log.Error("server", "server.cluster_secret_missing", nil)
+			os.Exit(1)
+		}
+		store, err := cluster.Open(conf.ClusterStore, conf.ClusterStorePath)
+		if err != nil {
+			log.Errorf("server", "server.cluster_store_failed", err)
+			os.Exit(1)
+		}
+		clusterStore = store
+		nodeID = conf.NodeID
+		nodePeerAddr = conf.AdvertiseAddr
+		clusterToken = conf.ClusterSecret
+		clusterLease = conf.ClusterLease
+		log.Info("server", "server.cluster_joined", map[string]interface{}{"Name": nodeID, "Addr": nodePeerAddr})
+	}
 
 	ln, err := net.Listen("tcp", conf.ListenAddr)
 	if err != nil {
@@ -94,7 +346,7 @@ func main() {
 	heartbeatDone := make(chan struct{})
 	go func() {
 		defer close(heartbeatDone)
-		ticker := time.NewTicker(5 * time.Second)
+		ticker := time.NewTicker(heartbeatCheckInterval)
 		defer ticker.Stop()
 		for {
 			select {
@@ -106,28 +358,88 @@ func main() {
 		}
 	}()
 
-	// Accept connections in a goroutine
-	acceptDone := make(chan struct{})
+	// Renew this node's port claims and follow the ports served by other nodes
+	clusterDone := make(chan struct{})
 	go func() {
-		defer close(acceptDone)
+		defer close(clusterDone)
+		if clusterStore == nil {
+			return
+		}
+		ticker := time.NewTicker(clusterLease / 3)
+		defer ticker.Stop()
 		for {
+			syncPeers()
 			select {
 			case <-ctx.Done():
 				return
-			default:
-				conn, err := ln.Accept()
-				if err != nil {
-					// Check if it's due to shutdown
-					select {
-					case <-ctx.Done():
-						return
-					default:
-						log.Errorf("server", "server.accept_error", err)
-						continue
-					}
+			case <-ticker.C:
+				renewClaims()
+			}
+		}
+	}()
+
+	// Check every tunnel end to end, catching broken data paths heartbeats do not see
+	checkDone := make(chan struct{})
+	go func() {
+		defer close(checkDone)
+		if tunnelCheckInterval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(tunnelCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				checkTunnels(ctx)
+			}
+		}
+	}()
+
+	// Prometheus metrics, off unless server.metrics_addr is set
+	var metricsServer *http.Server
+	if conf.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", serverMetrics.registry.Handler())
+		metricsServer = &http.Server{Addr: conf.MetricsAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			log.Infof("server", "server.metrics_listening", conf.MetricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Errorf("server", "server.metrics_failed", err)
+			}
+		}()
+	}
+
+	// Admin API, off unless server.admin.addr is set
+	var admin *http.Server
+	if conf.AdminAddr != "" {
+		admin = &http.Server{Addr: conf.AdminAddr, Handler: newAdminHandler(adminAuth{
+			Token: conf.AdminToken, Username: conf.AdminUsername, Password: conf.AdminPassword, SessionTTL: conf.AdminSessionTTL,
+		}), ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			log.Infof("server", "server.admin_listening", conf.AdminAddr)
+			if err := admin.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Errorf("server", "server.admin_failed", err)
+			}
+		}()
+	}
+
+	// Accept connections in a goroutine
+	acceptDone := make(chan struct{})
+	go func() {
+		defer close(acceptDone)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				// The listener is closed once shutdown has drained the relays
+				if errors.Is(err, net.ErrClosed) {
+					return
 				}
-				go handleControlConn(conn, conf.Token)
+				log.Errorf("server", "server.accept_error", err)
+				continue
 			}
+			go handleControlConn(conn, conf.Token)
 		}
 	}()
 
@@ -138,41 +450,235 @@ func main() {
 	// Start graceful shutdown
 	log.Info("server", "server.shutdown_started", nil)
 	cancel()
+	<-clusterDone
+	<-checkDone
+	if admin != nil {
+		_ = admin.Close()
+	}
+	if metricsServer != nil {
+		_ = metricsServer.Close()
+	}
 
-	// Close listener to stop accepting new connections
+	// Stop the public listeners first; data channels for users already accepted still arrive on
+	// the control listener, so it is closed only once the relays are drained
+	drainServer(drainTimeout)
 	_ = ln.Close()
-
-	// Wait for accept goroutine to finish
 	<-acceptDone
 
-	// Close all active connections
+	log.Info("server", "server.shutdown_complete", nil)
+}
+
+// readMaintenancePage returns the contents of the server.maintenance_page file, the built-in page if none is set.
+func readMaintenancePage(path string) (string, error) {
+	if path == "" {
+		return defaultMaintenancePage, nil
+	}
+	page, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(page), nil
+}
+
+// setRuntimeConfig installs the settings that may change while the server runs, see reloadConfig.
+// The listen addresses, server.token, the admin credentials, cluster settings and check intervals
+// only take effect on restart.
+func setRuntimeConfig(conf *ServerConfig, pool protocol.PortRange, page string) {
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	remotePortPool = pool
+	publicHost = conf.PublicHost
+	defaultBindAddr = conf.DefaultBindAddr
+	allowedBindAddrs = conf.AllowedBindAddrs
+	drainTimeout = conf.DrainTimeout
+	sessionGrace = conf.SessionGrace
+	heartbeatTimeout = conf.HeartbeatTimeout
+	tunnelCheck = conf.TunnelCheck
+	tunnelCheckProbe = conf.TunnelCheckProbe
+	maintenancePage = page
+}
+
+// reloadConfig reads the config file again and applies what setRuntimeConfig covers.
+// Nothing is changed if the new config is invalid.
+func reloadConfig() error {
+	conf := loadServerConfig()
+	pool, err := protocol.ParsePortRange(conf.PortRange)
+	if err != nil {
+		return err
+	}
+	if err := validateTunnelCheck(conf.TunnelCheck); err != nil {
+		return err
+	}
+	page, err := readMaintenancePage(conf.MaintenancePage)
+	if err != nil {
+		return err
+	}
+	setRuntimeConfig(conf, pool, page)
+	return nil
+}
+
+// stopListening closes the mapping's public listener if it is still open.
+func stopListening(m *Mapping) {
+	if m.ListenDone == nil {
+		return
+	}
+	select {
+	case <-m.ListenDone:
+		// Already closed
+	default:
+		close(m.ListenDone)
+	}
+}
+
+// isListening reports whether the mapping's public listener is running.
+func isListening(m *Mapping) bool {
+	if m.ListenDone == nil {
+		return false
+	}
+	select {
+	case <-m.ListenDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// refreshListener keeps the public listener in line with the members: it is stopped while every
+// member reports its local service down or fails the tunnel check, and started again once one recovers. Detached members
+// count as up, users are queued for them. A KeepOpen mapping keeps listening throughout, a port
+// disabled through the admin API does not listen at all. Callers must hold mappingTableMu.
+func refreshListener(port int, m *Mapping) {
+	open := (membersUp(m) || m.KeepOpen) && !disabledPorts[port] && !draining
+	switch {
+	case open && !isListening(m):
+		m.ListenDone = make(chan struct{})
+		go listenAndForwardWithStop(port, m.BindAddr, m.ListenDone)
+	case !open:
+		stopListening(m)
+	}
+	updateFailover(port, m)
+}
+
+// notify wakes the users queued on m. Callers must hold mappingTableMu.
+func (m *Mapping) notify() {
+	if m.changed != nil {
+		close(m.changed)
+		m.changed = nil
+	}
+}
+
+// memberOf returns the mapping on port and the member using control connection conn, if any.
+// Callers must hold mappingTableMu.
+func memberOf(port int, conn net.Conn) (*Mapping, *Member) {
+	m, exists := mappingTable[port]
+	if !exists {
+		return nil, nil
+	}
+	for _, mem := range m.Members {
+		if mem.ClientConn == conn {
+			return m, mem
+		}
+	}
+	return m, nil
+}
+
+// dropMember removes mem from the mapping on port. The last member to leave takes the public
+// listener and the mapping with it. Callers must hold mappingTableMu.
+func dropMember(port int, m *Mapping, mem *Member) {
+	endSession(mem)
+	for i, candidate := range m.Members {
+		if candidate == mem {
+			m.Members = append(m.Members[:i], m.Members[i+1:]...)
+			break
+		}
+	}
+	if m.Group != "" {
+		log.Info("server", "server.group_member_left", map[string]interface{}{
+			"Group": m.Group, "Port": port, "Name": mem.Name, "Members": len(m.Members),
+		})
+	}
+	if len(m.Members) == 0 {
+		stopListening(m)
+		if mappingTable[port] == m {
+			delete(mappingTable, port)
+			serverMetrics.forgetPort(port)
+			releasePort(port)
+		}
+	} else {
+		refreshListener(port, m)
+	}
+	m.notify()
+}
+
+// evictMapping closes every member of a mapping that a new plain registration takes over. The
+// cluster claim on port is kept: the new registration holds it already, or it was lost to another
+// node. Callers must hold mappingTableMu.
+func evictMapping(port int, m *Mapping) {
+	stopListening(m)
+	for _, mem := range m.Members {
+		endSession(mem)
+		_ = mem.ClientConn.Close()
+	}
+	m.Members = nil
+	delete(mappingTable, port)
+	serverMetrics.forgetPort(port)
+	m.notify()
+}
+
+// draining is set once shutdown starts; from then on new registrations are refused and public
+// listeners stay closed, while the control listener keeps accepting data channels. Guarded by
+// mappingTableMu.
+var draining bool
+
+// drainServer shuts the tunnels down without cutting users off: it stops every public listener,
+// tells each client to go away, waits up to timeout for the users already accepted and only then
+// closes the control connections. The mappings stay in place until then, so users still waiting
+// for a member or a data channel are served; the control listener must stay open as well, their
+// data channels arrive through it.
+func drainServer(timeout time.Duration) {
+	goAway, _ := json.Marshal(protocol.GoAway{Type: "goaway", Reason: "server shutting down"})
 	mappingTableMu.Lock()
+	draining = true
+	ports := make([]int, 0, len(mappingTable))
+	var clients []net.Conn
 	for port, mapping := range mappingTable {
+		ports = append(ports, port)
 		log.Infof("server", "server.closing_mapping", port)
-		// Close listener
-		if mapping.ListenDone != nil {
-			select {
-			case <-mapping.ListenDone:
-			default:
-				close(mapping.ListenDone)
+		// Stop accepting new users on the public port
+		stopListening(mapping)
+		for _, mem := range mapping.Members {
+			if !mem.Detached {
+				clients = append(clients, mem.ClientConn)
 			}
 		}
-		// Close control connection
-		_ = mapping.ClientConn.Close()
-		// Close data channel queue
-		select {
-		case <-mapping.DataChan:
-		default:
-			close(mapping.DataChan)
-		}
 	}
-	mappingTable = make(map[int]*Mapping)
 	mappingTableMu.Unlock()
+	for _, conn := range clients {
+		_ = conn.SetWriteDeadline(time.Now().Add(goAwayTimeout))
+		if err := protocol.WritePacket(conn, goAway); err != nil {
+			log.Warnf("server", "server.send_goaway_failed", err)
+		}
+		_ = conn.SetWriteDeadline(time.Time{})
+	}
+	// Hand the ports over to the other nodes, the clients reconnect there
+	leaveCluster(ports)
 
-	// Wait a bit for connections to close gracefully
-	time.Sleep(2 * time.Second)
+	log.Info("server", "server.draining_relays", map[string]interface{}{"Count": relayTracker.Active(), "Timeout": timeout})
+	if cut := relayTracker.Drain(timeout); cut > 0 {
+		log.Warn("server", "server.drain_cut_relays", map[string]interface{}{"Count": cut})
+	}
 
-	log.Info("server", "server.shutdown_complete", nil)
+	mappingTableMu.Lock()
+	mappings := mappingTable
+	mappingTable = make(map[int]*Mapping)
+	for _, mapping := range mappings {
+		for _, mem := range mapping.Members {
+			endSession(mem)
+			_ = mem.ClientConn.Close()
+		}
+		mapping.notify()
+	}
+	mappingTableMu.Unlock()
 }
 
 // checkClientHeartbeat periodically checks mappingTable and releases resources immediately on timeout
@@ -181,18 +687,26 @@ func checkClientHeartbeat() {
 	defer mappingTableMu.Unlock()
 	now := time.Now()
 	for port, m := range mappingTable {
-		if now.Sub(m.LastHeartbeat) > time.Duration(heartbeatTimeout)*time.Second {
-			log.Warnf("server", "server.client_heartbeat_timeout", port)
-			_ = m.ClientConn.Close()
-			delete(mappingTable, port)
+		for _, mem := range append([]*Member(nil), m.Members...) {
+			if mem.Detached {
+				continue
+			}
+			if now.Sub(mem.LastHeartbeat) > heartbeatTimeout {
+				log.Warnf("server", "server.client_heartbeat_timeout", port)
+				serverMetrics.heartbeatTimeouts.Inc()
+				_ = mem.ClientConn.Close()
+				if mem.SessionID == "" {
+					dropMember(port, m, mem)
+				}
+				// Members with a session are detached by their control loop once the connection drops
+			}
 		}
 	}
 }
 
 // handleControlConn handles the control channel for registration, heartbeat, etc.
 func handleControlConn(conn net.Conn, serverToken string) {
-	var regdRemotePort, regdLocalPort int
-	var listenDone chan struct{}
+	var regdRemotePort int
 	// Read registration message
 	firstPacket, err := protocol.ReadPacket(conn)
 	if err != nil {
@@ -202,13 +716,19 @@ func handleControlConn(conn net.Conn, serverToken string) {
 	}
 	var reg protocol.RegisterRequest
 	_ = json.Unmarshal(firstPacket, &reg)
-	if reg.Token != serverToken {
+	want := serverToken
+	if reg.Type == "peer_forward" {
+		// Nodes forward users with the cluster secret, which tunnel clients do not know
+		want = clusterToken
+	}
+	if want == "" || reg.Token != want {
 		resp := protocol.RegisterResponse{Type: "register_resp", Status: "fail", Reason: "authentication failed"}
 		msg, _ := json.Marshal(resp)
 		if err := protocol.WritePacket(conn, msg); err != nil {
 			log.Errorf("server", "server.send_response_failed", err)
 		}
 		log.Warnf("server", "server.token_auth_failed", reg.Name)
+		serverMetrics.authFailures.With("control").Inc()
 		_ = conn.Close()
 		return
 	}
@@ -221,134 +741,152 @@ func handleControlConn(conn net.Conn, serverToken string) {
 			_ = conn.Close()
 			return
 		}
-		// Find the corresponding mapping and send data connection to channel
-		mappingTableMu.Lock()
-		mapping, exists := mappingTable[reg.RemotePort]
-		mappingTableMu.Unlock()
-		if !exists {
+		// Hand the data connection to the user waiting for it
+		if !deliverDataChannel(reg.ConnID, reg.RemotePort, conn) {
 			log.Warnf("server", "server.data_channel_no_mapping", reg.RemotePort)
 			_ = conn.Close()
 			return
 		}
 		log.Infof("server", "server.data_channel_established", reg.RemotePort)
-		// Send data connection to channel (non-blocking)
-		select {
-		case mapping.DataChan <- conn:
-			// Connection is now in the channel, will be used by RelayConn
-			// Don't close it here, RelayConn will close it when done
-			// This function returns but connection remains alive for relay
-		default:
-			log.Warnf("server", "server.data_channel_queue_full", reg.RemotePort)
-			_ = conn.Close()
-		}
 		// Don't close connection here - it's being used by RelayConn
 		// The connection will be closed by RelayConn when the relay ends
 		return
 	}
+	// A user another cluster node accepted for a tunnel connected here
+	if reg.Type == "peer_forward" {
+		handlePeerForward(conn, reg)
+		return
+	}
 	// For control channel, use defer to close connection when function exits
 	defer func() { _ = conn.Close() }()
+	bindAddr, err := resolveBindAddr(reg.BindAddr)
+	if err != nil {
+		log.Warnf("server", "server.bind_addr_rejected", err)
+		rejectRegistration(conn, err)
+		return
+	}
+	if interval := time.Duration(reg.HeartbeatInterval) * time.Second; !reg.HeartbeatAdapts && interval > 0 && 2*interval > heartbeatTimeout {
+		// Clients that adapt shorten their interval from the advertised timeout; older ones would be dropped repeatedly
+		log.Warn("server", "server.heartbeat_interval_incompatible", map[string]interface{}{
+			"Name": reg.Name, "Interval": interval, "Timeout": heartbeatTimeout,
+		})
+	}
 	mappingTableMu.Lock()
-	// Check if port already exists and close old listener
-	if oldMapping, exists := mappingTable[reg.RemotePort]; exists {
-		// Close old listener (safely)
-		if oldMapping.ListenDone != nil {
-			select {
-			case <-oldMapping.ListenDone:
-				// Already closed
-			default:
-				close(oldMapping.ListenDone)
-			}
+	port, mapping, member := resumeSession(conn, reg)
+	mappingTableMu.Unlock()
+	resumed := member != nil
+	if !resumed {
+		member = &Member{
+			ClientConn:    conn,
+			Name:          reg.Name,
+			LocalPort:     reg.LocalPort,
+			LastHeartbeat: time.Now(),
+			SessionID:     reg.SessionID,
+			ID:            newMemberID(),
+			ConnectedAt:   time.Now(),
+		}
+		port, mapping, err = placeMember(reg, bindAddr, member)
+		if err != nil {
+			log.Warnf("server", "server.port_allocation_failed", err)
+			rejectRegistration(conn, err)
+			return
 		}
-		// Close old data channel queue (safely)
-		select {
-		case <-oldMapping.DataChan:
-			// Channel already closed or empty
-		default:
-			close(oldMapping.DataChan)
-		}
-		// Close old control connection
-		_ = oldMapping.ClientConn.Close()
-	}
-	listenDone = make(chan struct{})
-	mappingTable[reg.RemotePort] = &Mapping{
-		ClientConn:    conn,
-		LocalPort:     reg.LocalPort,
-		LastHeartbeat: time.Now(),
-		DataChan:      make(chan net.Conn, 10), // Buffer for pending data connections
-		ListenDone:    listenDone,
 	}
+	mappingTableMu.Lock()
+	bindAddr = mapping.BindAddr
 	mappingTableMu.Unlock()
-	regdRemotePort, regdLocalPort = reg.RemotePort, reg.LocalPort
-	log.Infof("server", "server.port_mapping_registered", regdLocalPort, regdRemotePort)
-	resp := protocol.RegisterResponse{Type: "register_resp", Status: "ok"}
+	regdRemotePort = port
+	if resumed {
+		log.Infof("server", "server.session_resumed", regdRemotePort)
+	} else {
+		log.Infof("server", "server.port_mapping_registered", reg.LocalPort, regdRemotePort)
+	}
+	resp := protocol.RegisterResponse{
+		Type:       "register_resp",
+		Status:     "ok",
+		RemotePort: regdRemotePort,
+		PublicAddr: publicAddrFor(conn, bindAddr, regdRemotePort),
+		Resumed:    resumed,
+
+		HeartbeatTimeout: int(heartbeatTimeout / time.Second),
+	}
 	msg, _ := json.Marshal(resp)
 	if err := protocol.WritePacket(conn, msg); err != nil {
 		log.Errorf("server", "server.send_response_failed", err)
+		releaseMember(regdRemotePort, conn)
 		return
 	}
 
-	go listenAndForwardWithStop(regdRemotePort, conn, regdLocalPort, listenDone)
+	mappingTableMu.Lock()
+	if mappingTable[regdRemotePort] == mapping {
+		refreshListener(regdRemotePort, mapping)
+	}
+	mappingTableMu.Unlock()
 
 	for {
 		packet, err := protocol.ReadPacket(conn)
 		if err != nil {
 			log.Warnf("server", "server.control_channel_disconnected", err)
-			// Close the listening port when control channel disconnects
-			mappingTableMu.Lock()
-			if mapping, exists := mappingTable[regdRemotePort]; exists && mapping.ListenDone != nil {
-				select {
-				case <-mapping.ListenDone:
-					// Already closed
-				default:
-					close(mapping.ListenDone)
-				}
-			}
-			mappingTableMu.Unlock()
 			break
 		}
 
 		var ping protocol.HeartbeatPing
 		if err := json.Unmarshal(packet, &ping); err == nil && ping.Type == "ping" {
 			mappingTableMu.Lock()
-			if m, ok := mappingTable[regdRemotePort]; ok {
-				m.LastHeartbeat = time.Now()
+			member.LastHeartbeat = time.Now()
+			if ping.RTT != nil {
+				member.RTT = *ping.RTT
 			}
 			mappingTableMu.Unlock()
-			pong := protocol.HeartbeatPong{Type: "pong", Time: time.Now().Unix()}
+			if ping.RTT != nil {
+				log.Debug("server", "server.client_rtt", map[string]interface{}{
+					"Port": regdRemotePort, "Name": reg.Name, "Avg": ping.RTT.Avg.Round(time.Microsecond),
+					"Min": ping.RTT.Min.Round(time.Microsecond), "Max": ping.RTT.Max.Round(time.Microsecond),
+					"Jitter": ping.RTT.Jitter.Round(time.Microsecond),
+				})
+			}
+			// Echo the ping time so the client can measure the round trip
+			pong := protocol.HeartbeatPong{Type: "pong", Time: ping.Time}
 			b, _ := json.Marshal(pong)
 			if err := protocol.WritePacket(conn, b); err != nil {
 				log.Errorf("server", "server.send_heartbeat_failed", err)
-				// Close the listening port when control channel disconnects
-				mappingTableMu.Lock()
-				if mapping, exists := mappingTable[regdRemotePort]; exists && mapping.ListenDone != nil {
-					select {
-					case <-mapping.ListenDone:
-						// Already closed
-					default:
-						close(mapping.ListenDone)
-					}
-				}
-				mappingTableMu.Unlock()
 				break
 			}
 			continue
 		}
+		// Handle health_report: keep the client's explanation of its tunnel's health
+		var report protocol.HealthReport
+		if err := json.Unmarshal(packet, &report); err == nil && report.Type == "health_report" {
+			mappingTableMu.Lock()
+			if _, mem := memberOf(report.Port, conn); mem != nil {
+				recordHealthReport(mem, &report)
+			}
+			mappingTableMu.Unlock()
+			continue
+		}
 		// Handle offline_port request
 		var off protocol.OfflinePortRequest
 		if err := json.Unmarshal(packet, &off); err == nil && off.Type == "offline_port" {
 			log.Infof("server", "server.client_offline_port", off.Port)
-			// Actively stop listening and relay
+			// Take this client out of rotation; the public listener stops once no member is left up
 			mappingTableMu.Lock()
-			if mapping, exists := mappingTable[off.Port]; exists {
-				if mapping.ListenDone != nil {
-					select {
-					case <-mapping.ListenDone:
-						// Already closed
-					default:
-						close(mapping.ListenDone)
-					}
+			if m, mem := memberOf(off.Port, conn); mem != nil {
+				if !mem.Offline {
+					serverMetrics.healthTransitions.With("offline_port", "down").Inc()
 				}
-				delete(mappingTable, off.Port)
+				mem.Offline = true
+				refreshListener(off.Port, m)
+			}
+			mappingTableMu.Unlock()
+			continue
+		}
+		// Handle unregister: the client is shutting down on purpose
+		var unreg protocol.UnregisterRequest
+		if err := json.Unmarshal(packet, &unreg); err == nil && unreg.Type == "unregister" {
+			log.Infof("server", "server.client_unregister", unreg.Port)
+			mappingTableMu.Lock()
+			if m, mem := memberOf(unreg.Port, conn); mem != nil {
+				dropMember(unreg.Port, m, mem)
 			}
 			mappingTableMu.Unlock()
 			continue
@@ -356,24 +894,17 @@ func handleControlConn(conn net.Conn, serverToken string) {
 		var on protocol.OnlinePortRequest
 		if err := json.Unmarshal(packet, &on); err == nil && on.Type == "online_port" {
 			log.Infof("server", "server.client_online_port", on.Port)
-			// Re-listen on the port
+			// Put the client back in rotation and re-listen on the port if needed
 			mappingTableMu.Lock()
-			if mapping, exists := mappingTable[on.Port]; exists {
-				if mapping.ListenDone != nil {
-					select {
-					case <-mapping.ListenDone:
-						// Already closed
-					default:
-						close(mapping.ListenDone)
-					}
+			if m, mem := memberOf(on.Port, conn); mem != nil {
+				if mem.Offline {
+					serverMetrics.healthTransitions.With("offline_port", "up").Inc()
 				}
-				listenDone = make(chan struct{})
-				mapping.ListenDone = listenDone
-			} else {
-				listenDone = make(chan struct{})
+				mem.Offline = false
+				refreshListener(on.Port, m)
+				m.notify()
 			}
 			mappingTableMu.Unlock()
-			go listenAndForwardWithStop(on.Port, conn, regdLocalPort, listenDone)
 			continue
 		}
 		// Handle open_data_channel and other protocols
@@ -382,15 +913,338 @@ func handleControlConn(conn net.Conn, serverToken string) {
 			continue
 		}
 	}
+	releaseMember(regdRemotePort, conn)
+	log.Info("server", "server.control_channel_exit", nil)
+}
+
+// recordHealthReport stores a client's health report on its member and logs when the reported
+// status changes. Callers must hold mappingTableMu.
+func recordHealthReport(mem *Member, report *protocol.HealthReport) {
+	prev := mem.Health
+	mem.Health, mem.HealthAt = report, time.Now()
+	if prev == nil && report.Status == "up" || prev != nil && prev.Status == report.Status {
+		log.Debug("server", "server.health_report_received", map[string]interface{}{"Port": report.Port, "Name": mem.Name, "Status": report.Status})
+		return
+	}
+	serverMetrics.healthTransitions.With("health_report", report.Status).Inc()
+	if report.Status == "up" {
+		log.Info("server", "server.client_health_up", map[string]interface{}{
+			"Port": report.Port, "Name": mem.Name, "Healthy": report.Healthy, "Total": len(report.Backends),
+		})
+		return
+	}
+	reason := ""
+	for _, b := range report.Backends {
+		if b.Error != "" {
+			reason = b.Addr + ": " + b.Error
+			break
+		}
+	}
+	log.Warn("server", "server.client_health_down", map[string]interface{}{
+		"Port": report.Port, "Name": mem.Name, "Checker": report.Checker, "Reason": reason,
+	})
+}
+
+// resumeSession re-attaches conn to the member owned by reg.SessionID, which may be detached or
+// still held by a half-open connection. It returns a nil member when there is nothing to resume.
+// Callers must hold mappingTableMu.
+func resumeSession(conn net.Conn, reg protocol.RegisterRequest) (int, *Mapping, *Member) {
+	if reg.SessionID == "" {
+		return 0, nil, nil
+	}
+	for port, m := range mappingTable {
+		for _, mem := range m.Members {
+			if mem.SessionID != reg.SessionID {
+				continue
+			}
+			if reg.RemotePort > 0 && reg.RemotePort != port {
+				// Client now asks for a different port, let the old session expire
+				return 0, nil, nil
+			}
+			endSession(mem)
+			if mem.ClientConn != conn {
+				_ = mem.ClientConn.Close()
+			}
+			mem.ClientConn = conn
+			mem.LocalPort = reg.LocalPort
+			mem.LastHeartbeat = time.Now()
+			mem.ConnectedAt = mem.LastHeartbeat
+			mem.Detached = false
+			updateFailover(port, m)
+			m.notify()
+			return port, m, mem
+		}
+	}
+	return 0, nil, nil
+}
+
+// placeMember finds the mapping a new registration belongs to and adds mem to it. A new mapping
+// is claimed in the cluster store before it is installed, so callers must not hold mappingTableMu.
+func placeMember(reg protocol.RegisterRequest, bindAddr string, mem *Member) (int, *Mapping, error) {
 	mappingTableMu.Lock()
-	delete(mappingTable, regdRemotePort)
+	port, m, err := findMapping(reg, bindAddr, mem)
+	if err != nil || mappingTable[port] == m {
+		mappingTableMu.Unlock()
+		return port, m, err
+	}
+	// Reserve the port while the store is asked for it
+	claiming[port]++
 	mappingTableMu.Unlock()
-	log.Info("server", "server.control_channel_exit", nil)
+	err = claimPort(port, m.BindAddr)
+
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	if claiming[port]--; claiming[port] == 0 {
+		delete(claiming, port)
+	}
+	if err == nil && draining {
+		err = errors.New("server shutting down")
+	}
+	if err == nil {
+		m, err = installMapping(port, m, reg, mem)
+	}
+	if err != nil {
+		releasePort(port)
+		return 0, nil, err
+	}
+	return port, m, nil
+}
+
+// findMapping returns the mapping a new registration belongs to. A plain registration takes its
+// port over from whoever held it; a group registration joins the group's mapping, creating it on
+// first use. mem is already added to an existing mapping; a new one is returned without being
+// installed. Callers must hold mappingTableMu.
+func findMapping(reg protocol.RegisterRequest, bindAddr string, mem *Member) (int, *Mapping, error) {
+	if draining {
+		return 0, nil, errors.New("server shutting down")
+	}
+	if reg.BackupFor != "" {
+		return joinAsBackup(reg, mem)
+	}
+	if port, m := standbyMapping(reg.Name); m != nil && reg.Group == m.Group && (reg.RemotePort == 0 || reg.RemotePort == port) {
+		// The primary comes back to the port its backups kept serving
+		if m.Group != "" {
+			return port, m, joinGroup(port, m, reg, mem)
+		}
+		takeOver(port, m, mem)
+		return port, m, nil
+	}
+	if reg.Group != "" && reg.RemotePort == 0 {
+		for port, m := range mappingTable {
+			if m.Group == reg.Group {
+				return port, m, joinGroup(port, m, reg, mem)
+			}
+		}
+	}
+	port, err := allocateRemotePort(reg, bindAddr)
+	if err != nil {
+		return 0, nil, err
+	}
+	if old, exists := mappingTable[port]; exists && (old.Group != "" || reg.Group != "") {
+		if old.Group != reg.Group {
+			return 0, nil, fmt.Errorf("port %d is served by another tunnel", port)
+		}
+		return port, old, joinGroup(port, old, reg, mem)
+	}
+	// Everything that can reject the registration comes first, a rejected one leaves the port alone
+	policy, err := groupPolicy(reg.LBPolicy)
+	if err != nil {
+		return 0, nil, err
+	}
+	m := &Mapping{
+		BindAddr: bindAddr,
+		Members:  []*Member{mem},
+		Group:    reg.Group,
+		GroupKey: reg.GroupKey,
+		Policy:   policy,
+	}
+	if err := applyOfflinePolicy(m, reg); err != nil {
+		return 0, nil, err
+	}
+	return port, m, nil
+}
+
+// installMapping puts the new mapping m on its claimed port. Another registration may have placed
+// the port meanwhile: a plain mapping there is evicted as before, the same group is joined instead.
+// Callers must hold mappingTableMu.
+func installMapping(port int, m *Mapping, reg protocol.RegisterRequest, mem *Member) (*Mapping, error) {
+	if old, exists := mappingTable[port]; exists {
+		if old.Group != "" || m.Group != "" {
+			if old.Group != m.Group {
+				return nil, fmt.Errorf("port %d is served by another tunnel", port)
+			}
+			return old, joinGroup(port, old, reg, mem)
+		}
+		// A second plain registration evicts the first, as before
+		evictMapping(port, old)
+	}
+	mappingTable[port] = m
+	if m.Group != "" {
+		log.Info("server", "server.group_member_joined", map[string]interface{}{
+			"Group": m.Group, "Port": port, "Name": mem.Name, "Members": 1,
+		})
+	}
+	return m, nil
+}
+
+// releaseMember cleans up after the control channel conn ends. Members with a session are kept
+// detached for sessionGrace so the client can resume without a gap; with no other member up,
+// users are queued for it meanwhile.
+func releaseMember(port int, conn net.Conn) {
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	m, mem := memberOf(port, conn)
+	if mem == nil {
+		// Already released, or taken over by a newer control channel
+		return
+	}
+	if mem.SessionID == "" || sessionGrace <= 0 {
+		dropMember(port, m, mem)
+		return
+	}
+	log.Info("server", "server.session_detached", map[string]interface{}{"Port": port, "Grace": sessionGrace})
+	mem.Detached = true
+	updateFailover(port, m)
+	mem.graceTimer = time.AfterFunc(sessionGrace, func() { expireSession(port, m, mem) })
+}
+
+// expireSession drops a detached member whose client did not come back in time.
+func expireSession(port int, m *Mapping, mem *Member) {
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	if mappingTable[port] != m || !mem.Detached {
+		return
+	}
+	log.Warnf("server", "server.session_expired", port)
+	dropMember(port, m, mem)
+}
+
+// endSession stops a detached member's grace timer. Callers must hold mappingTableMu.
+func endSession(mem *Member) {
+	if mem.graceTimer != nil {
+		mem.graceTimer.Stop()
+		mem.graceTimer = nil
+	}
+}
+
+// waitForMember picks the member that serves a user from clientIP and counts the user against it,
+// queueing the caller while no member is available (e.g. all detached). While a KeepOpen mapping
+// is offline the user waits at most its HoldTimeout. ok is false once the mapping is gone or the
+// hold ran out. Call doneWithMember when the user leaves.
+func waitForMember(port int, m *Mapping, clientIP string) (mem *Member, ok bool) {
+	var expired <-chan time.Time
+	for {
+		mappingTableMu.Lock()
+		if mappingTable[port] != m || len(m.Members) == 0 {
+			mappingTableMu.Unlock()
+			log.Warnf("server", "server.mapping_not_found", port)
+			return nil, false
+		}
+		if mem = pickMember(m, clientIP); mem != nil {
+			mem.Active++
+			mappingTableMu.Unlock()
+			return mem, true
+		}
+		if expired == nil && servingOffline(m) {
+			timer := time.NewTimer(m.HoldTimeout)
+			defer timer.Stop()
+			expired = timer.C
+			log.Debugf("server", "server.offline_hold_started", port)
+		}
+		if m.changed == nil {
+			m.changed = make(chan struct{})
+		}
+		changed := m.changed
+		mappingTableMu.Unlock()
+		select {
+		case <-changed:
+		case <-expired:
+			log.Warnf("server", "server.offline_hold_expired", port)
+			return nil, false
+		}
+	}
+}
+
+// doneWithMember releases the slot taken by waitForMember.
+func doneWithMember(mem *Member) {
+	mappingTableMu.Lock()
+	mem.Active--
+	mappingTableMu.Unlock()
+}
+
+// rejectRegistration answers a register request with a failure response.
+func rejectRegistration(conn net.Conn, reason error) {
+	resp := protocol.RegisterResponse{Type: "register_resp", Status: "fail", Reason: reason.Error()}
+	msg, _ := json.Marshal(resp)
+	if err := protocol.WritePacket(conn, msg); err != nil {
+		log.Errorf("server", "server.send_response_failed", err)
+	}
+}
+
+// allocateRemotePort picks the remote port for a registration. An explicit RemotePort is honoured as before;
+// RemotePort 0 takes the first free port on bindAddr from the client's PortRange narrowed by the server pool.
+// Callers must hold mappingTableMu.
+func allocateRemotePort(reg protocol.RegisterRequest, bindAddr string) (int, error) {
+	if reg.RemotePort > 0 {
+		return reg.RemotePort, nil
+	}
+	r := remotePortPool
+	if reg.PortRange != "" {
+		want, err := protocol.ParsePortRange(reg.PortRange)
+		if err != nil {
+			return 0, err
+		}
+		if !r.IsZero() {
+			var ok bool
+			if want, ok = want.Intersect(r); !ok {
+				return 0, fmt.Errorf("port range %s is outside server pool %s", reg.PortRange, r)
+			}
+		}
+		r = want
+	}
+	if r.IsZero() {
+		// No pool configured, let the OS hand out an ephemeral port
+		ln, err := net.Listen("tcp", net.JoinHostPort(bindAddr, "0"))
+		if err != nil {
+			return 0, err
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		_ = ln.Close()
+		return port, nil
+	}
+	for port := r.Min; port <= r.Max; port++ {
+		if _, used := mappingTable[port]; used || claiming[port] > 0 || claimedByPeer(port) {
+			continue
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(bindAddr, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		_ = ln.Close()
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free port in range %s", r)
+}
+
+// publicAddrFor builds the address users should connect to for remotePort.
+// A specific bind address wins over public_host, since the listener is only reachable there.
+func publicAddrFor(conn net.Conn, bindAddr string, remotePort int) string {
+	host := publicHost
+	if ip := net.ParseIP(stripZone(bindAddr)); ip != nil && !ip.IsUnspecified() {
+		host = bindAddr
+	}
+	if host == "" && conn.LocalAddr() != nil {
+		host, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+	}
+	if host == "" {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(remotePort))
 }
 
 // listenAndForwardWithStop listens with stop signal support, allowing health probe to stop port listening and relay when down
-func listenAndForwardWithStop(remotePort int, clientConn net.Conn, localPort int, stop <-chan struct{}) {
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", remotePort))
+func listenAndForwardWithStop(remotePort int, bindAddr string, stop <-chan struct{}) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(bindAddr, strconv.Itoa(remotePort)))
 	if err != nil {
 		log.Errorf("server", "server.listen_port_failed", err)
 		return
@@ -401,9 +1255,17 @@ func listenAndForwardWithStop(remotePort int, clientConn net.Conn, localPort int
 		for {
 			userConn, err := ln.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				continue
 			}
-			acceptCh <- userConn
+			select {
+			case acceptCh <- userConn:
+			case <-stop:
+				_ = userConn.Close()
+				return
+			}
 		}
 	}()
 	for {
@@ -413,39 +1275,114 @@ func listenAndForwardWithStop(remotePort int, clientConn net.Conn, localPort int
 			log.Infof("server", "server.port_stopped", remotePort)
 			return
 		case userConn := <-acceptCh:
-			go func() {
-				// Send open_data_channel command to client
-				req := protocol.RegisterRequest{Type: "open_data_channel", LocalPort: localPort}
-				reqBytes, _ := json.Marshal(req)
-				if err := protocol.WritePacket(clientConn, reqBytes); err != nil {
-					log.Errorf("server", "server.send_data_channel_cmd_failed", err)
-					_ = userConn.Close()
-					return
-				}
-				// Wait for data channel connection from client
-				mappingTableMu.Lock()
-				mapping, exists := mappingTable[remotePort]
-				mappingTableMu.Unlock()
-				if !exists {
-					log.Warnf("server", "server.mapping_not_found", remotePort)
-					_ = userConn.Close()
-					return
-				}
-				// Wait for data channel connection with timeout (increased to 60 seconds)
-				waitStart := time.Now()
-				select {
-				case dataConn := <-mapping.DataChan:
-					waitDuration := time.Since(waitStart)
-					log.Infof("server", "server.data_channel_connected", remotePort, waitDuration.Milliseconds())
-					log.Debugf("server", "server.relay_starting", remotePort)
-					// Relay user connection to data channel connection
-					core.RelayConn(userConn, dataConn)
-					log.Debugf("server", "server.relay_finished", remotePort)
-				case <-time.After(60 * time.Second):
-					log.Warnf("server", "server.data_channel_timeout", remotePort)
-					_ = userConn.Close()
-				}
-			}()
+			go forwardUser(remotePort, userConn)
 		}
 	}
 }
+
+// forwardUser asks one member of the mapping on remotePort for a data channel and relays userConn over it.
+func forwardUser(remotePort int, userConn net.Conn) {
+	forwardUserFrom(remotePort, userConn, remoteIP(userConn))
+}
+
+// forwardUserFrom is forwardUser for a user whose address is clientIP, which differs from the
+// connection's remote address when another cluster node forwarded the user.
+func forwardUserFrom(remotePort int, userConn net.Conn, clientIP string) {
+	mappingTableMu.Lock()
+	mapping, exists := mappingTable[remotePort]
+	maintenance := exists && mapping.Protocol == "http" && servingOffline(mapping)
+	disabled := disabledPorts[remotePort]
+	mappingTableMu.Unlock()
+	if disabled {
+		// Users forwarded by another cluster node still arrive while the port is disabled
+		_ = userConn.Close()
+		return
+	}
+	if !exists {
+		log.Warnf("server", "server.mapping_not_found", remotePort)
+		_ = userConn.Close()
+		return
+	}
+	if maintenance {
+		serveMaintenance(remotePort, mapping, userConn)
+		return
+	}
+	// Count the user from here, so a shutdown drain also waits for users not relayed yet; cutting
+	// the user connection ends the relay as well
+	untrack := relayTracker.Track(userConn)
+	defer untrack()
+	// Pick a member, queueing the user while clients are reconnecting within their session grace period
+	start := time.Now()
+	member, ok := waitForMember(remotePort, mapping, clientIP)
+	if !ok {
+		logConnection(connRecord{Time: start, Port: remotePort, ClientIP: clientIP, Error: "no client available"})
+		_ = userConn.Close()
+		return
+	}
+	defer doneWithMember(member)
+	mappingTableMu.Lock()
+	clientConn, localPort := member.ClientConn, member.LocalPort
+	mappingTableMu.Unlock()
+	record := connRecord{Time: start, Port: remotePort, ClientIP: clientIP, Client: member.Name}
+
+	// Wait for data channel connection with timeout (increased to 60 seconds)
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	waitStart := time.Now()
+	dataConn, err := openDataChannel(ctx, remotePort, clientConn, localPort)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Warnf("server", "server.data_channel_timeout", remotePort)
+		serverMetrics.dataChannelTimeouts.With(strconv.Itoa(remotePort)).Inc()
+		record.Error = "data channel timeout"
+	case err != nil:
+		log.Errorf("server", "server.send_data_channel_cmd_failed", err)
+		record.Error = err.Error()
+	}
+	if err != nil {
+		record.Duration = time.Since(start).Milliseconds()
+		logConnection(record)
+		_ = userConn.Close()
+		return
+	}
+	waitDuration := time.Since(waitStart)
+	serverMetrics.dataChannelWait.Observe(waitDuration.Seconds())
+	log.Infof("server", "server.data_channel_connected", remotePort, waitDuration.Milliseconds())
+	log.Debugf("server", "server.relay_starting", remotePort)
+	// Relay user connection to data channel connection, counting the bytes per member, port and user as they flow
+	relays := serverMetrics.activeRelays.With(strconv.Itoa(remotePort))
+	relays.Inc()
+	stats := core.RelayConn(userConn, dataConn, &member.Traffic, &mapping.Traffic, trafficFor(clientIP))
+	relays.Dec()
+	record.Duration = time.Since(start).Milliseconds()
+	record.BytesIn, record.BytesOut = stats.AToB, stats.BToA
+	logConnection(record)
+	closedBy := "user"
+	if stats.ClosedBy == "b" {
+		closedBy = "client"
+	}
+	log.Debug("server", "server.relay_summary", map[string]interface{}{
+		"Port": remotePort, "Addr": clientIP, "Name": member.Name, "In": stats.AToB, "Out": stats.BToA,
+		"Duration": stats.Duration.Round(time.Millisecond), "ClosedBy": closedBy,
+	})
+}
+
+// openDataChannel asks the client on clientConn for a data channel to its local service and
+// waits for it to connect until ctx is done.
+func openDataChannel(ctx context.Context, remotePort int, clientConn net.Conn, localPort int) (net.Conn, error) {
+	// Send open_data_channel command to client, tagged so its data channel finds this user
+	connID, dataChan, cancel := expectDataChannel(remotePort)
+	defer cancel()
+	req := protocol.RegisterRequest{Type: "open_data_channel", LocalPort: localPort, RemotePort: remotePort, ConnID: connID}
+	reqBytes, _ := json.Marshal(req)
+	if err := protocol.WritePacket(clientConn, reqBytes); err != nil {
+		return nil, err
+	}
+	// Wait for data channel connection from client
+	select {
+	case dataConn := <-dataChan:
+		return dataConn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
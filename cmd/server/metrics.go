@@ -0,0 +1,87 @@
+package main
+
+import (
+	"gotunnel/pkg/metrics"
+	"strconv"
+)
+
+// serverMetrics is what the server exposes on server.metrics_addr for Prometheus.
+var serverMetrics = newServerMetrics()
+
+type serverMetricSet struct {
+	registry            *metrics.Registry
+	activeRelays        *metrics.GaugeVec   // port
+	dataChannelWait     *metrics.Histogram  // Seconds from open_data_channel to the data channel arriving
+	dataChannelTimeouts *metrics.CounterVec // port
+	authFailures        *metrics.CounterVec // listener: control or admin
+	heartbeatTimeouts   *metrics.Counter
+	healthTransitions   *metrics.CounterVec // source, status
+}
+
+func newServerMetrics() *serverMetricSet {
+	r := metrics.NewRegistry()
+	s := &serverMetricSet{
+		registry: r,
+		activeRelays: r.NewGaugeVec("gotunnel_server_active_relays",
+			"User connections currently relayed through a tunnel.", "port"),
+		dataChannelWait: r.NewHistogram("gotunnel_server_data_channel_wait_seconds",
+			"Time from asking a client for a data channel until it connected.", metrics.DefBuckets),
+		dataChannelTimeouts: r.NewCounterVec("gotunnel_server_data_channel_timeouts_total",
+			"Users dropped because the client's data channel did not arrive in time.", "port"),
+		authFailures: r.NewCounterVec("gotunnel_server_auth_failures_total",
+			"Requests rejected for a wrong token or password.", "listener"),
+		heartbeatTimeouts: r.NewCounter("gotunnel_server_heartbeat_timeouts_total",
+			"Control connections closed because the client stopped sending heartbeats."),
+		healthTransitions: r.NewCounterVec("gotunnel_server_health_transitions_total",
+			"Tunnel members going up or down, by what noticed it.", "source", "status"),
+	}
+	r.NewGaugeFunc("gotunnel_server_connected_clients", "Clients with a live control connection.", func() float64 {
+		mappingTableMu.Lock()
+		defer mappingTableMu.Unlock()
+		n := 0
+		for _, m := range mappingTable {
+			for _, mem := range m.Members {
+				if !mem.Detached {
+					n++
+				}
+			}
+		}
+		return float64(n)
+	})
+	r.NewGaugeFunc("gotunnel_server_mappings", "Registered public ports.", func() float64 {
+		mappingTableMu.Lock()
+		defer mappingTableMu.Unlock()
+		return float64(len(mappingTable))
+	})
+	r.NewFunc("gotunnel_server_bytes_total", "Bytes relayed for users of a port since it was registered, in from and out to the user.",
+		metrics.CounterType, []string{"port", "direction"}, func() []metrics.Sample {
+			mappingTableMu.Lock()
+			defer mappingTableMu.Unlock()
+			samples := make([]metrics.Sample, 0, 2*len(mappingTable))
+			for port, m := range mappingTable {
+				p := strconv.Itoa(port)
+				samples = append(samples,
+					metrics.Sample{Labels: []string{p, "in"}, Value: float64(m.Traffic.In.Load())},
+					metrics.Sample{Labels: []string{p, "out"}, Value: float64(m.Traffic.Out.Load())})
+			}
+			return samples
+		})
+	return s
+}
+
+// forgetPort drops the per-port series of a mapping that went away, so ports clients stopped
+// registering do not linger in every scrape. Relays still running on the old mapping count
+// against a gauge that is no longer exported.
+func (s *serverMetricSet) forgetPort(port int) {
+	p := strconv.Itoa(port)
+	s.activeRelays.Delete(p)
+	s.dataChannelTimeouts.Delete(p)
+}
+
+// healthStatus is the status label of a health transition.
+func healthStatus(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
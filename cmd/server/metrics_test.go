@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerMetrics_Scrape(t *testing.T) {
+	m := &Mapping{Members: []*Member{
+		{Name: "a", ClientConn: &mockConn{}},
+		{Name: "b", ClientConn: &mockConn{}, Detached: true},
+	}}
+	m.Traffic.In.Add(100)
+	m.Traffic.Out.Add(2048)
+	mappingTableMu.Lock()
+	mappingTable = map[int]*Mapping{9500: m}
+	mappingTableMu.Unlock()
+
+	rec := httptest.NewRecorder()
+	serverMetrics.registry.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	// 已断开等待恢复的成员不算在线客户端
+	for _, line := range []string{
+		"gotunnel_server_connected_clients 1",
+		"gotunnel_server_mappings 1",
+		`gotunnel_server_bytes_total{port="9500",direction="in"} 100`,
+		`gotunnel_server_bytes_total{port="9500",direction="out"} 2048`,
+		"# TYPE gotunnel_server_data_channel_wait_seconds histogram",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestServerMetrics_ForgetsDroppedPort(t *testing.T) {
+	mem := &Member{Name: "a", ClientConn: &mockConn{}}
+	m := &Mapping{Members: []*Member{mem}}
+	mappingTableMu.Lock()
+	mappingTable = map[int]*Mapping{9501: m}
+	mappingTableMu.Unlock()
+	serverMetrics.activeRelays.With("9501").Inc()
+	serverMetrics.dataChannelTimeouts.With("9501").Inc()
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		serverMetrics.registry.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+	if body := scrape(); !strings.Contains(body, `port="9501"`) {
+		t.Fatalf("expected series for port 9501 in:\n%s", body)
+	}
+	// 最后一个成员离开、映射删除后，该端口的序列不再导出
+	mappingTableMu.Lock()
+	dropMember(9501, m, mem)
+	mappingTableMu.Unlock()
+	if body := scrape(); strings.Contains(body, `port="9501"`) {
+		t.Errorf("expected no series for port 9501 in:\n%s", body)
+	}
+}
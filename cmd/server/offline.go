@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"gotunnel/pkg/log"
+	"gotunnel/pkg/protocol"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultMaintenancePage is served to users of an offline HTTP tunnel when neither the client
+// nor server.maintenance_page provides one.
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>503 Service Unavailable</title></head>
+<body>
+<h1>Service temporarily unavailable</h1>
+<p>This service is down for maintenance. Please try again in a few minutes.</p>
+</body>
+</html>
+`
+
+// Limits on what a client may ask for while its tunnel is offline.
+const (
+	maxOfflineHold      = 5 * time.Minute
+	maxMaintenancePage  = 64 << 10
+	defaultOfflineHold  = 30 * time.Second
+	maintenanceReadWait = 5 * time.Second // How long to wait for the request before answering anyway
+)
+
+// maintenancePage is the server-wide page for offline HTTP tunnels, see server.maintenance_page.
+var maintenancePage = defaultMaintenancePage
+
+// applyOfflinePolicy copies what users of m get while the tunnel is offline from the registration
+// that creates it.
+func applyOfflinePolicy(m *Mapping, reg protocol.RegisterRequest) error {
+	switch reg.Protocol {
+	case "", "tcp", "http":
+	default:
+		return fmt.Errorf("unknown protocol %q", reg.Protocol)
+	}
+	if len(reg.MaintenancePage) > maxMaintenancePage {
+		return fmt.Errorf("maintenance page larger than %d bytes", maxMaintenancePage)
+	}
+	m.Protocol = reg.Protocol
+	m.KeepOpen = reg.KeepOpen
+	m.MaintenancePage = reg.MaintenancePage
+	m.HoldTimeout = defaultOfflineHold
+	if reg.HoldTimeout > 0 {
+		m.HoldTimeout = time.Duration(reg.HoldTimeout) * time.Second
+	}
+	if m.HoldTimeout > maxOfflineHold {
+		m.HoldTimeout = maxOfflineHold
+	}
+	return nil
+}
+
+// membersUp reports whether any member can take users now or after resuming its session.
+// Callers must hold mappingTableMu.
+func membersUp(m *Mapping) bool {
+	for _, mem := range m.Members {
+		if !mem.Offline && !mem.Unhealthy {
+			return true
+		}
+	}
+	return false
+}
+
+// servingOffline reports whether m keeps its port open although every member is down.
+// Callers must hold mappingTableMu.
+func servingOffline(m *Mapping) bool {
+	return m.KeepOpen && len(m.Members) > 0 && !membersUp(m)
+}
+
+// serveMaintenance answers an HTTP user of an offline tunnel with a 503 and the maintenance page.
+// The request is read first, so the browser sees the answer rather than a reset connection.
+func serveMaintenance(port int, m *Mapping, userConn net.Conn) {
+	defer userConn.Close()
+	page := m.MaintenancePage
+	if page == "" {
+		page = maintenancePage
+	}
+	_ = userConn.SetReadDeadline(time.Now().Add(maintenanceReadWait))
+	if req, err := http.ReadRequest(bufio.NewReader(userConn)); err == nil {
+		_ = req.Body.Close()
+	}
+	_ = userConn.SetWriteDeadline(time.Now().Add(maintenanceReadWait))
+	resp := "HTTP/1.1 503 Service Unavailable\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Length: " + strconv.Itoa(len(page)) + "\r\n" +
+		"Retry-After: " + strconv.Itoa(int(m.HoldTimeout/time.Second)) + "\r\n" +
+		"Cache-Control: no-store\r\n" +
+		"Connection: close\r\n\r\n" + page
+	if _, err := userConn.Write([]byte(resp)); err != nil {
+		return
+	}
+	log.Debugf("server", "server.maintenance_served", port)
+}
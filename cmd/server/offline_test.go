@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"gotunnel/pkg/protocol"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyOfflinePolicy(t *testing.T) {
+	m := &Mapping{}
+	if err := applyOfflinePolicy(m, protocol.RegisterRequest{Protocol: "tcp", KeepOpen: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !m.KeepOpen || m.HoldTimeout != defaultOfflineHold {
+		t.Errorf("expected keep_open with the default hold, got %+v", m)
+	}
+	// 过长的等待时间被截断到上限
+	if err := applyOfflinePolicy(m, protocol.RegisterRequest{HoldTimeout: 3600}); err != nil || m.HoldTimeout != maxOfflineHold {
+		t.Errorf("expected hold capped at %s, got %s err=%v", maxOfflineHold, m.HoldTimeout, err)
+	}
+	if err := applyOfflinePolicy(m, protocol.RegisterRequest{Protocol: "udp"}); err == nil {
+		t.Error("expected unknown protocol to be rejected")
+	}
+	big := strings.Repeat("x", maxMaintenancePage+1)
+	if err := applyOfflinePolicy(m, protocol.RegisterRequest{Protocol: "http", MaintenancePage: big}); err == nil {
+		t.Error("expected oversized maintenance page to be rejected")
+	}
+}
+
+func TestRefreshListener_KeepOpen(t *testing.T) {
+	mem := &Member{Name: "only", Offline: true}
+	m := &Mapping{KeepOpen: true, Members: []*Member{mem}, ListenDone: make(chan struct{})}
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	// 全部成员下线时仍保持监听
+	refreshListener(9300, m)
+	if !isListening(m) {
+		t.Fatal("keep_open mapping should keep listening while offline")
+	}
+	m.KeepOpen = false
+	refreshListener(9300, m)
+	if isListening(m) {
+		t.Error("plain mapping should stop listening while offline")
+	}
+}
+
+func TestForwardUser_MaintenancePage(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = map[int]*Mapping{9301: {
+		Protocol: "http", KeepOpen: true, HoldTimeout: 30 * time.Second, MaintenancePage: "<h1>back soon</h1>",
+		Members: []*Member{{Name: "web", Offline: true, ClientConn: &mockConn{}}},
+	}}
+	mappingTableMu.Unlock()
+
+	user, userPeer := net.Pipe()
+	defer user.Close()
+	go forwardUser(9301, userPeer)
+
+	// HTTP 隧道下线时返回 503 维护页，而不是拒绝连接
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	go req.Write(user)
+	user.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(user), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "<h1>back soon</h1>" || resp.Header.Get("Retry-After") != "30" {
+		t.Errorf("unexpected maintenance answer %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+}
+
+func TestWaitForMember_OfflineHold(t *testing.T) {
+	mem := &Member{Name: "db", Offline: true}
+	m := &Mapping{Protocol: "tcp", KeepOpen: true, HoldTimeout: 100 * time.Millisecond, Members: []*Member{mem}}
+	mappingTableMu.Lock()
+	mappingTable = map[int]*Mapping{9302: m}
+	mappingTableMu.Unlock()
+
+	// 隧道未在等待时间内恢复，用户被放弃
+	start := time.Now()
+	if _, ok := waitForMember(9302, m, "192.0.2.1"); ok {
+		t.Fatal("expected hold to expire while the tunnel stays offline")
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond || waited > time.Second {
+		t.Errorf("expected to wait about the hold timeout, waited %s", waited)
+	}
+
+	// 等待期间隧道恢复，用户被转发
+	m.HoldTimeout = 5 * time.Second
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		mappingTableMu.Lock()
+		mem.Offline = false
+		m.notify()
+		mappingTableMu.Unlock()
+	}()
+	got, ok := waitForMember(9302, m, "192.0.2.1")
+	if !ok || got != mem {
+		t.Fatal("expected the held user to get the member once it is back online")
+	}
+	doneWithMember(got)
+}
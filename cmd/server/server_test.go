@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"gotunnel/pkg/protocol"
 	"io"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -58,6 +62,178 @@ func TestLoadServerConfig_WithViper(t *testing.T) {
 	}
 }
 
+func TestLoadServerConfig_DrainTimeout(t *testing.T) {
+	viper.Reset()
+	if conf := loadServerConfig(); conf.DrainTimeout != 30*time.Second {
+		t.Errorf("expected default drain timeout 30s, got %v", conf.DrainTimeout)
+	}
+	viper.Set("server.drain_timeout", 5)
+	if conf := loadServerConfig(); conf.DrainTimeout != 5*time.Second {
+		t.Errorf("expected drain timeout 5s, got %v", conf.DrainTimeout)
+	}
+}
+
+func TestLoadServerConfig_SessionGrace(t *testing.T) {
+	viper.Reset()
+	if conf := loadServerConfig(); conf.SessionGrace != 30*time.Second {
+		t.Errorf("expected default session grace 30s, got %v", conf.SessionGrace)
+	}
+	viper.Set("server.session_grace", 0)
+	if conf := loadServerConfig(); conf.SessionGrace != 0 {
+		t.Errorf("expected session grace disabled, got %v", conf.SessionGrace)
+	}
+}
+
+func TestLoadServerConfig_Heartbeat(t *testing.T) {
+	viper.Reset()
+	conf := loadServerConfig()
+	if conf.HeartbeatTimeout != 30*time.Second || conf.HeartbeatCheckInterval != 5*time.Second {
+		t.Errorf("unexpected heartbeat defaults %v/%v", conf.HeartbeatTimeout, conf.HeartbeatCheckInterval)
+	}
+	viper.Set("server.heartbeat_timeout", 90)
+	viper.Set("server.heartbeat_check_interval", 10)
+	conf = loadServerConfig()
+	if conf.HeartbeatTimeout != 90*time.Second || conf.HeartbeatCheckInterval != 10*time.Second {
+		t.Errorf("unexpected heartbeat settings %v/%v", conf.HeartbeatTimeout, conf.HeartbeatCheckInterval)
+	}
+	// 检查间隔不小于超时时，改为超时的一半
+	viper.Set("server.heartbeat_check_interval", 120)
+	if conf := loadServerConfig(); conf.HeartbeatCheckInterval != 45*time.Second || conf.hbCheckTooLong != 120*time.Second {
+		t.Errorf("expected check interval clamped to 45s and the configured 120s kept for the warning, got %v/%v",
+			conf.HeartbeatCheckInterval, conf.hbCheckTooLong)
+	}
+	viper.Reset()
+}
+
+func TestHandleControlConn_AdvertisesHeartbeatTimeout(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+	defer func() { heartbeatTimeout = 30 * time.Second }()
+	heartbeatTimeout = 45 * time.Second
+
+	resp := registerOnce(t, protocol.RegisterRequest{Type: "register", LocalPort: 22, Token: "test-token", HeartbeatInterval: 40})
+	if resp.Status != "ok" || resp.HeartbeatTimeout != 45 {
+		t.Errorf("expected heartbeat timeout 45 in response, got %+v", resp)
+	}
+}
+
+func TestDrainServer(t *testing.T) {
+	defer func() {
+		mappingTableMu.Lock()
+		draining = false
+		mappingTableMu.Unlock()
+	}()
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	out := &bytes.Buffer{}
+	clientConn := &mockConn{Reader: &bytes.Buffer{}, Writer: out}
+	listenDone := make(chan struct{})
+	mappingTable[8080] = &Mapping{
+		ListenDone: listenDone,
+		Members:    []*Member{{ClientConn: clientConn, LocalPort: 22}},
+	}
+	mappingTableMu.Unlock()
+
+	// 一条活跃转发在排空期间自行结束
+	untrack := relayTracker.Track(&mockConn{}, &mockConn{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		untrack()
+	}()
+
+	drainServer(time.Second)
+
+	select {
+	case <-listenDone:
+	default:
+		t.Error("expected public listener to be stopped")
+	}
+	packet, err := protocol.ReadPacket(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var goAway protocol.GoAway
+	if err := json.Unmarshal(packet, &goAway); err != nil || goAway.Type != "goaway" {
+		t.Errorf("expected goaway message, got %s", packet)
+	}
+	if !clientConn.closed {
+		t.Error("expected control connection to be closed after drain")
+	}
+	if relayTracker.Active() != 0 {
+		t.Error("expected all relays drained")
+	}
+	mappingTableMu.Lock()
+	if len(mappingTable) != 0 {
+		t.Error("expected mapping table to be cleared")
+	}
+	mappingTableMu.Unlock()
+
+	// 控制端口在排空期间仍接受数据通道，但不再接受新的注册
+	if resp := registerOnce(t, protocol.RegisterRequest{Type: "register", LocalPort: 22, Token: "test-token"}); resp.Status != "fail" {
+		t.Errorf("expected registration refused while draining, got %+v", resp)
+	}
+}
+
+func TestDrainServer_WaitsForPendingUser(t *testing.T) {
+	defer func() {
+		mappingTableMu.Lock()
+		draining = false
+		mappingTableMu.Unlock()
+	}()
+	var answer atomic.Bool
+	mem := &Member{Name: "web", LocalPort: 3000, ClientConn: fakeTunnelClient(t, 9403, &answer)}
+	mappingTableMu.Lock()
+	mappingTable = map[int]*Mapping{9403: {Members: []*Member{mem}}}
+	mappingTableMu.Unlock()
+
+	user, userPeer := net.Pipe()
+	defer user.Close()
+	go forwardUserFrom(9403, userPeer, "192.0.2.8")
+	go io.WriteString(user, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		pendingDataChannelsMu.Lock()
+		waiting := false
+		for _, p := range pendingDataChannels {
+			waiting = waiting || p.port == 9403
+		}
+		pendingDataChannelsMu.Unlock()
+		if waiting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("user never asked for a data channel")
+		}
+	}
+
+	// 用户已接入但数据通道尚未到达，排空要等它转发结束，而不是立即返回
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		drainServer(2 * time.Second)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-drained:
+		t.Fatal("drain returned while a user was waiting for its data channel")
+	default:
+	}
+	data, dataPeer := net.Pipe()
+	if !deliverDataChannel("", 9403, dataPeer) {
+		t.Fatal("expected the pending user to take the data channel during the drain")
+	}
+	go func() {
+		defer data.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(data)); err == nil {
+			io.WriteString(data, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+		}
+	}()
+	if resp, _ := io.ReadAll(user); !bytes.HasSuffix(resp, []byte("ok")) {
+		t.Errorf("expected the user served during the drain, got %q", resp)
+	}
+	<-drained
+}
+
 func TestCheckClientHeartbeat(t *testing.T) {
 	// 清理映射表
 	mappingTableMu.Lock()
@@ -69,11 +245,12 @@ func TestCheckClientHeartbeat(t *testing.T) {
 	conn := &mockConn{Reader: &buf, Writer: &buf}
 	mappingTableMu.Lock()
 	mappingTable[8080] = &Mapping{
-		ClientConn:    conn,
-		LocalPort:     22,
-		LastHeartbeat: time.Now().Add(-40 * time.Second), // 40秒前，超过30秒超时
-		ListenDone:    make(chan struct{}),
-		DataChan:      make(chan net.Conn, 10),
+		ListenDone: make(chan struct{}),
+		Members: []*Member{{
+			ClientConn:    conn,
+			LocalPort:     22,
+			LastHeartbeat: time.Now().Add(-40 * time.Second), // 40秒前，超过30秒超时
+		}},
 	}
 	mappingTableMu.Unlock()
 
@@ -97,11 +274,12 @@ func TestCheckClientHeartbeat_NoTimeout(t *testing.T) {
 	conn := &mockConn{Reader: &buf, Writer: &buf}
 	mappingTableMu.Lock()
 	mappingTable[8080] = &Mapping{
-		ClientConn:    conn,
-		LocalPort:     22,
-		LastHeartbeat: time.Now(), // 刚刚更新
-		ListenDone:    make(chan struct{}),
-		DataChan:      make(chan net.Conn, 10),
+		ListenDone: make(chan struct{}),
+		Members: []*Member{{
+			ClientConn:    conn,
+			LocalPort:     22,
+			LastHeartbeat: time.Now(), // 刚刚更新
+		}},
 	}
 	mappingTableMu.Unlock()
 
@@ -132,8 +310,12 @@ func TestHandleControlConn_AuthFail(t *testing.T) {
 	b, _ := json.Marshal(req)
 	protocol.WritePacket(&wbuf, b)
 	conn := &mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: &bytes.Buffer{}}
+	failures := serverMetrics.authFailures.With("control").Value()
 	handleControlConn(conn, "correct-token")
-	// 应该拒绝并返回
+	// 应该拒绝并返回，并计入认证失败
+	if got := serverMetrics.authFailures.With("control").Value() - failures; got != 1 {
+		t.Errorf("expected 1 auth failure counted, got %v", got)
+	}
 }
 
 func TestHandleControlConn_RegisterSuccess(t *testing.T) {
@@ -153,7 +335,7 @@ func TestHandleControlConn_RegisterSuccess(t *testing.T) {
 	b, _ := json.Marshal(req)
 	protocol.WritePacket(&wbuf, b)
 	// 添加一个ping消息来测试心跳处理
-	ping := protocol.HeartbeatPing{Type: "ping", Time: time.Now().Unix()}
+	ping := protocol.HeartbeatPing{Type: "ping", Time: time.Now().UnixNano()}
 	pingBytes, _ := json.Marshal(ping)
 	protocol.WritePacket(&wbuf, pingBytes)
 	// 添加一个错误来结束循环
@@ -180,6 +362,51 @@ func TestHandleControlConn_RegisterSuccess(t *testing.T) {
 	mappingTableMu.Unlock()
 }
 
+func TestHandleControlConn_PingRTT(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+
+	var wbuf bytes.Buffer
+	b, _ := json.Marshal(protocol.RegisterRequest{Type: "register", LocalPort: 22, Token: "test-token", SessionID: "sess-rtt"})
+	protocol.WritePacket(&wbuf, b)
+	sent := time.Now().UnixNano()
+	rtt := &protocol.RTTStats{Samples: 2, Last: 3 * time.Millisecond, Min: 2 * time.Millisecond, Avg: 3 * time.Millisecond, Max: 4 * time.Millisecond}
+	b, _ = json.Marshal(protocol.HeartbeatPing{Type: "ping", Time: sent, RTT: rtt})
+	protocol.WritePacket(&wbuf, b)
+	out := &bytes.Buffer{}
+	handleControlConn(&mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: out}, "test-token")
+
+	respBytes, _ := protocol.ReadPacket(out)
+	var resp protocol.RegisterResponse
+	_ = json.Unmarshal(respBytes, &resp)
+	pongBytes, err := protocol.ReadPacket(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pong protocol.HeartbeatPong
+	_ = json.Unmarshal(pongBytes, &pong)
+	if pong.Type != "pong" || pong.Time != sent {
+		t.Errorf("pong should echo the ping time %d, got %+v", sent, pong)
+	}
+
+	// 会话保留期内映射仍在，可读取客户端上报的时延
+	mappingTableMu.Lock()
+	m := mappingTable[resp.RemotePort]
+	mappingTableMu.Unlock()
+	if m == nil {
+		t.Fatal("expected mapping to be kept within session grace")
+	}
+	mem := m.Members[0]
+	defer expireSession(resp.RemotePort, m, mem)
+	mappingTableMu.Lock()
+	got := mem.RTT
+	mappingTableMu.Unlock()
+	if got != *rtt {
+		t.Errorf("expected reported rtt %+v, got %+v", *rtt, got)
+	}
+}
+
 func TestHandleControlConn_OfflinePort(t *testing.T) {
 	// 清理映射表
 	mappingTableMu.Lock()
@@ -187,11 +414,8 @@ func TestHandleControlConn_OfflinePort(t *testing.T) {
 	var buf bytes.Buffer
 	conn := &mockConn{Reader: &buf, Writer: &buf}
 	mappingTable[8080] = &Mapping{
-		ClientConn:    conn,
-		LocalPort:     22,
-		LastHeartbeat: time.Now(),
-		ListenDone:    make(chan struct{}),
-		DataChan:      make(chan net.Conn, 10),
+		ListenDone: make(chan struct{}),
+		Members:    []*Member{{ClientConn: conn, LocalPort: 22, LastHeartbeat: time.Now()}},
 	}
 	mappingTableMu.Unlock()
 
@@ -271,6 +495,265 @@ func TestHandleControlConn_OnlinePort(t *testing.T) {
 	}
 }
 
+func TestHandleControlConn_Unregister(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	// 控制通道由管道驱动，先只写入注册请求
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	conn := &mockConn{Reader: pr, Writer: &bytes.Buffer{}}
+	go handleControlConn(conn, "test-token")
+	req := protocol.RegisterRequest{Type: "register", LocalPort: 22, RemotePort: port, Token: "test-token", Name: "test-client"}
+	b, _ := json.Marshal(req)
+	go protocol.WritePacket(pw, b)
+
+	// 等待映射建立并开始监听，否则映射不存在的断言没有意义
+	var m *Mapping
+	deadline := time.Now().Add(2 * time.Second)
+	for m == nil && time.Now().Before(deadline) {
+		mappingTableMu.Lock()
+		if cur, exists := mappingTable[port]; exists && isListening(cur) {
+			m = cur
+		}
+		mappingTableMu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m == nil || !waitPort(port, false) {
+		t.Fatal("expected the mapping to be registered and listening")
+	}
+
+	unreg, _ := json.Marshal(protocol.UnregisterRequest{Type: "unregister", Port: port})
+	go protocol.WritePacket(pw, unreg)
+
+	deadline = time.Now().Add(2 * time.Second)
+	released := false
+	for !released && time.Now().Before(deadline) {
+		mappingTableMu.Lock()
+		_, exists := mappingTable[port]
+		released = !exists && !isListening(m)
+		mappingTableMu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !released {
+		t.Fatal("expected mapping to be released after unregister")
+	}
+	if !waitPort(port, true) {
+		t.Error("expected the public listener to be closed after unregister")
+	}
+}
+
+// waitPort 等待端口变为可绑定（free 为 true，公网监听已关闭）或被占用（公网监听已打开）
+func waitPort(port int, free bool) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			ln.Close()
+		}
+		if (err == nil) == free {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+// registerOnce 发送一次注册请求，读完后控制通道随即断开，返回注册响应
+func registerOnce(t *testing.T, req protocol.RegisterRequest) protocol.RegisterResponse {
+	t.Helper()
+	var wbuf bytes.Buffer
+	b, _ := json.Marshal(req)
+	protocol.WritePacket(&wbuf, b)
+	out := &bytes.Buffer{}
+	handleControlConn(&mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: out}, "test-token")
+	respBytes, err := protocol.ReadPacket(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp protocol.RegisterResponse
+	_ = json.Unmarshal(respBytes, &resp)
+	return resp
+}
+
+func TestSessionResume(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+	defer func() { sessionGrace = 30 * time.Second }()
+	sessionGrace = time.Second
+
+	req := protocol.RegisterRequest{Type: "register", LocalPort: 22, Token: "test-token", Name: "c", SessionID: "sess-1"}
+	first := registerOnce(t, req)
+	if first.Status != "ok" || first.Resumed {
+		t.Fatalf("unexpected first registration %+v", first)
+	}
+
+	// 控制通道断开后映射进入detached状态，公网监听保留
+	mappingTableMu.Lock()
+	m, exists := mappingTable[first.RemotePort]
+	detached := exists && m.Members[0].Detached
+	mappingTableMu.Unlock()
+	if !detached {
+		t.Fatal("expected mapping to be kept detached within session grace")
+	}
+
+	// 排队等待的用户应在会话恢复后拿到新的控制通道
+	got := make(chan net.Conn, 1)
+	go func() {
+		mem, ok := waitForMember(first.RemotePort, m, "192.0.2.1")
+		if !ok {
+			got <- nil
+			return
+		}
+		mappingTableMu.Lock()
+		got <- mem.ClientConn
+		mappingTableMu.Unlock()
+		doneWithMember(mem)
+	}()
+
+	// 同一会话重连（remote_port 为0），应恢复原端口
+	var wbuf bytes.Buffer
+	b, _ := json.Marshal(req)
+	protocol.WritePacket(&wbuf, b)
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() { pw.Write(wbuf.Bytes()) }()
+	outR, outW := io.Pipe()
+	defer outR.Close()
+	conn2 := &mockConn{Reader: pr, Writer: outW}
+	exited := make(chan struct{})
+	go func() {
+		handleControlConn(conn2, "test-token")
+		close(exited)
+	}()
+	respBytes, err := protocol.ReadPacket(outR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp protocol.RegisterResponse
+	_ = json.Unmarshal(respBytes, &resp)
+	if !resp.Resumed || resp.RemotePort != first.RemotePort {
+		t.Errorf("expected resumed response on port %d, got %+v", first.RemotePort, resp)
+	}
+
+	select {
+	case c := <-got:
+		if c != conn2 {
+			t.Error("queued user should be handed the resumed control connection")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("queued user was not released on resume")
+	}
+	mappingTableMu.Lock()
+	m2 := mappingTable[first.RemotePort]
+	mappingTableMu.Unlock()
+	if m2 != m || len(m2.Members) != 1 || m2.Members[0].Detached {
+		t.Error("expected the same mapping to be resumed and attached")
+	}
+	pw.Close()
+	<-exited
+}
+
+func TestSessionExpire(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+	defer func() { sessionGrace = 30 * time.Second }()
+	sessionGrace = 50 * time.Millisecond
+
+	resp := registerOnce(t, protocol.RegisterRequest{Type: "register", LocalPort: 22, Token: "test-token", SessionID: "sess-2"})
+	mappingTableMu.Lock()
+	m := mappingTable[resp.RemotePort]
+	mappingTableMu.Unlock()
+
+	if _, ok := waitForMember(resp.RemotePort, m, "192.0.2.1"); ok {
+		t.Error("expected queued user to be rejected once the session expires")
+	}
+	mappingTableMu.Lock()
+	_, exists := mappingTable[resp.RemotePort]
+	mappingTableMu.Unlock()
+	if exists {
+		t.Error("expected mapping to be released after session grace")
+	}
+}
+
+func TestAllocateRemotePort(t *testing.T) {
+	mappingTableMu.Lock()
+	defer mappingTableMu.Unlock()
+	mappingTable = make(map[int]*Mapping)
+	defer func() { remotePortPool = protocol.PortRange{} }()
+
+	// 显式端口保持原样
+	port, err := allocateRemotePort(protocol.RegisterRequest{RemotePort: 10022}, "")
+	if err != nil || port != 10022 {
+		t.Fatalf("expected 10022, got %d err=%v", port, err)
+	}
+
+	// 未配置端口池时由系统分配
+	port, err = allocateRemotePort(protocol.RegisterRequest{}, "")
+	if err != nil || port == 0 {
+		t.Fatalf("expected OS assigned port, got %d err=%v", port, err)
+	}
+
+	// 客户端范围与端口池取交集，跳过已占用端口
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	remotePortPool = protocol.PortRange{Min: base, Max: base + 5}
+	mappingTable[base] = &Mapping{}
+	port, err = allocateRemotePort(protocol.RegisterRequest{PortRange: fmt.Sprintf("%d-%d", base-10, base+1)}, "")
+	if err != nil || port != base+1 {
+		t.Fatalf("expected %d, got %d err=%v", base+1, port, err)
+	}
+
+	// 与端口池不相交时拒绝
+	if _, err := allocateRemotePort(protocol.RegisterRequest{PortRange: "1-2"}, ""); err == nil {
+		t.Error("expected error for range outside pool")
+	}
+}
+
+func TestHandleControlConn_AssignedPort(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+
+	var wbuf bytes.Buffer
+	req := protocol.RegisterRequest{Type: "register", LocalPort: 22, Token: "test-token", Name: "test-client"}
+	b, _ := json.Marshal(req)
+	protocol.WritePacket(&wbuf, b)
+
+	out := &bytes.Buffer{}
+	conn := &mockConn{Reader: bytes.NewReader(wbuf.Bytes()), Writer: out}
+	publicHost = "203.0.113.10"
+	defer func() { publicHost = "" }()
+	handleControlConn(conn, "test-token")
+
+	respBytes, err := protocol.ReadPacket(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp protocol.RegisterResponse
+	_ = json.Unmarshal(respBytes, &resp)
+	if resp.Status != "ok" || resp.RemotePort == 0 {
+		t.Fatalf("expected assigned port, got %+v", resp)
+	}
+	if want := net.JoinHostPort("203.0.113.10", fmt.Sprint(resp.RemotePort)); resp.PublicAddr != want {
+		t.Errorf("expected public addr %s, got %s", want, resp.PublicAddr)
+	}
+}
+
 func TestListenAndForwardWithStop(t *testing.T) {
 	// 找一个可用端口
 	ln, err := net.Listen("tcp", ":0")
@@ -280,13 +763,11 @@ func TestListenAndForwardWithStop(t *testing.T) {
 	addr := ln.Addr().(*net.TCPAddr)
 	ln.Close()
 
-	var buf bytes.Buffer
-	clientConn := &mockConn{Reader: &buf, Writer: &buf}
 	stop := make(chan struct{})
 
 	done := make(chan struct{})
 	go func() {
-		listenAndForwardWithStop(addr.Port, clientConn, 22, stop)
+		listenAndForwardWithStop(addr.Port, "", stop)
 		close(done)
 	}()
 
@@ -307,11 +788,9 @@ func TestListenAndForwardWithStop(t *testing.T) {
 func TestListenAndForwardWithStop_ListenError(t *testing.T) {
 	// 使用一个无效的端口（可能需要root权限的端口，或者已经被占用的端口）
 	// 这里我们使用一个可能无效的端口号
-	var buf bytes.Buffer
-	clientConn := &mockConn{Reader: &buf, Writer: &buf}
 	stop := make(chan struct{})
 	// 使用一个非常大的端口号，可能会失败
-	listenAndForwardWithStop(999999, clientConn, 22, stop)
+	listenAndForwardWithStop(999999, "", stop)
 	// 应该正常返回，不panic
 }
 
@@ -324,13 +803,11 @@ func TestListenAndForwardWithStop_AcceptConnection(t *testing.T) {
 	addr := ln.Addr().(*net.TCPAddr)
 	ln.Close()
 
-	var buf bytes.Buffer
-	clientConn := &mockConn{Reader: &buf, Writer: &buf}
 	stop := make(chan struct{})
 
 	done := make(chan struct{})
 	go func() {
-		listenAndForwardWithStop(addr.Port, clientConn, 22, stop)
+		listenAndForwardWithStop(addr.Port, "", stop)
 		close(done)
 	}()
 
@@ -356,3 +833,58 @@ func TestListenAndForwardWithStop_AcceptConnection(t *testing.T) {
 		t.Error("listenAndForwardWithStop should complete after stop")
 	}
 }
+
+func TestHandleControlConn_HealthReport(t *testing.T) {
+	mappingTableMu.Lock()
+	mappingTable = make(map[int]*Mapping)
+	mappingTableMu.Unlock()
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleControlConn(&mockConn{Reader: inR, Writer: outW}, "test-token")
+		close(done)
+	}()
+	defer func() {
+		inW.Close()
+		<-done
+		outR.Close()
+	}()
+	b, _ := json.Marshal(protocol.RegisterRequest{Type: "register", LocalPort: 22, RemotePort: 0, Token: "test-token", Name: "web"})
+	go protocol.WritePacket(inW, b)
+	respBytes, err := protocol.ReadPacket(outR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp protocol.RegisterResponse
+	_ = json.Unmarshal(respBytes, &resp)
+	go io.Copy(io.Discard, outR)
+
+	// 客户端上报的健康详情按成员保存，便于查看隧道下线原因
+	report := protocol.HealthReport{Type: "health_report", Port: resp.RemotePort, Status: "down", Checker: "http", Backends: []protocol.BackendHealth{
+		{Addr: "127.0.0.1:8080", Status: "down", Error: "status 502", Latency: 3 * time.Millisecond, Failures: 4},
+	}}
+	b, _ = json.Marshal(report)
+	if err := protocol.WritePacket(inW, b); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mappingTableMu.Lock()
+		var got *protocol.HealthReport
+		if m := mappingTable[resp.RemotePort]; m != nil && len(m.Members) == 1 {
+			got = m.Members[0].Health
+		}
+		mappingTableMu.Unlock()
+		if got != nil {
+			if got.Status != "down" || len(got.Backends) != 1 || got.Backends[0].Error != "status 502" || got.Backends[0].Failures != 4 {
+				t.Errorf("unexpected stored report %+v", got)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("health report was not stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,241 @@
+// gotunnel dashboard: polls the admin API and renders it. No build step, no dependencies.
+"use strict";
+
+const POLL_MS = 5000;
+const HISTORY = 60; // Traffic points kept per port, 5 minutes at POLL_MS
+const COLORS = ["#0969da", "#1a7f37", "#cf222e", "#8250df", "#bf8700", "#1b7c83", "#bc4c00", "#57606a"];
+
+const $ = (id) => document.getElementById(id);
+let timer = null;
+let last = null;     // Previous /api/mappings sample, for byte rates
+let history = {};    // Port to [{in, out}] bytes per second
+
+function esc(v) {
+  return String(v ?? "").replace(/[&<>"']/g, (c) => ({ "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;" }[c]));
+}
+
+function bytes(n) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return (i ? n.toFixed(1) : n) + " " + units[i];
+}
+
+function ago(t) {
+  if (!t || t.startsWith("0001")) return "-";
+  const s = Math.max(0, Math.round((Date.now() - new Date(t)) / 1000));
+  if (s < 60) return s + "s ago";
+  if (s < 3600) return Math.floor(s / 60) + "m ago";
+  if (s < 86400) return Math.floor(s / 3600) + "h ago";
+  return Math.floor(s / 86400) + "d ago";
+}
+
+async function api(method, path) {
+  const resp = await fetch(path, { method, headers: { "X-Requested-With": "gotunnel" } });
+  if (resp.status === 401) {
+    showLogin();
+    throw new Error("unauthorized");
+  }
+  const body = await resp.json();
+  if (!resp.ok) throw new Error(body.error || resp.statusText);
+  return body;
+}
+
+function showLogin() {
+  clearInterval(timer);
+  timer = null;
+  $("dashboard").hidden = true;
+  $("login").hidden = false;
+}
+
+function showDashboard() {
+  $("login").hidden = true;
+  $("dashboard").hidden = false;
+  if (!timer) {
+    refresh();
+    timer = setInterval(refresh, POLL_MS);
+  }
+}
+
+async function refresh() {
+  try {
+    const [mappings, conns, users] = await Promise.all([
+      api("GET", "/api/mappings"), api("GET", "/api/connections"), api("GET", "/api/users"),
+    ]);
+    sample(mappings);
+    renderMappings(mappings);
+    renderClients(mappings.flatMap((m) => m.members));
+    renderUsers(users.slice(0, 20));
+    renderConnections(conns);
+    drawTraffic();
+    $("message").textContent = "";
+  } catch (err) {
+    if (err.message !== "unauthorized") $("message").textContent = err.message;
+  }
+}
+
+function sample(mappings) {
+  const now = Date.now();
+  const current = {};
+  for (const m of mappings) current[m.port] = m;
+  if (last) {
+    const secs = (now - last.time) / 1000;
+    for (const m of mappings) {
+      const prev = last.ports[m.port];
+      const rate = prev
+        ? { in: Math.max(0, m.bytes_in - prev.bytes_in) / secs, out: Math.max(0, m.bytes_out - prev.bytes_out) / secs }
+        : { in: 0, out: 0 };
+      const points = (history[m.port] ||= []);
+      points.push(rate);
+      if (points.length > HISTORY) points.shift();
+    }
+  }
+  for (const port of Object.keys(history)) {
+    if (!current[port]) delete history[port];
+  }
+  last = { time: now, ports: current };
+}
+
+function drawTraffic() {
+  const canvas = $("traffic");
+  const ctx = canvas.getContext("2d");
+  const w = canvas.width, h = canvas.height, pad = 4;
+  ctx.clearRect(0, 0, w, h);
+  const ports = Object.keys(history);
+  let max = 1;
+  for (const port of ports) for (const p of history[port]) max = Math.max(max, p.in + p.out);
+  const legend = [];
+  ports.forEach((port, i) => {
+    const color = COLORS[i % COLORS.length];
+    const points = history[port];
+    ctx.strokeStyle = color;
+    ctx.lineWidth = 2;
+    ctx.beginPath();
+    points.forEach((p, j) => {
+      const x = w - (points.length - 1 - j) * (w / (HISTORY - 1));
+      const y = h - pad - ((p.in + p.out) / max) * (h - 2 * pad);
+      j ? ctx.lineTo(x, y) : ctx.moveTo(x, y);
+    });
+    ctx.stroke();
+    const now = points[points.length - 1] || { in: 0, out: 0 };
+    legend.push(`<span><i style="background:${color}"></i>${esc(port)}: ${bytes(now.in)}/s in, ${bytes(now.out)}/s out</span>`);
+  });
+  ctx.fillStyle = "#6e7781";
+  ctx.fillText("peak " + bytes(max) + "/s", 6, 14);
+  $("legend").innerHTML = legend.join("");
+}
+
+function mappingState(m) {
+  if (m.disabled) return '<span class="down">disabled</span>';
+  if (m.listening) return '<span class="up">listening</span>';
+  return '<span class="muted">closed</span>';
+}
+
+function renderMappings(mappings) {
+  $("summary").textContent = `${mappings.length} mappings`;
+  $("mappings").innerHTML = mappings.map((m) => `<tr>
+    <td>${esc(m.bind_addr ? m.bind_addr + ":" : "")}${m.port}</td>
+    <td>${esc(m.group || "-")}${m.policy && m.group ? ` <span class="muted">(${esc(m.policy)})</span>` : ""}</td>
+    <td>${esc(m.protocol || "tcp")}${m.keep_open ? ' <span class="muted">keep open</span>' : ""}</td>
+    <td>${mappingState(m)}</td>
+    <td class="num">${m.active_conns}</td>
+    <td class="num">${bytes(m.bytes_in)}</td>
+    <td class="num">${bytes(m.bytes_out)}</td>
+    <td><button data-port="${m.port}" data-action="${m.disabled ? "enable" : "disable"}">${m.disabled ? "Enable" : "Disable"}</button></td>
+  </tr>`).join("");
+}
+
+function clientHealth(c) {
+  if (c.detached) return '<span class="muted">reconnecting</span>';
+  if (c.offline) return '<span class="down">offline</span>';
+  if (c.unhealthy) return `<span class="down" title="${esc(c.check_error)}">check failing</span>`;
+  const down = (c.backends || []).filter((b) => b.status !== "up");
+  if (c.health === "down" || down.length) {
+    const title = down.map((b) => `${b.addr}: ${b.error}`).join("\n");
+    return `<span class="down" title="${esc(title)}">${c.health === "down" ? "down" : "degraded"}</span>`;
+  }
+  return '<span class="up">up</span>';
+}
+
+function renderClients(clients) {
+  $("summary").textContent += `, ${clients.length} clients`;
+  $("clients").innerHTML = clients.map((c) => `<tr>
+    <td>${esc(c.name)}${c.backup_for ? ` <span class="muted">backup for ${esc(c.backup_for)}</span>` : ""}</td>
+    <td>${c.remote_port}</td>
+    <td>${c.local_port}</td>
+    <td>${esc(c.remote_addr || "-")}</td>
+    <td>${ago(c.connected_since)}</td>
+    <td>${ago(c.last_heartbeat)}</td>
+    <td>${clientHealth(c)}</td>
+    <td class="num">${c.active_conns}</td>
+    <td class="num">${bytes(c.bytes_in)}</td>
+    <td class="num">${bytes(c.bytes_out)}</td>
+    <td><button data-kick="${esc(c.id)}">Kick</button></td>
+  </tr>`).join("");
+}
+
+function renderUsers(users) {
+  $("users").innerHTML = users.map((u) => `<tr>
+    <td>${esc(u.client_ip)}</td>
+    <td class="num">${u.connections}</td>
+    <td>${ago(u.last_seen)}</td>
+    <td class="num">${bytes(u.bytes_in)}</td>
+    <td class="num">${bytes(u.bytes_out)}</td>
+  </tr>`).join("");
+}
+
+function renderConnections(conns) {
+  $("connections").innerHTML = conns.map((c) => `<tr>
+    <td>${new Date(c.time).toLocaleTimeString()}</td>
+    <td>${c.port}</td>
+    <td>${esc(c.client_ip)}</td>
+    <td>${esc(c.client || "-")}</td>
+    <td class="num">${(c.duration_ms / 1000).toFixed(1)}s</td>
+    <td class="num">${bytes(c.bytes_in)}</td>
+    <td class="num">${bytes(c.bytes_out)}</td>
+    <td class="down">${esc(c.error || "")}</td>
+  </tr>`).join("");
+}
+
+async function act(method, path, confirmText) {
+  if (confirmText && !confirm(confirmText)) return;
+  try {
+    await api(method, path);
+    refresh();
+  } catch (err) {
+    if (err.message !== "unauthorized") $("message").textContent = err.message;
+  }
+}
+
+document.addEventListener("click", (e) => {
+  const t = e.target;
+  if (t.dataset.kick) act("POST", `/api/clients/${encodeURIComponent(t.dataset.kick)}/kick`, "Disconnect this client?");
+  if (t.dataset.port) act("POST", `/api/mappings/${t.dataset.port}/${t.dataset.action}`, t.dataset.action === "disable" ? `Close port ${t.dataset.port}?` : "");
+});
+
+$("reload").addEventListener("click", () => act("POST", "/api/reload", "Reload the server configuration?"));
+
+$("logout").addEventListener("click", async () => {
+  await fetch("/logout", { method: "POST" });
+  showLogin();
+});
+
+$("login-form").addEventListener("submit", async (e) => {
+  e.preventDefault();
+  const form = new FormData(e.target);
+  const resp = await fetch("/login", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ username: form.get("username"), password: form.get("password") }),
+  });
+  if (!resp.ok) {
+    $("login-error").textContent = resp.status === 429 ? "Too many failed attempts, try again later" : "Invalid username or password";
+    return;
+  }
+  $("login-error").textContent = "";
+  e.target.reset();
+  showDashboard();
+});
+
+// A session cookie from an earlier login may still be valid
+api("GET", "/api/mappings").then(showDashboard, showLogin);
@@ -2,13 +2,16 @@ module gotunnel
 
 go 1.23.0
 
-require github.com/spf13/viper v1.21.0
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/nicksnyder/go-i18n/v2 v2.6.0
+	github.com/spf13/viper v1.21.0
+	golang.org/x/text v0.28.0
+)
 
 require (
-	github.com/BurntSushi/toml v1.5.0 // indirect
 	github.com/fsnotify/fsnotify v1.9.0 // indirect
 	github.com/go-viper/mapstructure/v2 v2.4.0 // indirect
-	github.com/nicksnyder/go-i18n/v2 v2.6.0 // indirect
 	github.com/pelletier/go-toml/v2 v2.2.4 // indirect
 	github.com/sagikazarmark/locafero v0.11.0 // indirect
 	github.com/sourcegraph/conc v0.3.1-0.20240121214520-5f936abd7ae8 // indirect
@@ -18,6 +21,5 @@ require (
 	github.com/subosito/gotenv v1.6.0 // indirect
 	go.yaml.in/yaml/v3 v3.0.4 // indirect
 	golang.org/x/sys v0.29.0 // indirect
-	golang.org/x/text v0.28.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
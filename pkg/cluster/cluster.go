@@ -0,0 +1,55 @@
+// Package cluster shares remote port ownership between gotunnel server nodes, so a user reaching
+// any node can be forwarded to the node the tunnel's client is connected to.
+package cluster
+
+import (
+	"fmt"
+	"time"
+)
+
+// Owner records which node serves a remote port. A claim is a lease: it must be renewed before
+// Expires, otherwise other nodes treat the port as free again.
+type Owner struct {
+	Port     int       `json:"port"`
+	Node     string    `json:"node"`                // ID of the owning node
+	PeerAddr string    `json:"peer_addr"`           // Control address other nodes forward users to
+	BindAddr string    `json:"bind_addr,omitempty"` // Address the port is public on, "" for all interfaces
+	Expires  time.Time `json:"expires"`
+}
+
+// Live reports whether the claim is still valid at now.
+func (o Owner) Live(now time.Time) bool {
+	return now.Before(o.Expires)
+}
+
+// Store is a state backend shared by the nodes of a cluster.
+type Store interface {
+	// Claim records o.Node as the owner of o.Port until o.Expires, renewing an existing claim by the
+	// same node. It returns a *ClaimedError if another node holds a live claim.
+	Claim(o Owner) error
+	// Release drops node's claim on port. A claim held by another node is left alone.
+	Release(port int, node string) error
+	// Owners returns every live claim.
+	Owners() ([]Owner, error)
+}
+
+// ClaimedError is returned by Claim when the port belongs to another node.
+type ClaimedError struct {
+	Owner Owner
+}
+
+func (e *ClaimedError) Error() string {
+	return fmt.Sprintf("port %d is served by node %s", e.Owner.Port, e.Owner.Node)
+}
+
+// Open returns the store for a configured backend: "memory" for a store private to this process,
+// "file" for a directory shared by the nodes.
+func Open(backend, path string) (Store, error) {
+	switch backend {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		return NewFileStore(path)
+	}
+	return nil, fmt.Errorf("unknown cluster store %q", backend)
+}
@@ -0,0 +1,140 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStores 返回同一份用例要覆盖的各种存储实现
+func testStores(t *testing.T) map[string]Store {
+	fs, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{"memory": NewMemoryStore(), "file": fs}
+}
+
+func TestStore_ClaimConflict(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			lease := time.Now().Add(time.Minute)
+			if err := s.Claim(Owner{Port: 20001, Node: "a", PeerAddr: "10.0.0.1:17000", Expires: lease}); err != nil {
+				t.Fatal(err)
+			}
+			// 同一节点续约成功，其他节点抢占失败
+			if err := s.Claim(Owner{Port: 20001, Node: "a", Expires: lease.Add(time.Minute)}); err != nil {
+				t.Errorf("renewal should succeed: %v", err)
+			}
+			err := s.Claim(Owner{Port: 20001, Node: "b", Expires: lease})
+			var claimed *ClaimedError
+			if !errors.As(err, &claimed) || claimed.Owner.Node != "a" {
+				t.Fatalf("expected ClaimedError naming node a, got %v", err)
+			}
+
+			// 其他节点无法释放不属于自己的端口
+			_ = s.Release(20001, "b")
+			owners, _ := s.Owners()
+			if len(owners) != 1 || owners[0].Node != "a" {
+				t.Fatalf("expected claim of node a to survive, got %+v", owners)
+			}
+			_ = s.Release(20001, "a")
+			if err := s.Claim(Owner{Port: 20001, Node: "b", Expires: lease}); err != nil {
+				t.Errorf("released port should be claimable: %v", err)
+			}
+		})
+	}
+}
+
+func TestStore_LeaseExpires(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// 过期的租约不再出现在列表中，并可被其他节点接管
+			past := time.Now().Add(-time.Second)
+			if err := s.Claim(Owner{Port: 20002, Node: "a", Expires: past}); err != nil {
+				t.Fatal(err)
+			}
+			if owners, _ := s.Owners(); len(owners) != 0 {
+				t.Errorf("expired claim should not be listed, got %+v", owners)
+			}
+			if err := s.Claim(Owner{Port: 20002, Node: "b", Expires: time.Now().Add(time.Minute)}); err != nil {
+				t.Errorf("expired claim should be taken over: %v", err)
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	if _, err := Open("memory", ""); err != nil {
+		t.Error(err)
+	}
+	if _, err := Open("file", ""); err == nil {
+		t.Error("file store without path should fail")
+	}
+	if _, err := Open("etcd", ""); err == nil {
+		t.Error("unknown backend should fail")
+	}
+}
+
+// writeLock 伪造其他节点持有的存储锁
+func writeLock(t *testing.T, dir string, expires time.Time) string {
+	lockDir := filepath.Join(dir, "claim.lock")
+	if err := os.Mkdir(lockDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(lockHolder{ID: "node-a", Expires: expires})
+	if err := os.WriteFile(filepath.Join(lockDir, "holder.json"), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// 目录的修改时间很早，不能再据此判断锁已失效
+	old := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(lockDir, old, old)
+	return lockDir
+}
+
+func TestFileStore_LockLease(t *testing.T) {
+	dir := t.TempDir()
+	lockDir := writeLock(t, dir, time.Now().Add(time.Minute))
+	// 租约未到期的锁即使很久未修改也不能被打破
+	breakExpired(lockDir)
+	if _, err := os.Stat(lockDir); err != nil {
+		t.Fatalf("live lock should be kept: %v", err)
+	}
+	_ = os.RemoveAll(lockDir)
+
+	writeLock(t, dir, time.Now().Add(-time.Second))
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Claim(Owner{Port: 20003, Node: "b", Expires: time.Now().Add(time.Minute)}); err != nil {
+		t.Fatalf("expired lock should be broken: %v", err)
+	}
+	if _, err := os.Stat(lockDir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock should be released after the claim, got %v", err)
+	}
+}
+
+func TestFileStore_LockRenewed(t *testing.T) {
+	s, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := s.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.unlock()
+	// 持有者写入自己的租约，其他节点据此等待
+	h, ok := readHolder(l.dir)
+	if !ok || h.ID != l.id || !h.Expires.After(time.Now()) {
+		t.Fatalf("expected a live lease for the holder, got %+v", h)
+	}
+	breakExpired(l.dir)
+	if !l.held() {
+		t.Error("a held lock with a live lease should not be broken")
+	}
+}
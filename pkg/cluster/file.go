@@ -0,0 +1,258 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lockLease is how long the store lock stays valid without its holder renewing it. Only a lock
+// whose lease ran out, left behind by a crashed or hung node, is broken by another node.
+const lockLease = 10 * time.Second
+
+// lockWait bounds how long Claim and Release wait for the store lock.
+const lockWait = 2 * lockLease
+
+// errLockLost is returned when the lease on the store lock ran out before the write.
+var errLockLost = errors.New("lost the cluster store lock")
+
+// FileStore keeps one JSON file per claimed port in a directory shared by the nodes, e.g. on NFS
+// or a volume mounted into every pod. Claims are serialised with a lock directory, since creating
+// a directory is atomic on every platform. The lock directory holds the holder's ID and lease,
+// renewed while the lock is held.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a FileStore in dir, creating the directory if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("file cluster store needs a path")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) portFile(port int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("port-%d.json", port))
+}
+
+// lockHolder is written into the lock directory by the node holding it.
+type lockHolder struct {
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+// fileLock is the store-wide lock held by this process.
+type fileLock struct {
+	dir  string
+	id   string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// lock acquires the store-wide lock. It waits while another node holds a live lease and breaks a
+// lock whose lease has expired.
+func (s *FileStore) lock() (*fileLock, error) {
+	l := &fileLock{dir: filepath.Join(s.dir, "claim.lock"), id: newHolderID()}
+	deadline := time.Now().Add(lockWait)
+	for {
+		err := os.Mkdir(l.dir, 0o755)
+		if err == nil {
+			if err := l.renew(); err != nil {
+				_ = os.RemoveAll(l.dir)
+				return nil, err
+			}
+			l.stop, l.done = make(chan struct{}), make(chan struct{})
+			go l.keepAlive()
+			return l, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		breakExpired(l.dir)
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for cluster store lock %s", l.dir)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newHolderID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// readHolder returns the holder recorded in a lock directory.
+func readHolder(dir string) (lockHolder, bool) {
+	b, err := os.ReadFile(filepath.Join(dir, "holder.json"))
+	if err != nil {
+		return lockHolder{}, false
+	}
+	var h lockHolder
+	if json.Unmarshal(b, &h) != nil {
+		return lockHolder{}, false
+	}
+	return h, true
+}
+
+// breakExpired removes the lock at dir if its holder's lease ran out. A lock without a holder
+// file is being created, or its creator crashed; it is judged by its age instead.
+func breakExpired(dir string) {
+	h, ok := readHolder(dir)
+	if !ok {
+		info, err := os.Stat(dir)
+		if err != nil || time.Since(info.ModTime()) <= lockLease {
+			return
+		}
+	} else if time.Now().Before(h.Expires) {
+		return
+	}
+	// Move the lock aside first, so only one node breaks it
+	grave := dir + "." + newHolderID()
+	if os.Rename(dir, grave) != nil {
+		return
+	}
+	if cur, _ := readHolder(grave); cur.ID != h.ID {
+		// Another node broke it and took the lock meanwhile, hand it back
+		_ = os.Rename(grave, dir)
+		return
+	}
+	_ = os.RemoveAll(grave)
+}
+
+// renew extends the lease in the lock directory.
+func (l *fileLock) renew() error {
+	b, _ := json.Marshal(lockHolder{ID: l.id, Expires: time.Now().Add(lockLease)})
+	tmp := filepath.Join(l.dir, "holder.json.tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(l.dir, "holder.json"))
+}
+
+// keepAlive renews the lease until the lock is released, so a slow holder keeps it.
+func (l *fileLock) keepAlive() {
+	defer close(l.done)
+	ticker := time.NewTicker(lockLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if !l.held() {
+				return
+			}
+			_ = l.renew()
+		}
+	}
+}
+
+// held reports whether the lock still belongs to this holder.
+func (l *fileLock) held() bool {
+	h, ok := readHolder(l.dir)
+	return ok && h.ID == l.id
+}
+
+// unlock releases the lock unless another node broke it after the lease ran out.
+func (l *fileLock) unlock() {
+	close(l.stop)
+	<-l.done
+	if l.held() {
+		_ = os.RemoveAll(l.dir)
+	}
+}
+
+func (s *FileStore) read(path string) (Owner, bool, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Owner{}, false, nil
+	}
+	if err != nil {
+		return Owner{}, false, err
+	}
+	var o Owner
+	if err := json.Unmarshal(b, &o); err != nil {
+		return Owner{}, false, err
+	}
+	return o, true, nil
+}
+
+// Claim implements Store.
+func (s *FileStore) Claim(o Owner) error {
+	l, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+	path := s.portFile(o.Port)
+	if cur, ok, err := s.read(path); err != nil {
+		return err
+	} else if ok && cur.Node != o.Node && cur.Live(time.Now()) {
+		return &ClaimedError{Owner: cur}
+	}
+	b, _ := json.Marshal(o)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	if !l.held() {
+		_ = os.Remove(tmp)
+		return errLockLost
+	}
+	// Rename replaces the file atomically, readers never see a partial claim
+	return os.Rename(tmp, path)
+}
+
+// Release implements Store.
+func (s *FileStore) Release(port int, node string) error {
+	l, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+	path := s.portFile(port)
+	cur, ok, err := s.read(path)
+	if err != nil || !ok || cur.Node != node {
+		return err
+	}
+	if !l.held() {
+		return errLockLost
+	}
+	return os.Remove(path)
+}
+
+// Owners implements Store.
+func (s *FileStore) Owners() ([]Owner, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var owners []Owner
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "port-") || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		o, ok, err := s.read(filepath.Join(s.dir, e.Name()))
+		if err != nil || !ok || !o.Live(now) {
+			// Expired or unreadable claims are skipped, the next Claim overwrites them
+			continue
+		}
+		owners = append(owners, o)
+	}
+	sort.Slice(owners, func(i, j int) bool { return owners[i].Port < owners[j].Port })
+	return owners, nil
+}
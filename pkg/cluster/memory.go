@@ -0,0 +1,57 @@
+package cluster
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps claims in memory. Nodes sharing one MemoryStore must run in the same process,
+// which makes it the store for tests and single-node setups.
+type MemoryStore struct {
+	mu     sync.Mutex
+	owners map[int]Owner
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{owners: make(map[int]Owner)}
+}
+
+// Claim implements Store.
+func (s *MemoryStore) Claim(o Owner) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur, ok := s.owners[o.Port]; ok && cur.Node != o.Node && cur.Live(time.Now()) {
+		return &ClaimedError{Owner: cur}
+	}
+	s.owners[o.Port] = o
+	return nil
+}
+
+// Release implements Store.
+func (s *MemoryStore) Release(port int, node string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur, ok := s.owners[port]; ok && cur.Node == node {
+		delete(s.owners, port)
+	}
+	return nil
+}
+
+// Owners implements Store.
+func (s *MemoryStore) Owners() ([]Owner, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	owners := make([]Owner, 0, len(s.owners))
+	for port, o := range s.owners {
+		if !o.Live(now) {
+			delete(s.owners, port)
+			continue
+		}
+		owners = append(owners, o)
+	}
+	sort.Slice(owners, func(i, j int) bool { return owners[i].Port < owners[j].Port })
+	return owners, nil
+}
@@ -3,17 +3,71 @@ package core
 import (
 	"io"
 	"net"
+	"time"
 )
 
+// RelayStats describes a finished relay.
+type RelayStats struct {
+	AToB     int64         // Bytes copied from a to b
+	BToA     int64         // Bytes copied from b to a
+	Duration time.Duration // Time from the start of the relay until both directions ended
+	ClosedBy string        // "a" or "b": the side whose stream ended first and so ended the relay
+}
+
+// Counter is told about bytes while a relay runs, so totals stay current on long-lived connections.
+type Counter interface {
+	Add(aToB, bToA int64)
+}
+
 // RelayConn implements full-duplex (bidirectional) byte stream forwarding between two TCP connections A and B, until either side closes.
-// This function blocks after being called until either connection is closed. Suitable for all full passthrough services like ssh/http.
-func RelayConn(a, b net.Conn) {
+// This function blocks after being called until both directions are done. Suitable for all full passthrough services like ssh/http.
+// The optional counters receive the bytes as they are copied; without counters the copies keep
+// their zero-copy fast paths.
+func RelayConn(a, b net.Conn, counters ...Counter) RelayStats {
+	start := time.Now()
+	ended := make(chan string, 2)
+	var aToB int64
+	aDone := make(chan struct{})
 	// a->b
 	go func() {
-		_, _ = io.Copy(b, a)
+		defer close(aDone)
+		aToB = relayCopy(b, a, counters, false)
+		ended <- "a"
 		_ = b.Close()
 	}()
 	// b->a
-	_, _ = io.Copy(a, b)
+	bToA := relayCopy(a, b, counters, true)
+	ended <- "b"
 	_ = a.Close()
+	<-aDone
+	return RelayStats{AToB: aToB, BToA: bToA, Duration: time.Since(start), ClosedBy: <-ended}
+}
+
+// relayCopy copies src to dst, reporting to counters as it goes, and returns the bytes copied.
+func relayCopy(dst, src net.Conn, counters []Counter, fromB bool) int64 {
+	var w io.Writer = dst
+	if len(counters) > 0 {
+		w = &countingWriter{w: dst, counters: counters, fromB: fromB}
+	}
+	n, _ := io.Copy(w, src)
+	return n
+}
+
+// countingWriter passes writes through and reports their size to counters.
+type countingWriter struct {
+	w        io.Writer
+	counters []Counter
+	fromB    bool // The bytes travel from b to a
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	for _, counter := range c.counters {
+		if c.fromB {
+			counter.Add(0, int64(n))
+		} else {
+			counter.Add(int64(n), 0)
+		}
+	}
+	return n, err
 }
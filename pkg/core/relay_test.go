@@ -127,3 +127,59 @@ func TestRelayConn_Simple(t *testing.T) {
 }
 
 // TestRelayConn_BothDirections 已移除，使用简单的单向测试已足够验证RelayConn功能
+
+// countingCounter 累计 RelayConn 实时上报的字节数
+type countingCounter struct {
+	mu         sync.Mutex
+	aToB, bToA int64
+}
+
+func (c *countingCounter) Add(aToB, bToA int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.aToB += aToB
+	c.bToA += bToA
+}
+
+func TestRelayConn_Stats(t *testing.T) {
+	user, a := net.Pipe()
+	b, peer := net.Pipe()
+	live := &countingCounter{}
+	done := make(chan RelayStats, 1)
+	go func() { done <- RelayConn(a, b, live) }()
+
+	buf := make([]byte, 16)
+	user.Write([]byte("hello"))
+	if n, _ := io.ReadFull(peer, buf[:5]); n != 5 {
+		t.Fatal("a->b not relayed")
+	}
+	peer.Write([]byte("world!"))
+	if n, _ := io.ReadFull(user, buf[:6]); n != 6 {
+		t.Fatal("b->a not relayed")
+	}
+	// 计数在转发过程中即已更新（对端读到数据后写入方才返回，稍等片刻）
+	deadline := time.Now().Add(time.Second)
+	for {
+		live.mu.Lock()
+		gotA, gotB := live.aToB, live.bToA
+		live.mu.Unlock()
+		if gotA == 5 && gotB == 6 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected live counts 5/6 before the relay ends, got %d/%d", gotA, gotB)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// a 侧先关闭
+	user.Close()
+	select {
+	case st := <-done:
+		if st.AToB != 5 || st.BToA != 6 || st.ClosedBy != "a" || st.Duration <= 0 {
+			t.Errorf("unexpected stats %+v", st)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RelayConn未及时退出")
+	}
+}
@@ -0,0 +1,66 @@
+package core
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// drainPollInterval is how often Drain re-checks the number of active relays.
+const drainPollInterval = 50 * time.Millisecond
+
+// Tracker records in-flight relays so shutdown code can wait for them to finish and cut the rest.
+// The zero value is ready to use.
+type Tracker struct {
+	mu     sync.Mutex
+	relays map[*trackedRelay]struct{}
+}
+
+type trackedRelay struct {
+	conns []net.Conn
+}
+
+// Track registers the connections of one relay and returns the function to call once the relay ends.
+func (t *Tracker) Track(conns ...net.Conn) (untrack func()) {
+	r := &trackedRelay{conns: conns}
+	t.mu.Lock()
+	if t.relays == nil {
+		t.relays = make(map[*trackedRelay]struct{})
+	}
+	t.relays[r] = struct{}{}
+	t.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			delete(t.relays, r)
+			t.mu.Unlock()
+		})
+	}
+}
+
+// Active returns the number of relays currently in flight.
+func (t *Tracker) Active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.relays)
+}
+
+// Drain waits up to timeout for in-flight relays to finish on their own, then closes whatever is
+// still running. It returns the number of relays that had to be cut.
+func (t *Tracker) Drain(timeout time.Duration) (cut int) {
+	deadline := time.Now().Add(timeout)
+	for t.Active() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for r := range t.relays {
+		for _, c := range r.conns {
+			_ = c.Close()
+		}
+		delete(t.relays, r)
+		cut++
+	}
+	return cut
+}
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTracker_DrainWaitsForRelays(t *testing.T) {
+	var tr Tracker
+	untrack := tr.Track(newMockConn(), newMockConn())
+	if tr.Active() != 1 {
+		t.Fatalf("expected 1 active relay, got %d", tr.Active())
+	}
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		untrack()
+	}()
+	if cut := tr.Drain(time.Second); cut != 0 {
+		t.Errorf("relay finished before deadline, expected 0 cut, got %d", cut)
+	}
+}
+
+func TestTracker_DrainCutsAfterTimeout(t *testing.T) {
+	var tr Tracker
+	a, b := newMockConn(), newMockConn()
+	untrack := tr.Track(a, b)
+	tr.Track(newMockConn())
+	if cut := tr.Drain(20 * time.Millisecond); cut != 2 {
+		t.Errorf("expected 2 relays cut, got %d", cut)
+	}
+	if !a.closed || !b.closed {
+		t.Error("cut relays should have their connections closed")
+	}
+	// 超时后再调用untrack不应出错
+	untrack()
+	if tr.Active() != 0 {
+		t.Errorf("expected no active relays, got %d", tr.Active())
+	}
+}
@@ -0,0 +1,65 @@
+package ha
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponentially growing retry delays with random jitter.
+// Call Next after every failed attempt and Reset once a connection has proven stable.
+type Backoff struct {
+	Base     time.Duration // Delay before the first retry
+	Max      time.Duration // Upper bound for a single delay, jitter excluded
+	Jitter   float64       // Random extra delay as a fraction of the current delay, e.g. 0.2 adds up to 20%
+	MaxTries int           // Maximum consecutive failed attempts, 0 means unlimited
+	tries    int
+}
+
+// Next records a failed attempt and returns how long to wait before the next one.
+// It returns false once MaxTries consecutive attempts have failed.
+func (b *Backoff) Next() (time.Duration, bool) {
+	b.tries++
+	if b.MaxTries > 0 && b.tries >= b.MaxTries {
+		return 0, false
+	}
+	d := b.Base
+	if d <= 0 {
+		d = time.Second
+	}
+	for i := 1; i < b.tries; i++ {
+		d *= 2
+		if b.Max > 0 && d >= b.Max {
+			break
+		}
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(float64(d)*b.Jitter) + 1))
+	}
+	return d, true
+}
+
+// Tries returns the number of consecutive failed attempts since the last Reset.
+func (b *Backoff) Tries() int {
+	return b.tries
+}
+
+// Reset starts the delay sequence over from Base.
+func (b *Backoff) Reset() {
+	b.tries = 0
+}
+
+// Sleep waits for d or until ctx is done, whichever comes first. It returns ctx.Err() if interrupted.
+func Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
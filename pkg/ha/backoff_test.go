@@ -0,0 +1,61 @@
+package ha
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoff_Growth(t *testing.T) {
+	b := &Backoff{Base: time.Second, Max: 5 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		d, ok := b.Next()
+		if !ok || d != w {
+			t.Fatalf("第%d次退避期望%v，实际%v ok=%v", i+1, w, d, ok)
+		}
+	}
+	// 连接稳定后重置，重新从Base开始
+	b.Reset()
+	if d, _ := b.Next(); d != time.Second {
+		t.Errorf("reset应回到Base，实际%v", d)
+	}
+}
+
+func TestBackoff_Jitter(t *testing.T) {
+	b := &Backoff{Base: 100 * time.Millisecond, Max: time.Second, Jitter: 0.5}
+	for i := 0; i < 50; i++ {
+		b.Reset()
+		d, _ := b.Next()
+		if d < 100*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("抖动超出范围: %v", d)
+		}
+	}
+}
+
+func TestBackoff_MaxTries(t *testing.T) {
+	b := &Backoff{Base: time.Millisecond, MaxTries: 3}
+	for i := 0; i < 2; i++ {
+		if _, ok := b.Next(); !ok {
+			t.Fatalf("第%d次失败后仍应重试", i+1)
+		}
+	}
+	if _, ok := b.Next(); ok {
+		t.Error("达到MaxTries后应停止重试")
+	}
+}
+
+func TestSleep_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if err := Sleep(ctx, 5*time.Second); err == nil {
+		t.Error("取消context后Sleep应返回错误")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Sleep未及时响应取消")
+	}
+}
@@ -5,34 +5,58 @@ import (
 	"gotunnel/pkg/log"
 	"gotunnel/pkg/protocol"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// defaultHeartbeatInterval is used when HeartbeatManager.Interval is not set.
+const defaultHeartbeatInterval = 10 * time.Second
+
 // HeartbeatManager manages heartbeat sending and monitoring. Used for client and server control channel health.
 type HeartbeatManager struct {
 	Conn      net.Conn      // Associated network connection
 	Interval  time.Duration // Heartbeat packet send interval
-	OnTimeout func()        // Timeout disconnect callback
+	MaxMissed int           // Intervals without a pong before OnTimeout fires, 0 disables pong tracking
+	OnTimeout func()        // Timeout disconnect callback, called at most once
+	RTT       *RTTWindow    // Optional, collects round-trip samples from pongs and reports them in pings
 	stopChan  chan struct{}
+	stopOnce  sync.Once
+	lastPong  atomic.Int64 // Unix nanoseconds of the last pong (or of StartHeartbeat)
 }
 
 // StartHeartbeat starts a goroutine that periodically sends ping packets. Suitable for clients.
+// With MaxMissed set, OnTimeout also fires when no pong arrives for MaxMissed intervals,
+// which catches half-open connections that still accept writes.
 func (h *HeartbeatManager) StartHeartbeat() {
 	h.stopChan = make(chan struct{})
+	h.lastPong.Store(time.Now().UnixNano())
+	interval := h.Interval
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
+	}
 	go func() {
-		ticker := time.NewTicker(h.Interval)
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				ping := protocol.HeartbeatPing{Type: "ping", Time: time.Now().Unix()}
+				if h.MaxMissed > 0 && time.Since(h.LastPong()) > time.Duration(h.MaxMissed)*interval {
+					log.Warn("ha", "ha.heartbeat_pong_timeout", map[string]interface{}{"Missed": h.MaxMissed, "Since": time.Since(h.LastPong()).Round(time.Millisecond)})
+					h.timeout()
+					return
+				}
+				ping := protocol.HeartbeatPing{Type: "ping", Time: time.Now().UnixNano()}
+				if h.RTT != nil {
+					if st := h.RTT.Stats(); st.Samples > 0 {
+						ping.RTT = &st
+					}
+				}
 				b, _ := json.Marshal(ping)
 				err := protocol.WritePacket(h.Conn, b)
 				if err != nil {
 					log.Errorf("ha", "ha.heartbeat_send_failed", err)
-					if h.OnTimeout != nil {
-						h.OnTimeout()
-					}
+					h.timeout()
 					return
 				}
 			case <-h.stopChan:
@@ -42,9 +66,35 @@ func (h *HeartbeatManager) StartHeartbeat() {
 	}()
 }
 
-// StopHeartbeat stops the heartbeat.
+// Pong records that a pong arrived. Call it from the loop that reads the control connection with the
+// ping time the pong echoes; the round trip is added to RTT and returned (0 if unknown).
+func (h *HeartbeatManager) Pong(sentAt time.Time) time.Duration {
+	now := time.Now()
+	h.lastPong.Store(now.UnixNano())
+	if h.RTT == nil || sentAt.IsZero() {
+		return 0
+	}
+	rtt := now.Sub(sentAt)
+	if !h.RTT.Add(rtt) {
+		return 0
+	}
+	return rtt
+}
+
+// LastPong returns when the last pong arrived.
+func (h *HeartbeatManager) LastPong() time.Time {
+	return time.Unix(0, h.lastPong.Load())
+}
+
+func (h *HeartbeatManager) timeout() {
+	if h.OnTimeout != nil {
+		h.OnTimeout()
+	}
+}
+
+// StopHeartbeat stops the heartbeat. It is safe to call more than once.
 func (h *HeartbeatManager) StopHeartbeat() {
-	close(h.stopChan)
+	h.stopOnce.Do(func() { close(h.stopChan) })
 }
 
 // HeartbeatCheckLoop runs a periodic heartbeat check loop for the server.
@@ -57,7 +107,8 @@ func HeartbeatCheckLoop(checkFunc func()) {
 }
 
 // Example usage:
-// cMgr := &ha.HeartbeatManager{Conn: conn, Interval: 10 * time.Second, OnTimeout: func(){...}}
+// cMgr := &ha.HeartbeatManager{Conn: conn, Interval: 10 * time.Second, MaxMissed: 3, OnTimeout: func(){...}}
 // cMgr.StartHeartbeat() // Client heartbeat
+// cMgr.Pong(time.Unix(0, pong.Time)) // Call for every pong read from conn
 // cMgr.StopHeartbeat() // Stop heartbeat
 // ha.HeartbeatCheckLoop(customCheckFunc) // Server heartbeat polling
@@ -1,7 +1,9 @@
 package ha
 
 import (
+	"encoding/json"
 	"errors"
+	"gotunnel/pkg/protocol"
 	"net"
 	"sync/atomic"
 	"testing"
@@ -47,3 +49,78 @@ func TestHeartbeatManager_TimeoutOnWriteFail(t *testing.T) {
 		t.Fatal("heartbeat timeout callback not triggered on write fail")
 	}
 }
+
+func TestHeartbeatManager_PongTimeout(t *testing.T) {
+	// 写入正常但始终收不到pong（半开连接），超过MaxMissed个周期后应触发超时且只触发一次
+	var fired int32
+	mgr := &HeartbeatManager{
+		Conn:      &goodWriteConn{},
+		Interval:  20 * time.Millisecond,
+		MaxMissed: 2,
+		OnTimeout: func() { atomic.AddInt32(&fired, 1) },
+	}
+	mgr.StartHeartbeat()
+	defer mgr.StopHeartbeat()
+	time.Sleep(150 * time.Millisecond)
+	if n := atomic.LoadInt32(&fired); n != 1 {
+		t.Errorf("期望超时回调触发1次，实际%d次", n)
+	}
+}
+
+func TestHeartbeatManager_PongKeepsAlive(t *testing.T) {
+	var fired int32
+	mgr := &HeartbeatManager{
+		Conn:      &goodWriteConn{},
+		Interval:  20 * time.Millisecond,
+		MaxMissed: 2,
+		OnTimeout: func() { atomic.AddInt32(&fired, 1) },
+	}
+	mgr.StartHeartbeat()
+	stop := time.After(150 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case <-stop:
+			done = true
+		case <-time.After(10 * time.Millisecond):
+			mgr.Pong(time.Time{})
+		}
+	}
+	mgr.StopHeartbeat()
+	mgr.StopHeartbeat() // 重复停止不应panic
+	if atomic.LoadInt32(&fired) != 0 {
+		t.Error("持续收到pong时不应触发超时")
+	}
+}
+
+type captureConn struct {
+	net.Conn
+	pings chan []byte
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	c.pings <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestHeartbeatManager_ReportsRTT(t *testing.T) {
+	conn := &captureConn{pings: make(chan []byte, 16)}
+	mgr := &HeartbeatManager{Conn: conn, Interval: 10 * time.Millisecond, RTT: NewRTTWindow(0)}
+	if rtt := mgr.Pong(time.Now().Add(-5 * time.Millisecond)); rtt < 5*time.Millisecond {
+		t.Fatalf("期望往返时延不小于5ms，实际%v", rtt)
+	}
+	mgr.StartHeartbeat()
+	defer mgr.StopHeartbeat()
+
+	// ping应携带纳秒时间戳及往返时延统计
+	raw := <-conn.pings
+	var ping protocol.HeartbeatPing
+	if err := json.Unmarshal(raw[4:], &ping); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(time.Unix(0, ping.Time)) > time.Second {
+		t.Errorf("ping时间应为纳秒时间戳: %d", ping.Time)
+	}
+	if ping.RTT == nil || ping.RTT.Samples != 1 {
+		t.Errorf("ping应携带RTT统计: %+v", ping.RTT)
+	}
+}
@@ -2,7 +2,6 @@ package ha
 
 import (
 	"gotunnel/pkg/log"
-	"math/rand"
 	"time"
 )
 
@@ -15,25 +14,23 @@ var sleepHook = time.Sleep
 // maxTries: maximum number of attempts, 0 means unlimited retries.
 // Returns true if connection is successfully established, false if it ultimately fails.
 func ReconnectLoop(dialFunc func() bool, baseInterval, maxInterval int, maxTries int) bool {
-	tries := 0
-	interval := baseInterval
+	b := &Backoff{
+		Base:     time.Duration(baseInterval) * time.Second,
+		Max:      time.Duration(maxInterval) * time.Second,
+		Jitter:   0.2,
+		MaxTries: maxTries,
+	}
 	for {
-		if maxTries > 0 && tries >= maxTries {
-			log.Errorf("ha", "ha.reconnect_max_tries", maxTries)
-			return false
-		}
 		if dialFunc() {
 			return true
 		}
-		d := time.Duration(interval) * time.Second
-		jitter := time.Duration(rand.Intn(1000)) * time.Millisecond
-		log.Warnf("ha", "ha.reconnect_retry", tries+1, d+jitter)
-		sleepHook(d + jitter)
-		interval = interval * 2
-		if interval > maxInterval {
-			interval = maxInterval
+		d, ok := b.Next()
+		if !ok {
+			log.Error("ha", "ha.reconnect_max_tries", map[string]interface{}{"MaxTries": maxTries})
+			return false
 		}
-		tries++
+		log.Warn("ha", "ha.reconnect_retry", map[string]interface{}{"Tries": b.Tries(), "Duration": d.Round(time.Millisecond)})
+		sleepHook(d)
 	}
 }
 
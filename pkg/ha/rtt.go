@@ -0,0 +1,89 @@
+package ha
+
+import (
+	"gotunnel/pkg/protocol"
+	"sync"
+	"time"
+)
+
+// defaultRTTWindow is the number of samples kept when NewRTTWindow is given a non-positive size.
+const defaultRTTWindow = 20
+
+// maxRTTSample discards nonsensical samples, e.g. a pong from an older server that echoes seconds.
+const maxRTTSample = time.Minute
+
+// RTTWindow keeps the most recent round-trip samples and summarizes them. It is safe for concurrent use.
+type RTTWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+// NewRTTWindow creates a sliding window holding up to size samples.
+func NewRTTWindow(size int) *RTTWindow {
+	if size <= 0 {
+		size = defaultRTTWindow
+	}
+	return &RTTWindow{samples: make([]time.Duration, size)}
+}
+
+// Add records one round-trip sample. Samples outside (0, 1m] are ignored; it reports whether d was kept.
+func (w *RTTWindow) Add(d time.Duration) bool {
+	if d <= 0 || d > maxRTTSample {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % len(w.samples)
+	if w.next == 0 {
+		w.full = true
+	}
+	return true
+}
+
+// Stats returns min/avg/max/jitter over the samples in the window, oldest to newest.
+func (w *RTTWindow) Stats() protocol.RTTStats {
+	w.mu.Lock()
+	ordered := w.ordered()
+	w.mu.Unlock()
+
+	var st protocol.RTTStats
+	if len(ordered) == 0 {
+		return st
+	}
+	var sum, diffs time.Duration
+	st.Min = ordered[0]
+	for i, d := range ordered {
+		sum += d
+		if d < st.Min {
+			st.Min = d
+		}
+		if d > st.Max {
+			st.Max = d
+		}
+		if i > 0 {
+			delta := d - ordered[i-1]
+			if delta < 0 {
+				delta = -delta
+			}
+			diffs += delta
+		}
+	}
+	st.Samples = len(ordered)
+	st.Last = ordered[len(ordered)-1]
+	st.Avg = sum / time.Duration(len(ordered))
+	if len(ordered) > 1 {
+		st.Jitter = diffs / time.Duration(len(ordered)-1)
+	}
+	return st
+}
+
+// ordered returns the samples oldest first. Callers hold w.mu.
+func (w *RTTWindow) ordered() []time.Duration {
+	if !w.full {
+		return append([]time.Duration(nil), w.samples[:w.next]...)
+	}
+	return append(append([]time.Duration(nil), w.samples[w.next:]...), w.samples[:w.next]...)
+}
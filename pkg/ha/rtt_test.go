@@ -0,0 +1,36 @@
+package ha
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTWindow_Stats(t *testing.T) {
+	w := NewRTTWindow(3)
+	if st := w.Stats(); st.Samples != 0 {
+		t.Fatalf("空窗口不应有样本: %+v", st)
+	}
+	for _, ms := range []int{10, 30, 20, 40} {
+		w.Add(time.Duration(ms) * time.Millisecond)
+	}
+	// 窗口大小为3，最早的10ms应被挤出，剩余30/20/40
+	st := w.Stats()
+	ms := time.Millisecond
+	if st.Samples != 3 || st.Last != 40*ms || st.Min != 20*ms || st.Max != 40*ms || st.Avg != 30*ms {
+		t.Errorf("统计结果错误: %+v", st)
+	}
+	// 抖动为相邻样本差值的平均: (|20-30| + |40-20|) / 2 = 15ms
+	if st.Jitter != 15*ms {
+		t.Errorf("期望抖动15ms，实际%v", st.Jitter)
+	}
+}
+
+func TestRTTWindow_RejectsBogusSamples(t *testing.T) {
+	w := NewRTTWindow(0)
+	if w.Add(0) || w.Add(-time.Second) || w.Add(2*time.Hour) {
+		t.Error("非法样本应被丢弃")
+	}
+	if w.Stats().Samples != 0 {
+		t.Error("非法样本不应计入统计")
+	}
+}
@@ -0,0 +1,224 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Checker decides whether the service at addr is healthy. Check returns nil when it is and an
+// error describing the failure otherwise; it must give up when ctx is done.
+type Checker interface {
+	Check(ctx context.Context, addr string) error
+}
+
+// DialFunc opens the connection a check runs over. Checks use a plain TCP dial when it is nil;
+// the server sets it to reach a service through its tunnel.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (d DialFunc) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if d != nil {
+		return d(ctx, "tcp", addr)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// Check types accepted by CheckSpec.Type.
+const (
+	CheckTCP     = "tcp"
+	CheckHTTP    = "http"
+	CheckHTTPS   = "https"
+	CheckTLS     = "tls"
+	CheckCommand = "command"
+)
+
+// CheckSpec describes a health check as configured for a tunnel.
+type CheckSpec struct {
+	Type               string        // One of the Check* constants, "" means tcp
+	Path               string        // HTTP(S): request path, default "/"
+	Host               string        // HTTP(S): Host header, default the target address
+	ExpectStatus       int           // HTTP(S): required status code, 0 accepts any 2xx or 3xx
+	ExpectBody         string        // HTTP(S): substring the response body must contain
+	ServerName         string        // HTTPS/TLS: name to verify the certificate against, default the target host
+	InsecureSkipVerify bool          // HTTPS/TLS: accept any certificate chain
+	MinCertValidity    time.Duration // TLS: fail when the certificate expires sooner than this
+	Command            []string      // Command: program and arguments, run with GOTUNNEL_TARGET set to the address
+	Dial               DialFunc      // TCP/HTTP(S)/TLS: how the target is reached, nil means a plain dial
+}
+
+// NewChecker returns the Checker described by spec.
+func NewChecker(spec CheckSpec) (Checker, error) {
+	switch spec.Type {
+	case "", CheckTCP:
+		return TCPChecker{Dial: spec.Dial}, nil
+	case CheckHTTP, CheckHTTPS:
+		return &HTTPChecker{
+			HTTPS:              spec.Type == CheckHTTPS,
+			Path:               spec.Path,
+			Host:               spec.Host,
+			ExpectStatus:       spec.ExpectStatus,
+			ExpectBody:         spec.ExpectBody,
+			ServerName:         spec.ServerName,
+			InsecureSkipVerify: spec.InsecureSkipVerify,
+			Dial:               spec.Dial,
+		}, nil
+	case CheckTLS:
+		return &TLSChecker{
+			ServerName:         spec.ServerName,
+			InsecureSkipVerify: spec.InsecureSkipVerify,
+			MinValidity:        spec.MinCertValidity,
+			Dial:               spec.Dial,
+		}, nil
+	case CheckCommand:
+		if len(spec.Command) == 0 {
+			return nil, fmt.Errorf("command health check needs a command")
+		}
+		return &CommandChecker{Command: spec.Command}, nil
+	}
+	return nil, fmt.Errorf("unknown health check type %q", spec.Type)
+}
+
+// TCPChecker considers a service healthy when it accepts a TCP connection.
+type TCPChecker struct {
+	Dial DialFunc
+}
+
+// Check implements Checker.
+func (c TCPChecker) Check(ctx context.Context, addr string) error {
+	conn, err := c.Dial.dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// maxCheckBody bounds how much of an HTTP response body is read for ExpectBody.
+const maxCheckBody = 64 << 10
+
+// HTTPChecker sends a GET request and checks the status code and, optionally, the body.
+// Redirects are not followed, a 3xx answer is judged by its own status.
+type HTTPChecker struct {
+	HTTPS              bool
+	Path               string
+	Host               string
+	ExpectStatus       int
+	ExpectBody         string
+	ServerName         string
+	InsecureSkipVerify bool
+	Dial               DialFunc
+}
+
+// Check implements Checker.
+func (c *HTTPChecker) Check(ctx context.Context, addr string) error {
+	scheme := "http"
+	if c.HTTPS {
+		scheme = "https"
+	}
+	path := c.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	if c.Host != "" {
+		req.Host = c.Host
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify},
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, _, a string) (net.Conn, error) {
+				return c.Dial.dial(ctx, a)
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if c.ExpectStatus != 0 && resp.StatusCode != c.ExpectStatus {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, c.ExpectStatus)
+	}
+	if c.ExpectStatus == 0 && (resp.StatusCode < 200 || resp.StatusCode >= 400) {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if c.ExpectBody != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(body, []byte(c.ExpectBody)) {
+			return fmt.Errorf("response body does not contain %q", c.ExpectBody)
+		}
+	}
+	return nil
+}
+
+// TLSChecker completes a TLS handshake and checks that the certificate is not about to expire.
+type TLSChecker struct {
+	ServerName         string
+	InsecureSkipVerify bool
+	MinValidity        time.Duration // Fail when the leaf certificate expires within this time
+	Dial               DialFunc
+}
+
+// Check implements Checker.
+func (c *TLSChecker) Check(ctx context.Context, addr string) error {
+	serverName := c.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+	raw, err := c.Dial.dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	conn := tls.Client(raw, &tls.Config{ServerName: serverName, InsecureSkipVerify: c.InsecureSkipVerify})
+	defer conn.Close()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate presented")
+	}
+	if left := time.Until(certs[0].NotAfter); left < c.MinValidity {
+		return fmt.Errorf("certificate expires %s, in less than %s", certs[0].NotAfter.Format(time.RFC3339), c.MinValidity)
+	}
+	return nil
+}
+
+// CommandChecker runs a local command and considers the service healthy when it exits with status 0.
+// The address being checked is passed in the GOTUNNEL_TARGET environment variable.
+type CommandChecker struct {
+	Command []string
+}
+
+// Check implements Checker.
+func (c *CommandChecker) Check(ctx context.Context, addr string) error {
+	cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+	cmd.Env = append(os.Environ(), "GOTUNNEL_TARGET="+addr)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			if len(msg) > 200 {
+				msg = msg[:200] + "..."
+			}
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package health
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func checkCtx(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestTCPChecker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	if err := (TCPChecker{}).Check(checkCtx(t), addr); err != nil {
+		t.Errorf("端口已监听应健康: %v", err)
+	}
+	ln.Close()
+	if err := (TCPChecker{}).Check(checkCtx(t), addr); err == nil {
+		t.Error("端口已关闭应不健康")
+	}
+}
+
+func TestHTTPChecker(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.Write([]byte(`{"status":"ok"}`))
+		case "/moved":
+			http.Redirect(w, r, "/healthz", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	cases := []struct {
+		name    string
+		checker *HTTPChecker
+		healthy bool
+	}{
+		{"2xx", &HTTPChecker{Path: "/healthz"}, true},
+		{"500", &HTTPChecker{Path: "/"}, false},
+		{"body match", &HTTPChecker{Path: "healthz", ExpectBody: `"ok"`}, true},
+		{"body mismatch", &HTTPChecker{Path: "/healthz", ExpectBody: "degraded"}, false},
+		{"exact status", &HTTPChecker{Path: "/", ExpectStatus: 500}, true},
+		// 不跟随跳转，按 3xx 本身判断
+		{"redirect", &HTTPChecker{Path: "/moved", ExpectStatus: 200}, false},
+	}
+	for _, c := range cases {
+		err := c.checker.Check(checkCtx(t), addr)
+		if (err == nil) != c.healthy {
+			t.Errorf("%s: expected healthy=%v, got %v", c.name, c.healthy, err)
+		}
+	}
+}
+
+func TestHTTPChecker_HTTPS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+	// 自签证书须显式跳过校验
+	if err := (&HTTPChecker{HTTPS: true}).Check(checkCtx(t), addr); err == nil {
+		t.Error("expected untrusted certificate to fail")
+	}
+	if err := (&HTTPChecker{HTTPS: true, InsecureSkipVerify: true}).Check(checkCtx(t), addr); err != nil {
+		t.Errorf("expected healthy with insecure_skip_verify: %v", err)
+	}
+}
+
+func TestTLSChecker_Expiry(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+	if err := (&TLSChecker{InsecureSkipVerify: true, MinValidity: time.Hour}).Check(checkCtx(t), addr); err != nil {
+		t.Errorf("expected valid certificate: %v", err)
+	}
+	// 证书剩余有效期不足时判为不健康
+	if err := (&TLSChecker{InsecureSkipVerify: true, MinValidity: 200 * 365 * 24 * time.Hour}).Check(checkCtx(t), addr); err == nil {
+		t.Error("expected certificate expiring too soon to fail")
+	}
+}
+
+func TestCommandChecker(t *testing.T) {
+	ok := &CommandChecker{Command: []string{"sh", "-c", `test "$GOTUNNEL_TARGET" = "127.0.0.1:8080"`}}
+	if err := ok.Check(checkCtx(t), "127.0.0.1:8080"); err != nil {
+		t.Errorf("expected exit 0 with target in env: %v", err)
+	}
+	fail := &CommandChecker{Command: []string{"sh", "-c", "echo broken; exit 3"}}
+	if err := fail.Check(checkCtx(t), "127.0.0.1:8080"); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected failure with command output, got %v", err)
+	}
+}
+
+func TestNewChecker(t *testing.T) {
+	for _, spec := range []CheckSpec{{}, {Type: "tcp"}, {Type: "http"}, {Type: "https"}, {Type: "tls"}, {Type: "command", Command: []string{"true"}}} {
+		if _, err := NewChecker(spec); err != nil {
+			t.Errorf("%+v should be accepted: %v", spec, err)
+		}
+	}
+	for _, spec := range []CheckSpec{{Type: "udp"}, {Type: "command"}} {
+		if _, err := NewChecker(spec); err == nil {
+			t.Errorf("%+v should be rejected", spec)
+		}
+	}
+}
+
+func TestChecker_CustomDial(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("host=" + r.Host))
+	}))
+	defer srv.Close()
+
+	// 通过自定义拨号把检查转发到真实地址，检查目标只作为 Host 使用
+	var dialed []string
+	dial := DialFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		var d net.Dialer
+		return d.DialContext(ctx, network, srv.Listener.Addr().String())
+	})
+	checker, err := NewChecker(CheckSpec{Type: CheckHTTP, ExpectBody: "host=tunnel:80", Dial: dial})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checker.Check(checkCtx(t), "tunnel:80"); err != nil {
+		t.Errorf("check through custom dial failed: %v", err)
+	}
+	tcp, _ := NewChecker(CheckSpec{Dial: dial})
+	if err := tcp.Check(checkCtx(t), "tunnel:80"); err != nil {
+		t.Errorf("tcp check through custom dial failed: %v", err)
+	}
+	if len(dialed) != 2 || dialed[0] != "tunnel:80" {
+		t.Errorf("expected both checks to use the dial hook, got %v", dialed)
+	}
+}
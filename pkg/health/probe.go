@@ -1,6 +1,7 @@
 package health
 
 import (
+	"context"
 	"gotunnel/pkg/log"
 	"net"
 	"time"
@@ -16,27 +17,139 @@ func ProbeTCPAlive(addr string, timeout time.Duration) bool {
 	return false
 }
 
-// PeriodicProbe periodically probes a local port, can notify main process to go offline when down is detected
-func PeriodicProbe(target string, interval time.Duration, onDead func(), onAlive func()) {
-	aliveLast := true
+// ProbeOptions tunes how probe results turn into alive/dead decisions.
+type ProbeOptions struct {
+	Checker Checker       // How the target is checked, nil means TCPChecker
+	Timeout time.Duration // Bound on one check, default 1s
+	Rise    int           // Consecutive successes before a dead target counts as alive, default 1
+	Fall    int           // Consecutive failures before an alive target counts as dead, default 1
+
+	// A target that changes state FlapLimit times within FlapWindow is held dead for FlapWindow,
+	// however its checks turn out. A FlapLimit of 0 disables flap damping.
+	FlapLimit  int
+	FlapWindow time.Duration
+}
+
+// WithDefaults fills in the defaults for unset fields.
+func (o ProbeOptions) WithDefaults() ProbeOptions {
+	if o.Checker == nil {
+		o.Checker = TCPChecker{}
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = time.Second
+	}
+	if o.Rise <= 0 {
+		o.Rise = 1
+	}
+	if o.Fall <= 0 {
+		o.Fall = 1
+	}
+	return o
+}
+
+// Tracker turns a stream of probe results into a damped alive/dead state. It is not safe for
+// concurrent use. Targets start out alive.
+type Tracker struct {
+	opts        ProbeOptions
+	alive       bool
+	successes   int
+	failures    int
+	transitions []time.Time // State changes within the flap window
+	heldUntil   time.Time
+}
+
+// NewTracker returns a Tracker applying the thresholds in opts.
+func NewTracker(opts ProbeOptions) *Tracker {
+	return &Tracker{opts: opts.WithDefaults(), alive: true}
+}
+
+// Alive reports the current judged state.
+func (t *Tracker) Alive() bool { return t.alive }
+
+// Failures returns the number of consecutive failed results up to now.
+func (t *Tracker) Failures() int { return t.failures }
+
+// HeldUntil returns the end of the current flap hold, zero if the target was never held.
+func (t *Tracker) HeldUntil() time.Time { return t.heldUntil }
+
+// Observe records one probe result taken at now. changed reports whether the judged state
+// flipped, held whether this result started a flap hold.
+func (t *Tracker) Observe(ok bool, now time.Time) (changed, held bool) {
+	if ok {
+		t.failures = 0
+		t.successes++
+		if t.alive || t.successes < t.opts.Rise || now.Before(t.heldUntil) {
+			return false, false
+		}
+	} else {
+		t.successes = 0
+		t.failures++
+		if !t.alive || t.failures < t.opts.Fall {
+			return false, false
+		}
+	}
+	if t.flapping(now) {
+		// Going up is suppressed, going down still happens
+		t.heldUntil = now.Add(t.opts.FlapWindow)
+		t.transitions = nil
+		changed = t.alive
+		t.alive = false
+		return changed, true
+	}
+	t.alive = ok
+	return true, false
+}
+
+// flapping records a transition at now and reports whether it reaches the flap limit.
+func (t *Tracker) flapping(now time.Time) bool {
+	if t.opts.FlapLimit <= 0 {
+		return false
+	}
+	kept := t.transitions[:0]
+	for _, at := range t.transitions {
+		if now.Sub(at) < t.opts.FlapWindow {
+			kept = append(kept, at)
+		}
+	}
+	t.transitions = append(kept, now)
+	return len(t.transitions) >= t.opts.FlapLimit
+}
+
+// Result is the outcome of one check of a target.
+type Result struct {
+	Target  string
+	Err     error         // nil if the target passed the check
+	Latency time.Duration // How long the check took
+}
+
+// Probe checks every target with opts' checker every interval, bounding each check by opts'
+// timeout, and passes each result with the target's index to observe. Feeding the results into
+// a Tracker per target applies the rise/fall thresholds and flap damping. Probe returns once ctx
+// is done; a check cut short by ctx is dropped, so observe is not called after Probe returned.
+func Probe(ctx context.Context, targets []string, interval time.Duration, opts ProbeOptions, observe func(i int, r Result)) {
+	opts = opts.WithDefaults()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		ok := ProbeTCPAlive(target, time.Second)
-		if ok {
-			if !aliveLast && onAlive != nil {
-				onAlive()
+		for i, target := range targets {
+			checkCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+			start := time.Now()
+			err := opts.Checker.Check(checkCtx, target)
+			cancel()
+			if ctx.Err() != nil {
+				return
 			}
-			aliveLast = true
-			log.Debugf("health", "health.port_healthy", target)
-		} else {
-			if aliveLast && onDead != nil {
-				onDead()
+			if err == nil {
+				log.Debugf("health", "health.port_healthy", target)
+			} else {
+				log.Debugf("health", "health.port_unreachable", target)
 			}
-			aliveLast = false
-			log.Warnf("health", "health.port_unreachable", target)
+			observe(i, Result{Target: target, Err: err, Latency: time.Since(start)})
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-		time.Sleep(interval)
 	}
 }
-
-// Example usage:
-// health.PeriodicProbe("127.0.0.1:2222", 30*time.Second, func(){...}, func(){...})
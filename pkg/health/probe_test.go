@@ -1,7 +1,9 @@
 package health
 
 import (
+	"context"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -23,62 +25,147 @@ func TestProbeTCPAlive_ActiveAndInactive(t *testing.T) {
 	}
 }
 
-func TestPeriodicProbe_Calls(t *testing.T) {
-	// 利用chan让probe只检测一次后主动结束
-	deadCh := make(chan struct{}, 1)
-	go func() {
-		PeriodicProbe("127.0.0.1:65530", 50*time.Millisecond,
-			func() { deadCh <- struct{}{} }, nil)
-	}()
-	select {
-	case <-deadCh:
-		// ok，收到回调
-	case <-time.After(300 * time.Millisecond):
-		t.Fatal("PeriodicProbe未及时触发onDead")
+func TestProbe_Results(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestPeriodicProbe_DeadToAlive(t *testing.T) {
-	// 测试从dead到alive的转换
-	ln, err := net.Listen("tcp", ":0")
+	defer ln.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
-	addr := ln.Addr().String()
+	dead.Close()
 
-	deadCh := make(chan struct{}, 1)
-	aliveCh := make(chan struct{}, 1)
+	// 每个目标的结果带上其下标，监听中的端口成功、已关闭的端口失败
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan Result, 2)
+	targets := []string{ln.Addr().String(), dead.Addr().String()}
+	go Probe(ctx, targets, time.Hour, ProbeOptions{}, func(i int, r Result) {
+		if r.Target != targets[i] {
+			t.Errorf("result %d for %s, want %s", i, r.Target, targets[i])
+		}
+		results <- r
+	})
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			if (r.Err == nil) != (r.Target == targets[0]) {
+				t.Errorf("unexpected result for %s: %v", r.Target, r.Err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Probe未及时返回检查结果")
+		}
+	}
+}
 
-	// 先关闭监听，让probe检测到dead
-	ln.Close()
+func TestTracker_RiseFall(t *testing.T) {
+	tr := NewTracker(ProbeOptions{Rise: 2, Fall: 3})
+	now := time.Now()
+	// 连续失败未达到 Fall 前保持存活，中间一次成功会清零计数
+	for i, ok := range []bool{false, false, true, false, false} {
+		if changed, _ := tr.Observe(ok, now); changed || !tr.Alive() {
+			t.Fatalf("result %d should not flip the state", i)
+		}
+	}
+	if changed, _ := tr.Observe(false, now); !changed || tr.Alive() {
+		t.Fatal("third consecutive failure should mark the target dead")
+	}
+	if changed, _ := tr.Observe(true, now); changed || tr.Alive() {
+		t.Fatal("a single success should not bring the target back with Rise 2")
+	}
+	if changed, _ := tr.Observe(true, now); !changed || !tr.Alive() {
+		t.Fatal("second consecutive success should mark the target alive")
+	}
+}
 
-	go func() {
-		PeriodicProbe(addr, 50*time.Millisecond,
-			func() { deadCh <- struct{}{} },
-			func() { aliveCh <- struct{}{} })
-	}()
+func TestTracker_FlapDamping(t *testing.T) {
+	tr := NewTracker(ProbeOptions{FlapLimit: 3, FlapWindow: time.Minute})
+	now := time.Now()
+	tr.Observe(false, now)
+	tr.Observe(true, now.Add(time.Second))
+	// 窗口内第三次切换触发抑制：目标被判为不可用
+	changed, held := tr.Observe(false, now.Add(2*time.Second))
+	if !changed || !held || tr.Alive() {
+		t.Fatalf("third transition should start a hold, changed=%v held=%v", changed, held)
+	}
+	if changed, _ := tr.Observe(true, now.Add(30*time.Second)); changed || tr.Alive() {
+		t.Fatal("target should stay dead during the hold")
+	}
+	if changed, _ := tr.Observe(true, now.Add(2*time.Second+time.Minute)); !changed || !tr.Alive() {
+		t.Fatal("target should come back once the hold is over")
+	}
 
-	// 等待检测到dead
-	select {
-	case <-deadCh:
-		// ok，收到dead回调
-	case <-time.After(300 * time.Millisecond):
-		t.Fatal("PeriodicProbe未及时触发onDead")
+	// 窗口外的切换不累计
+	tr = NewTracker(ProbeOptions{FlapLimit: 3, FlapWindow: time.Minute})
+	for i, ok := range []bool{false, true, false, true} {
+		if _, held := tr.Observe(ok, now.Add(time.Duration(i)*time.Minute)); held {
+			t.Fatalf("transitions a window apart should not count as flapping (step %d)", i)
+		}
 	}
+}
 
-	// 重新启动监听
-	ln2, err := net.Listen("tcp", addr)
+func TestProbe_Fall(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer ln2.Close()
+	addr := ln.Addr().String()
+	ln.Close()
 
-	// 等待检测到alive
+	// 结果交给 Tracker 判定，连续失败达到 Fall 才判为不可用
+	opts := ProbeOptions{Fall: 3, Timeout: 100 * time.Millisecond}
+	tracker := NewTracker(opts)
+	var probes atomic.Int32
+	deadCh := make(chan int32, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Probe(ctx, []string{addr}, 10*time.Millisecond, opts, func(_ int, r Result) {
+		n := probes.Add(1)
+		if changed, _ := tracker.Observe(r.Err == nil, time.Now()); changed && !tracker.Alive() {
+			deadCh <- n
+		}
+	})
 	select {
-	case <-aliveCh:
-		// ok，收到alive回调
-	case <-time.After(500 * time.Millisecond):
-		// 可能还没检测到，这是正常的，因为需要等待interval
-		t.Log("PeriodicProbe可能还未检测到alive，这是正常的")
+	case n := <-deadCh:
+		if n != 3 {
+			t.Errorf("target dead after %d probes, want 3", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Probe的结果未使目标判为不可用")
+	}
+}
+
+// checkerFunc 把函数适配为 Checker
+type checkerFunc func(ctx context.Context, addr string) error
+
+func (f checkerFunc) Check(ctx context.Context, addr string) error { return f(ctx, addr) }
+
+func TestProbe_StopsOnCancel(t *testing.T) {
+	// 检查进行中取消：应立即返回且不再触发回调
+	started := make(chan struct{})
+	checker := checkerFunc(func(ctx context.Context, addr string) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var calls atomic.Int32
+	go func() {
+		Probe(ctx, []string{"127.0.0.1:1"}, time.Hour, ProbeOptions{Checker: checker, Timeout: time.Hour},
+			func(int, Result) { calls.Add(1) })
+		close(done)
+	}()
+	<-started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Probe did not return after cancel")
+	}
+	if calls.Load() != 0 {
+		t.Error("no result should be observed for a check cut short by the cancel")
 	}
 }
@@ -0,0 +1,415 @@
+// Package metrics keeps counters, gauges and histograms and serves them in the Prometheus text
+// exposition format, without pulling in the Prometheus client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric types as written in # TYPE lines.
+const (
+	CounterType   = "counter"
+	GaugeType     = "gauge"
+	HistogramType = "histogram"
+)
+
+// DefBuckets are histogram upper bounds in seconds suited to network waits.
+var DefBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Sample is one series of a metric collected at scrape time, with values for the metric's labels.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// Registry holds the metrics of one process. The zero value is not usable, see NewRegistry.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]family
+}
+
+// family is one metric name with its series.
+type family interface {
+	write(w io.Writer, name string)
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]family)}
+}
+
+func (r *Registry) register(name string, f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.families[name]; exists {
+		panic("metrics: " + name + " registered twice")
+	}
+	r.families[name] = f
+}
+
+// WriteTo writes every metric in the text exposition format, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	families := make(map[string]family, len(r.families))
+	for name, f := range r.families {
+		families[name] = f
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	for _, name := range names {
+		families[name].write(cw, name)
+	}
+	if err := bw.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, cw.err
+}
+
+// Handler serves the registry for Prometheus to scrape.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = r.WriteTo(w)
+	})
+}
+
+// vec holds the series of one labeled metric, created on first use.
+type vec[T any] struct {
+	help   string
+	typ    string
+	labels []string
+	newFn  func() *T
+	mu     sync.Mutex
+	series map[string]*series[T]
+}
+
+type series[T any] struct {
+	values []string
+	metric *T
+}
+
+func newVec[T any](help, typ string, labels []string, newFn func() *T) *vec[T] {
+	return &vec[T]{help: help, typ: typ, labels: labels, newFn: newFn, series: make(map[string]*series[T])}
+}
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: got %d label values for %d labels", len(values), len(v.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &series[T]{values: append([]string(nil), values...), metric: v.newFn()}
+		v.series[key] = s
+	}
+	return s.metric
+}
+
+// delete drops the series with the given label values.
+func (v *vec[T]) delete(values []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.series, strings.Join(values, "\xff"))
+}
+
+// sorted returns the series ordered by label values.
+func (v *vec[T]) sorted() []*series[T] {
+	v.mu.Lock()
+	list := make([]*series[T], 0, len(v.series))
+	for _, s := range v.series {
+		list = append(list, s)
+	}
+	v.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return lessValues(list[i].values, list[j].values) })
+	return list
+}
+
+// Counter is a value that only goes up.
+type Counter struct{ v atomicFloat }
+
+// Inc adds one.
+func (c *Counter) Inc() { c.v.add(1) }
+
+// Add adds delta, which must not be negative.
+func (c *Counter) Add(delta float64) {
+	if delta > 0 {
+		c.v.add(delta)
+	}
+}
+
+// Value returns the current count.
+func (c *Counter) Value() float64 { return c.v.load() }
+
+// CounterVec is a counter with labels.
+type CounterVec struct{ v *vec[Counter] }
+
+// NewCounterVec registers a counter with the given label names.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{v: newVec(help, CounterType, labels, func() *Counter { return &Counter{} })}
+	r.register(name, cv)
+	return cv
+}
+
+// NewCounter registers a counter without labels.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+// With returns the counter for the given label values, in the order the labels were registered.
+func (cv *CounterVec) With(values ...string) *Counter { return cv.v.with(values) }
+
+// Delete drops the series for the given label values, e.g. once a port is gone.
+func (cv *CounterVec) Delete(values ...string) { cv.v.delete(values) }
+
+func (cv *CounterVec) write(w io.Writer, name string) {
+	writeHeader(w, name, cv.v.help, cv.v.typ)
+	for _, s := range cv.v.sorted() {
+		writeSample(w, name, cv.v.labels, s.values, "", "", s.metric.Value())
+	}
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct{ v atomicFloat }
+
+// Set replaces the value.
+func (g *Gauge) Set(value float64) { g.v.store(value) }
+
+// Inc adds one.
+func (g *Gauge) Inc() { g.v.add(1) }
+
+// Dec subtracts one.
+func (g *Gauge) Dec() { g.v.add(-1) }
+
+// Add adds delta, which may be negative.
+func (g *Gauge) Add(delta float64) { g.v.add(delta) }
+
+// Value returns the current value.
+func (g *Gauge) Value() float64 { return g.v.load() }
+
+// GaugeVec is a gauge with labels.
+type GaugeVec struct{ v *vec[Gauge] }
+
+// NewGaugeVec registers a gauge with the given label names.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	gv := &GaugeVec{v: newVec(help, GaugeType, labels, func() *Gauge { return &Gauge{} })}
+	r.register(name, gv)
+	return gv
+}
+
+// NewGauge registers a gauge without labels.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+// With returns the gauge for the given label values.
+func (gv *GaugeVec) With(values ...string) *Gauge { return gv.v.with(values) }
+
+// Delete drops the series for the given label values, e.g. once a port is gone.
+func (gv *GaugeVec) Delete(values ...string) { gv.v.delete(values) }
+
+func (gv *GaugeVec) write(w io.Writer, name string) {
+	writeHeader(w, name, gv.v.help, gv.v.typ)
+	for _, s := range gv.v.sorted() {
+		writeSample(w, name, gv.v.labels, s.values, "", "", s.metric.Value())
+	}
+}
+
+// Histogram counts observations into buckets.
+type Histogram struct {
+	bounds []float64
+	counts []atomic.Uint64 // Per bucket, not cumulative; the last one is +Inf
+	sum    atomicFloat
+	count  atomic.Uint64
+}
+
+// Observe records one value.
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.bounds, value)
+	h.counts[i].Add(1)
+	h.sum.add(value)
+	h.count.Add(1)
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 { return h.count.Load() }
+
+// HistogramVec is a histogram with labels.
+type HistogramVec struct{ v *vec[Histogram] }
+
+// NewHistogramVec registers a histogram with the given upper bounds and label names.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+	hv := &HistogramVec{v: newVec(help, HistogramType, labels, func() *Histogram {
+		return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+	})}
+	r.register(name, hv)
+	return hv
+}
+
+// NewHistogram registers a histogram without labels.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).With()
+}
+
+// With returns the histogram for the given label values.
+func (hv *HistogramVec) With(values ...string) *Histogram { return hv.v.with(values) }
+
+func (hv *HistogramVec) write(w io.Writer, name string) {
+	writeHeader(w, name, hv.v.help, hv.v.typ)
+	for _, s := range hv.v.sorted() {
+		h := s.metric
+		var cumulative uint64
+		for i := range h.counts {
+			cumulative += h.counts[i].Load()
+			le := math.Inf(1)
+			if i < len(h.bounds) {
+				le = h.bounds[i]
+			}
+			writeSample(w, name+"_bucket", hv.v.labels, s.values, "le", formatFloat(le), float64(cumulative))
+		}
+		writeSample(w, name+"_sum", hv.v.labels, s.values, "", "", h.sum.load())
+		writeSample(w, name+"_count", hv.v.labels, s.values, "", "", float64(cumulative))
+	}
+}
+
+// funcFamily is a metric whose series are collected when scraped.
+type funcFamily struct {
+	help    string
+	typ     string
+	labels  []string
+	collect func() []Sample
+}
+
+// NewFunc registers a counter or gauge whose series collect returns at every scrape, for values
+// the program already keeps elsewhere.
+func (r *Registry) NewFunc(name, help, typ string, labels []string, collect func() []Sample) {
+	r.register(name, &funcFamily{help: help, typ: typ, labels: labels, collect: collect})
+}
+
+// NewGaugeFunc registers an unlabeled gauge read from fn at every scrape.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.NewFunc(name, help, GaugeType, nil, func() []Sample { return []Sample{{Value: fn()}} })
+}
+
+func (f *funcFamily) write(w io.Writer, name string) {
+	samples := f.collect()
+	sort.Slice(samples, func(i, j int) bool { return lessValues(samples[i].Labels, samples[j].Labels) })
+	writeHeader(w, name, f.help, f.typ)
+	for _, s := range samples {
+		writeSample(w, name, f.labels, s.Labels, "", "", s.Value)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeSample writes one line; extraName/extraValue add a label such as a histogram's le.
+func writeSample(w io.Writer, name string, labels, values []string, extraName, extraValue string, value float64) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		b.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			v := ""
+			if i < len(values) {
+				v = values[i]
+			}
+			fmt.Fprintf(&b, `%s="%s"`, label, labelEscaper.Replace(v))
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, `%s="%s"`, extraName, extraValue)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(value))
+	b.WriteByte('\n')
+	_, _ = io.WriteString(w, b.String())
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// lessValues orders label values, numbers numerically so ports sort naturally.
+func lessValues(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		na, errA := strconv.Atoi(a[i])
+		nb, errB := strconv.Atoi(b[i])
+		if errA == nil && errB == nil {
+			return na < nb
+		}
+		return a[i] < b[i]
+	}
+	return len(a) < len(b)
+}
+
+// atomicFloat is a float64 updated without locks.
+type atomicFloat struct{ bits atomic.Uint64 }
+
+func (f *atomicFloat) load() float64 { return math.Float64frombits(f.bits.Load()) }
+
+func (f *atomicFloat) store(v float64) { f.bits.Store(math.Float64bits(v)) }
+
+func (f *atomicFloat) add(delta float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
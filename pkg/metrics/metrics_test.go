@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_TextFormat(t *testing.T) {
+	r := NewRegistry()
+	relays := r.NewGaugeVec("relays", "Active relays.", "port")
+	relays.With("9000").Inc()
+	relays.With("80").Add(2)
+	r.NewCounter("auth_failures_total", "Rejected tokens.").Inc()
+	r.NewFunc("bytes_total", "Bytes.", CounterType, []string{"port", "direction"}, func() []Sample {
+		return []Sample{{Labels: []string{"80", `in"`}, Value: 5}}
+	})
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP auth_failures_total Rejected tokens.
+# TYPE auth_failures_total counter
+auth_failures_total 1
+# HELP bytes_total Bytes.
+# TYPE bytes_total counter
+bytes_total{port="80",direction="in\""} 5
+# HELP relays Active relays.
+# TYPE relays gauge
+relays{port="80"} 2
+relays{port="9000"} 1
+`
+	if b.String() != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestHistogram_Buckets(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("wait_seconds", "Wait.", []float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		h.Observe(v)
+	}
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	// 桶为累计计数，边界值计入该桶
+	for _, line := range []string{
+		`wait_seconds_bucket{le="0.1"} 2`,
+		`wait_seconds_bucket{le="1"} 3`,
+		`wait_seconds_bucket{le="+Inf"} 4`,
+		`wait_seconds_sum 3.65`,
+		`wait_seconds_count 4`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, rec.Body.String())
+		}
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestRegistry_DuplicatePanics(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("x", "")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a name twice to panic")
+		}
+	}()
+	r.NewGauge("x", "")
+}
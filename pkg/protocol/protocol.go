@@ -3,42 +3,141 @@ package protocol
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"gotunnel/pkg/log"
 	"io"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // HeartbeatPing represents a heartbeat ping packet for the control channel to keep client-server connection alive.
 // Server should immediately reply with HeartbeatPong upon receiving.
 // Type is fixed: "ping"
 type HeartbeatPing struct {
-	Type string `json:"type"` // "ping"
-	Time int64  `json:"time"` // Optional, current timestamp, can be used for monitoring logs
+	Type string    `json:"type"`          // "ping"
+	Time int64     `json:"time"`          // Send time in Unix nanoseconds, echoed back in the pong
+	RTT  *RTTStats `json:"rtt,omitempty"` // Optional, the client's latest round-trip statistics
 }
 
 // HeartbeatPong represents a heartbeat pong response packet.
 // Type is fixed: "pong"
 type HeartbeatPong struct {
 	Type string `json:"type"` // "pong"
-	Time int64  `json:"time"` // Optional
+	Time int64  `json:"time"` // Time of the ping being answered, so the client can compute the round trip
+}
+
+// RTTStats summarizes control channel round-trip times over a sliding window of heartbeats.
+// Durations are encoded in nanoseconds.
+type RTTStats struct {
+	Samples int           `json:"samples"`
+	Last    time.Duration `json:"last"`
+	Min     time.Duration `json:"min"`
+	Avg     time.Duration `json:"avg"`
+	Max     time.Duration `json:"max"`
+	Jitter  time.Duration `json:"jitter"` // Mean difference between consecutive samples
 }
 
 // RegisterRequest represents a control message structure for client port registration (for registering ports that need to be proxied by server).
 type RegisterRequest struct {
-	Type       string `json:"type"`        // Fixed as "register"
-	LocalPort  int    `json:"local_port"`  // Local port on client that needs to be mapped
-	RemotePort int    `json:"remote_port"` // Public port on server opened for this mapping
-	Protocol   string `json:"protocol"`    // Protocol "tcp"/"http" etc.
-	Token      string `json:"token"`       // Authentication token
-	Name       string `json:"name"`        // Client custom name
+	Type       string `json:"type"`                 // Fixed as "register"
+	LocalPort  int    `json:"local_port"`           // Local port on client that needs to be mapped
+	RemotePort int    `json:"remote_port"`          // Public port on server opened for this mapping, 0 lets the server allocate one
+	Protocol   string `json:"protocol"`             // Protocol "tcp"/"http" etc.
+	Token      string `json:"token"`                // Authentication token
+	Name       string `json:"name"`                 // Client custom name
+	PortRange  string `json:"port_range,omitempty"` // Acceptable remote ports "min-max" when RemotePort is 0
+	BindAddr   string `json:"bind_addr,omitempty"`  // Server address or interface to bind the public listener to
+	SessionID  string `json:"session_id,omitempty"` // Client session, lets a reconnect resume the existing mapping
+
+	HeartbeatInterval int  `json:"heartbeat_interval,omitempty"` // Client ping interval in seconds
+	HeartbeatAdapts   bool `json:"heartbeat_adapts,omitempty"`   // Client shortens its interval to the advertised heartbeat timeout
+
+	// Tunnel groups: clients registering the same group and key share one public port
+	Group    string `json:"group,omitempty"`     // Group name
+	GroupKey string `json:"group_key,omitempty"` // Key every member of the group must present
+	LBPolicy string `json:"lb_policy,omitempty"` // "round_robin", "least_conn" or "source_hash", set by the first member
+
+	// BackupFor registers a hot standby for the tunnel with this name: it only gets users while
+	// no client of the primary tunnel is connected and online
+	BackupFor string `json:"backup_for,omitempty"`
+
+	// While every client of the tunnel is offline, KeepOpen keeps the public port open: users of an
+	// "http" tunnel get a 503 with MaintenancePage, others wait up to HoldTimeout seconds for it to return
+	KeepOpen        bool   `json:"keep_open,omitempty"`
+	HoldTimeout     int    `json:"hold_timeout,omitempty"`
+	MaintenancePage string `json:"maintenance_page,omitempty"`
+
+	// ClientIP carries the user's address when one server node forwards a user to another (peer_forward)
+	ClientIP string `json:"client_ip,omitempty"`
+
+	// ConnID pairs an open_data_channel command with the data_channel registration answering it
+	ConnID string `json:"conn_id,omitempty"`
 }
 
 // RegisterResponse represents a control message for server registration response, used for confirmation/rejection.
 type RegisterResponse struct {
-	Type   string `json:"type"`             // Fixed as "register_resp"
-	Status string `json:"status"`           // "ok" / "fail"
-	Reason string `json:"reason,omitempty"` // Reason for failure
+	Type       string `json:"type"`                  // Fixed as "register_resp"
+	Status     string `json:"status"`                // "ok" / "fail"
+	Reason     string `json:"reason,omitempty"`      // Reason for failure
+	RemotePort int    `json:"remote_port,omitempty"` // Remote port actually assigned by server
+	PublicAddr string `json:"public_addr,omitempty"` // Public address users connect to, e.g. "1.2.3.4:20001"
+	Resumed    bool   `json:"resumed,omitempty"`     // Registration picked up an existing session without closing the listener
+
+	HeartbeatTimeout int `json:"heartbeat_timeout,omitempty"` // Seconds of silence after which the server drops the client
+}
+
+// PortRange is an inclusive range of TCP ports, written as "min-max" in config and on the wire.
+// The zero value means "no range".
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// ParsePortRange parses "20000-20100" (or a single port "20000") into a PortRange.
+func ParsePortRange(s string) (PortRange, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return PortRange{}, nil
+	}
+	first, last, found := strings.Cut(s, "-")
+	lo, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	hi := lo
+	if found {
+		if hi, err = strconv.Atoi(strings.TrimSpace(last)); err != nil {
+			return PortRange{}, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{Min: lo, Max: hi}, nil
 }
 
+// IsZero reports whether the range is unset.
+func (r PortRange) IsZero() bool { return r.Min == 0 && r.Max == 0 }
+
+// Intersect returns the overlap of two ranges, ok is false when they do not overlap.
+func (r PortRange) Intersect(o PortRange) (PortRange, bool) {
+	out := PortRange{Min: r.Min, Max: r.Max}
+	if o.Min > out.Min {
+		out.Min = o.Min
+	}
+	if o.Max < out.Max {
+		out.Max = o.Max
+	}
+	if out.Min > out.Max {
+		return PortRange{}, false
+	}
+	return out, true
+}
+
+// String formats the range as "min-max".
+func (r PortRange) String() string { return fmt.Sprintf("%d-%d", r.Min, r.Max) }
+
 // OfflinePortRequest notifies server that a port (remote_port) should go offline, stop public listening and mapping.
 // Type: "offline_port"
 type OfflinePortRequest struct {
@@ -53,6 +152,45 @@ type OnlinePortRequest struct {
 	Port int    `json:"port"` // remote_port to be restored
 }
 
+// HealthReport explains the state of a tunnel's local service. The client sends one on every
+// health transition and periodically; offline_port/online_port still decide whether users are
+// sent, the report tells the server why.
+// Type: "health_report"
+type HealthReport struct {
+	Type     string          `json:"type"`               // "health_report"
+	Port     int             `json:"port"`               // remote_port the report is for
+	Status   string          `json:"status"`             // "up" while at least one backend is healthy, else "down"
+	Checker  string          `json:"checker"`            // Check type, e.g. "tcp" or "http"
+	Healthy  int             `json:"healthy"`            // Healthy backends
+	Backends []BackendHealth `json:"backends,omitempty"` // Detail per backend
+}
+
+// BackendHealth is the health of one backend in a HealthReport. Durations are encoded in nanoseconds.
+type BackendHealth struct {
+	Addr      string        `json:"addr"`
+	Status    string        `json:"status"`               // "up" or "down"
+	Error     string        `json:"error,omitempty"`      // Error of the last failed check
+	Latency   time.Duration `json:"latency"`              // Duration of the last check
+	Failures  int           `json:"failures"`             // Consecutive failed checks
+	LastCheck int64         `json:"last_check,omitempty"` // Time of the last check in Unix seconds
+}
+
+// UnregisterRequest tells the server a client is shutting down on purpose and the mapping for Port can be released.
+// Relays already in progress are left to finish.
+// Type: "unregister"
+type UnregisterRequest struct {
+	Type string `json:"type"` // "unregister"
+	Port int    `json:"port"` // remote_port to release
+}
+
+// GoAway is sent by a draining server to ask the client to reconnect later or to another server.
+// It is not an error: the client should drop the control channel quietly and go through its normal reconnect path.
+// Type: "goaway"
+type GoAway struct {
+	Type   string `json:"type"`             // "goaway"
+	Reason string `json:"reason,omitempty"` // Human readable reason, e.g. "server shutting down"
+}
+
 // WritePacket writes a complete message to the connection, format: 4-byte payload length (big-endian) + original message content (payload).
 // Parameters:
 //
@@ -68,15 +206,13 @@ func WritePacket(w io.Writer, payload []byte) error {
 		log.Errorf("protocol", "error.payload_too_large", len(payload))
 		return errors.New("payload too large")
 	}
-	// Store payload length in 4 bytes big-endian
-	var lenBuf [4]byte
-	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(payload)))
-	// Write packet length first, then payload content
-	if _, err1 := w.Write(lenBuf[:]); err1 != nil {
-		return err1
-	}
-	_, err2 := w.Write(payload)
-	return err2
+	// Store payload length in 4 bytes big-endian, followed by the payload.
+	// A single Write keeps frames intact when several goroutines write to the same control connection.
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)))
+	copy(buf[4:], payload)
+	_, err := w.Write(buf)
+	return err
 }
 
 // ReadPacket reads a complete message from the connection, format requirement same as above (4-byte payload length + actual content).
@@ -109,6 +109,40 @@ func TestHeartbeatPingStruct(t *testing.T) {
 	}
 }
 
+func TestParsePortRange(t *testing.T) {
+	r, err := ParsePortRange("20000-20100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Min != 20000 || r.Max != 20100 {
+		t.Errorf("端口范围解析异常: %+v", r)
+	}
+	single, err := ParsePortRange("8080")
+	if err != nil || single.Min != 8080 || single.Max != 8080 {
+		t.Errorf("单端口应解析为8080-8080, got %+v err=%v", single, err)
+	}
+	empty, err := ParsePortRange("")
+	if err != nil || !empty.IsZero() {
+		t.Errorf("空字符串应返回零值范围")
+	}
+	for _, bad := range []string{"abc", "20100-20000", "0-10", "1-70000", "1-x"} {
+		if _, err := ParsePortRange(bad); err == nil {
+			t.Errorf("%q 应解析失败", bad)
+		}
+	}
+}
+
+func TestPortRangeIntersect(t *testing.T) {
+	a := PortRange{Min: 20000, Max: 20100}
+	got, ok := a.Intersect(PortRange{Min: 20050, Max: 30000})
+	if !ok || got.Min != 20050 || got.Max != 20100 {
+		t.Errorf("交集计算错误: %+v", got)
+	}
+	if _, ok := a.Intersect(PortRange{Min: 1, Max: 100}); ok {
+		t.Error("不相交的范围应返回false")
+	}
+}
+
 func TestWritePacketError(t *testing.T) {
 	// Test write error
 	ew := &errorWriter{}
@@ -157,3 +191,20 @@ type errorReader struct{}
 func (e *errorReader) Read([]byte) (int, error) {
 	return 0, errors.New("read error")
 }
+
+func TestHealthReportStruct(t *testing.T) {
+	rep := HealthReport{Type: "health_report", Port: 10022, Status: "down", Checker: "http", Backends: []BackendHealth{
+		{Addr: "127.0.0.1:8080", Status: "down", Error: "status 502", Latency: 2 * time.Millisecond, Failures: 3},
+	}}
+	b, err := json.Marshal(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out HealthReport
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Type != "health_report" || len(out.Backends) != 1 || out.Backends[0].Latency != 2*time.Millisecond || out.Backends[0].Failures != 3 {
+		t.Errorf("HealthReport序列化异常: %+v", out)
+	}
+}